@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/golang_db/internal"
+	"github.com/golang_db/internal/sql"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -34,34 +37,394 @@ func errorIfUnexpectedNumArgs(expected int, args []string) *parserError {
 	return nil
 }
 
+// Used to check if at least a minimum number of tokens/arguments provided for command
+//
+// PARAMS:
+//
+//	min - minimum number of args expected
+//	args - array of arguments (not including command opcode itself)
+//
+// RETURNS:
+//
+//	parser error w/ appropriate message if too few args
+//	otherwise nil
+func errorIfTooFewArgs(min int, args []string) *parserError {
+	if len(args) < min {
+		return &parserError{fmt.Sprintf("EXPECTED AT LEAST %d ARGUMENTS, GOT %d", min, len(args))}
+	}
+	return nil
+}
+
+// Parses a comma-seperated list of column assignments, e.g. "name='Jane', age='30'"
+// Values must be wrapped in single quotemarks. A quotemark inside a value is escaped by doubling it
+//
+// PARAMS: assignmentsStr - the list of assignments
+//
+// RETURNS:
+//
+//	map with assigned column names as keys and their new values as values
+//	parser error if the list is malformed, otherwise nil
+func parseAssignments(assignmentsStr string) (map[string]string, *parserError) {
+
+	res := make(map[string]string)
+	remaining := strings.TrimSpace(assignmentsStr)
+	for len(remaining) > 0 {
+
+		// Column name is everything up to the '='
+		eqIdx := strings.Index(remaining, "=")
+		if eqIdx == -1 {
+			return nil, &parserError{fmt.Sprintf("EXPECTED '=' IN ASSIGNMENT '%s'", remaining)}
+		}
+		col := strings.TrimSpace(remaining[:eqIdx])
+		if col == "" {
+			return nil, &parserError{"MISSING COLUMN NAME IN ASSIGNMENT"}
+		}
+
+		// Value is the quoted string after the '='
+		remaining = strings.TrimSpace(remaining[eqIdx+1:])
+		if !strings.HasPrefix(remaining, "'") {
+			return nil, &parserError{fmt.Sprintf("VALUE FOR COLUMN '%s' MUST BE IN SINGLE QUOTEMARKS", col)}
+		}
+		var value strings.Builder
+		i := 1
+		closed := false
+		for i < len(remaining) {
+			if remaining[i] == '\'' {
+				if i+1 < len(remaining) && remaining[i+1] == '\'' { // Escaped quotemark
+					value.WriteByte('\'')
+					i += 2
+					continue
+				}
+				closed = true
+				i++
+				break
+			}
+			value.WriteByte(remaining[i])
+			i++
+		}
+		if !closed {
+			return nil, &parserError{fmt.Sprintf("UNTERMINATED VALUE FOR COLUMN '%s'", col)}
+		}
+		res[col] = value.String()
+
+		// Assignments are seperated by commas
+		remaining = strings.TrimSpace(remaining[i:])
+		if len(remaining) > 0 {
+			if remaining[0] != ',' {
+				return nil, &parserError{fmt.Sprintf("EXPECTED ',' AFTER VALUE FOR COLUMN '%s'", col)}
+			}
+			remaining = strings.TrimSpace(remaining[1:])
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, &parserError{"NO COLUMNS ASSIGNED"}
+	}
+	return res, nil
+}
+
+// A clause of a command, e.g. the 'where' clause of a select command
+//
+// FIELDS:
+//
+//	keyword - the keyword the clause starts with (e.g. 'where', 'order by')
+//	args - the arguments after the keyword, up until the next clause
+type clause struct {
+	keyword string
+	args    []arg
+}
+
+// Splits a command's arguments into clauses, each starting w/ one of a set of keywords
+// Arguments before the first keyword are returned seperately. Keywords may be multiple words (e.g. 'order by'),
+// and are matched case-insensitively. Quoted arguments never match a keyword. A clause can't appear more than once
+//
+// PARAMS:
+//
+//	args - array of arguments (not including command opcode itself)
+//	keywords - keywords that start clauses
+//
+// RETURNS:
+//
+//	arguments before the first clause
+//	map of clauses found, keyed by keyword
+//	parser error if a clause appears more than once, otherwise nil
+func splitClauses(args []arg, keywords ...string) ([]arg, map[string]*clause, *parserError) {
+	leading := make([]arg, 0, len(args))
+	clauses := make(map[string]*clause)
+	var current *clause
+
+	for i := 0; i < len(args); i++ {
+
+		// Check if a keyword starts at this argument
+		foundKeyword := ""
+		for _, keyword := range keywords {
+			words := strings.Fields(keyword)
+			if i+len(words) <= len(args) && keywordsAt(args[i:i+len(words)], words) {
+				foundKeyword = keyword
+				i += len(words) - 1
+				break
+			}
+		}
+
+		switch {
+		case foundKeyword != "":
+			if _, seen := clauses[foundKeyword]; seen {
+				return nil, nil, &parserError{fmt.Sprintf("'%s' GIVEN MORE THAN ONCE", strings.ToUpper(foundKeyword))}
+			}
+			current = &clause{foundKeyword, make([]arg, 0, 5)}
+			clauses[foundKeyword] = current
+		case current == nil:
+			leading = append(leading, args[i])
+		default:
+			current.args = append(current.args, args[i])
+		}
+	}
+
+	return leading, clauses, nil
+}
+
+// Checks if a join starts at an argument, i.e. the argument is 'join', or 'left'/'inner' followed by 'join'
+//
+// RETURNS: the kind of join, and the number of arguments its keyword takes up (0 if no join starts there)
+func joinKeywordAt(args []arg, i int) (internal.JoinKind, int) {
+	switch {
+	case isKeyword(args[i], "join"):
+		return internal.INNER_JOIN, 1
+	case i+1 < len(args) && isKeyword(args[i+1], "join") && isKeyword(args[i], "inner"):
+		return internal.INNER_JOIN, 2
+	case i+1 < len(args) && isKeyword(args[i+1], "join") && isKeyword(args[i], "left"):
+		return internal.LEFT_JOIN, 2
+	default:
+		return internal.INNER_JOIN, 0
+	}
+}
+
+// Splits the joins off the end of a command's arguments
+// Each join has the form '[left|inner] join <db> on <db>.<col> = <db>.<col> [and <db>.<col> = <db>.<col>]...'
+//
+// PARAMS: args - array of arguments, w/ any joins at the end
+//
+// RETURNS:
+//
+//	arguments before the first join
+//	the joins, in order
+//	parser error if a join is malformed, otherwise nil
+func splitJoins(args []arg) ([]arg, []internal.Join, *parserError) {
+	// Find where each join starts
+	starts := make([]int, 0, 2)
+	for i := 0; i < len(args); i++ {
+		if _, numWords := joinKeywordAt(args, i); numWords > 0 {
+			starts = append(starts, i)
+			i += numWords - 1
+		}
+	}
+	if len(starts) == 0 {
+		return args, nil, nil
+	}
+
+	joins := make([]internal.Join, 0, len(starts))
+	for n, start := range starts {
+		end := len(args)
+		if n+1 < len(starts) {
+			end = starts[n+1]
+		}
+		kind, numWords := joinKeywordAt(args, start)
+		joinArgs := args[start+numWords : end]
+		if len(joinArgs) < 3 || !isKeyword(joinArgs[1], "on") {
+			return nil, nil, &parserError{"EXPECTED 'JOIN <db> ON <condition>'"}
+		}
+
+		// Keys are seperated by 'and'. Spaces around '=' are optional
+		join := internal.Join{Kind: kind, DB: joinArgs[0].value}
+		keyStrs := []string{""}
+		for _, a := range joinArgs[2:] {
+			if isKeyword(a, "and") {
+				keyStrs = append(keyStrs, "")
+			} else {
+				keyStrs[len(keyStrs)-1] += a.value
+			}
+		}
+		for _, keyStr := range keyStrs {
+			left, right, found := strings.Cut(keyStr, "=")
+			if !found || left == "" || right == "" {
+				return nil, nil, &parserError{fmt.Sprintf("EXPECTED '<col> = <col>' IN JOIN OF '%s', GOT '%s'", join.DB, keyStr)}
+			}
+			join.On = append(join.On, internal.JoinKey{Left: left, Right: right})
+		}
+		joins = append(joins, join)
+	}
+	return args[:starts[0]], joins, nil
+}
+
+// Checks if each of a list of arguments is the corresponding keyword in a list of keywords
+func keywordsAt(args []arg, keywords []string) bool {
+	for i, keyword := range keywords {
+		if !isKeyword(args[i], keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses the single integer argument of a clause such as 'limit'
+//
+// PARAMS:
+//
+//	c - the clause
+//	min - smallest number allowed
+func parseCountClause(c *clause, min int) (int, *parserError) {
+	if len(c.args) != 1 {
+		return 0, &parserError{fmt.Sprintf("EXPECTED 1 NUMBER AFTER '%s'", strings.ToUpper(c.keyword))}
+	}
+	n, err := strconv.Atoi(c.args[0].value)
+	if err != nil || n < min {
+		return 0, &parserError{fmt.Sprintf("EXPECTED A NUMBER OF AT LEAST %d AFTER '%s', GOT '%s'", min, strings.ToUpper(c.keyword), c.args[0].value)}
+	}
+	return n, nil
+}
+
+// Gets the condition of a clause such as 'where', exactly as written in the command
+// An empty clause is an error, as only leaving the clause out means every entry
+//
+// PARAMS:
+//
+//	command - the command as typed
+//	c - the clause
+func conditionClause(command string, c *clause) (string, *parserError) {
+	if len(c.args) == 0 {
+		return "", &parserError{"EXPECTED CONDITION"}
+	}
+	return rawText(command, c.args), nil
+}
+
+// Prints the entries in a result set, under a line of column names
+func printResultSet(res *internal.ResultSet) {
+	fmt.Println(strings.Join(res.Columns, " | "))
+	for _, row := range res.Rows {
+		fmt.Println(strings.Join(row, " | "))
+	}
+}
+
+// Prints an error returned from running a command
+// If the error is in a condition string or SQL statement, that is printed too, w/ a marker under where the error is
+//
+// PARAMS: err - the error
+func printError(err error) {
+	fmt.Println(err.Error())
+
+	var condErr *internal.ConditionError
+	var syntaxErr *sql.SyntaxError
+	switch {
+	case errors.As(err, &condErr):
+		fmt.Println("  " + condErr.Condition)
+		fmt.Println("  " + strings.Repeat(" ", condErr.Offset) + "^")
+	case errors.As(err, &syntaxErr):
+		fmt.Println("  " + syntaxErr.Statement)
+		fmt.Println("  " + strings.Repeat(" ", syntaxErr.Offset) + "^")
+	}
+}
+
+// Text printed by the help command
+// There are 2 ways of writing commands, parsed seperately: the original commands below, and SQL statements (see sql.Parse)
+const helpText = `Commands can be written in either of 2 forms:
+
+  1. A command, i.e. an opcode followed by it's arguments. Arguments w/ spaces must be quoted, e.g. 'Jane Doe'
+       createdb <db> <col>[:<type>] ...
+       dropdb <db>
+       renamedb <db> <new name>
+       listdbs
+       columns <db>
+       createindex <db> <col> ... [unique] [hash|btree]
+       insert <db> <col> ... | <value> ...
+       select <db> <select list> [[left] join <db> on <col> = <col>]... [where <condition>] [group by <col>,...]
+              [having <condition>] [order by <col> [asc|desc],...] [limit <n>] [offset <n>]
+       update <db> set <col>='<value>',... where <condition>
+       delete <db> where <condition>
+       begin | commit | rollback
+       help
+       exit
+
+  2. One or more SQL statements, seperated by semicolons. Anything ending in a semicolon is SQL, e.g.
+       CREATE TABLE users (name, age int);
+       SELECT name FROM users WHERE age > 30 ORDER BY name;
+     Supported statements are CREATE TABLE, DROP TABLE, ALTER TABLE, INSERT, SELECT, UPDATE, DELETE, BEGIN, COMMIT and ROLLBACK
+     An UPDATE or DELETE w/o a WHERE clause changes every entry, which the update and delete commands can't do
+
+Conditions are written the same way in both forms, e.g. age > 30 and name like 'J%'`
+
+// Parse Parses and runs a command typed into the REPL, printing it's results (see helpText for the forms a command can take)
 func Parse(command string, coll *internal.Collection) {
-	tokens := strings.Split(command, " ")
-	opcode := tokens[0]
+
+	// Commands ending in a semicolon are SQL statements, anything else is an opcode followed by it's arguments
+	if strings.HasSuffix(strings.TrimSpace(command), ";") {
+		executeSQL(command, coll)
+		return
+	}
+
+	tokens, err := tokenizeCommand(command)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if len(tokens) == 0 {
+		return
+	}
+	opcode := tokens[0].value
 	args := tokens[1:]
+	values := argValues(args)
 	switch {
 
 	case opcode == "createdb":
-		// New DB name is first argument, rest are all new column names
-		coll.NewDB(args[0], args[1:]...)
+		// New DB name is first argument, rest are all new column definitions ('name' or 'name:type')
+		err := errorIfTooFewArgs(1, values)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		txErr := errorIfInTx(coll, "CREATEDB")
+		if txErr != nil {
+			fmt.Println(txErr.Error())
+			return
+		}
+
+		dbErr := coll.NewDB(values[0], values[1:]...)
+		if dbErr != nil {
+			fmt.Println(dbErr.Error())
+		}
 
 	case opcode == "dropdb":
-		err := errorIfUnexpectedNumArgs(1, args)
+		err := errorIfUnexpectedNumArgs(1, values)
 		if err != nil {
 			fmt.Println(err.Error())
+			return
+		}
+
+		txErr := errorIfInTx(coll, "DROPDB")
+		if txErr != nil {
+			fmt.Println(txErr.Error())
+			return
 		}
 
-		err2 := coll.DropDB(args[0])
+		err2 := coll.DropDB(values[0])
 		if err2 != nil {
 			fmt.Println(err2.Error()) // Display any errors passed forward by dropDB
 		}
 
 	case opcode == "renamedb":
-		err := errorIfUnexpectedNumArgs(2, args)
+		err := errorIfUnexpectedNumArgs(2, values)
 		if err != nil {
 			fmt.Println(err.Error())
+			return
+		}
+
+		txErr := errorIfInTx(coll, "RENAMEDB")
+		if txErr != nil {
+			fmt.Println(txErr.Error())
+			return
 		}
 
-		err2 := coll.RenameDB(args[0], args[1])
+		err2 := coll.RenameDB(values[0], values[1])
 		if err2 != nil {
 			fmt.Println(err2.Error())
 		}
@@ -71,56 +434,293 @@ func Parse(command string, coll *internal.Collection) {
 
 	case opcode == "columns": // Print all columns of DB
 
-		err := errorIfUnexpectedNumArgs(1, args)
+		err := errorIfUnexpectedNumArgs(1, values)
 		if err != nil {
 			fmt.Println(err.Error())
+			return
 		}
 
-		dbName := args[0]
-		db, foundKey := coll.DBs[dbName]
+		db, err2 := getDB(coll, values[0])
 		// Raise non-fatal error & return from method if invalid database name provided
-		if !foundKey {
-			err2 := internal.collError{fmt.Sprintf("NO DATABASE CALLED '%s' IN COLLECTION '%s'", dbName, coll.Name)}
+		if err2 != nil {
 			fmt.Println(err2.Error())
 			return
 		}
 
-		for _, name := range db.Columns {
-			fmt.Println(name)
+		columns, types := db.Schema()
+		for _, name := range columns {
+			fmt.Printf("%s %s\n", name, types[name])
+		}
+
+	case opcode == "createindex":
+		// Command format: createindex <db> <col> ... [unique] [hash|btree]
+		// Indexes are hash indexes unless btree is given. An index on more than 1 column is a composite index
+		// Columns called unique, hash or btree must be quoted
+		kind, unique := internal.HASH_INDEX, false
+		for len(args) > 0 {
+			last := args[len(args)-1]
+			if isKeyword(last, "unique") {
+				unique = true
+			} else if isKeyword(last, "hash") || isKeyword(last, "btree") {
+				kind, _ = internal.ParseIndexKind(last.value)
+			} else {
+				break
+			}
+			args = args[:len(args)-1]
+		}
+		err := errorIfTooFewArgs(2, argValues(args))
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		db, err2 := getDB(coll, args[0].value)
+		if err2 != nil {
+			fmt.Println(err2.Error())
+			return
+		}
+
+		err2 = db.CreateIndex(argValues(args[1:]), kind, unique)
+		if err2 != nil {
+			fmt.Println(err2.Error())
 		}
 
 	case opcode == "insert":
-		dbName := args[0]
-		db, foundKey := coll.DBs[dbName]
-		// Raise non-fatal error & return from method if invalid database name provided
-		if !foundKey {
-			err := internal.collError{fmt.Sprintf("NO DATABASE CALLED '%s' IN COLLECTION '%s'", dbName, coll.Name)}
+		// Command format: insert <db> <col> ... | <value> ...
+		// Values w/ spaces (or that are just a pipe char) must be quoted, e.g. insert people name | 'Jane Doe'
+		err := errorIfTooFewArgs(1, values)
+		if err != nil {
 			fmt.Println(err.Error())
 			return
 		}
 
+		db, err2 := getDB(coll, values[0])
+		// Raise non-fatal error & return from method if invalid database name provided
+		if err2 != nil {
+			fmt.Println(err2.Error())
+			return
+		}
+
 		// Parse columns & values from remaining arguments
 		columns := make([]string, 0, 10)
-		values := make([]string, 0, 10)
+		entryValues := make([]string, 0, 10)
 		target := &columns
-		for i := 1; i < len(args); i++ {
-			if args[i] == "|" { // Pipe char seperates columns from values
-				target = &values
+		for _, a := range args[1:] {
+			if a.value == "|" && !a.quoted { // Pipe char seperates columns from values
+				target = &entryValues
 				continue
 			}
-			*target = append(*target, args[i])
+			*target = append(*target, a.value)
 		}
 
-		dbErr := db.Insert(columns, values)
+		dbErr := db.Insert(columns, entryValues)
 		if dbErr != nil {
 			fmt.Println(dbErr.Error())
 		}
 
+	case opcode == "select":
+		// Command format: select <db> <select list> [where <condition>] [group by <col>,...] [having <condition>]
+		//                 [order by <col> [asc|desc],...] [limit <n>] [offset <n>]
+		// where the select list is '*' or a comma-seperated list of column names and aggregates (e.g. 'city, count(*)')
+		// Other databases can be joined on after the select list: select <db> <select list> [[left] join <db> on <col> = <col>]...
+		// Columns in a query w/ joins must be qualified w/ their database's name (e.g. users.name)
+		// Conditions are taken exactly as written, so keep their own quoting (e.g. where name = 'Jane Doe')
+		leading, clauses, err := splitClauses(args, "where", "group by", "having", "order by", "limit", "offset")
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		leading, joins, err := splitJoins(leading)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if len(leading) < 2 {
+			fmt.Println((&parserError{fmt.Sprintf("EXPECTED DATABASE AND SELECT LIST, GOT %d ARGUMENTS", len(leading))}).Error())
+			return
+		}
+
+		var err2 error
+		query := internal.SelectQuery{}
+		query.Columns, query.Aggregates, err2 = internal.ParseSelectList(strings.Join(argValues(leading[1:]), " "))
+		if err2 != nil {
+			fmt.Println(err2.Error())
+			return
+		}
+		if where, found := clauses["where"]; found {
+			query.Condition, err = conditionClause(command, where)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+		}
+		if groupBy, found := clauses["group by"]; found {
+			for _, col := range strings.Split(strings.Join(argValues(groupBy.args), " "), ",") {
+				query.GroupBy = append(query.GroupBy, strings.TrimSpace(col))
+			}
+		}
+		if having, found := clauses["having"]; found {
+			query.Having, err = conditionClause(command, having)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+		}
+		if orderBy, found := clauses["order by"]; found {
+			query.OrderBy, err2 = internal.ParseOrderBy(strings.Join(argValues(orderBy.args), " "))
+			if err2 != nil {
+				fmt.Println(err2.Error())
+				return
+			}
+		}
+		if limit, found := clauses["limit"]; found {
+			query.Limit, err = parseCountClause(limit, 1) // A limit of 0 in a query means no limit, so isn't allowed here
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+		}
+		if offset, found := clauses["offset"]; found {
+			query.Offset, err = parseCountClause(offset, 0)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+		}
+
+		var res *internal.ResultSet
+		if len(joins) == 0 {
+			db, dbErr := getDB(coll, leading[0].value)
+			if dbErr != nil {
+				fmt.Println(dbErr.Error())
+				return
+			}
+			res, err2 = db.Select(query)
+		} else {
+			res, err2 = selectJoined(coll, leading[0].value, joins, query)
+		}
+		if err2 != nil {
+			printError(err2)
+			return
+		}
+		printResultSet(res)
+
+	case opcode == "update":
+		// Command format: update <db> set <col>='<value>',... where <condition>
+		// Assignments and the condition are taken exactly as written, so keep their own quoting
+		// The condition is required, so a missing one can't update every entry by mistake
+		err := errorIfTooFewArgs(3, values)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if !isKeyword(args[1], "set") {
+			fmt.Println((&parserError{fmt.Sprintf("EXPECTED 'set', GOT '%s'", values[1])}).Error())
+			return
+		}
+
+		db, err2 := getDB(coll, values[0])
+		if err2 != nil {
+			fmt.Println(err2.Error())
+			return
+		}
+
+		_, clauses, err := splitClauses(args[1:], "set", "where")
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		assignments, err := parseAssignments(rawText(command, clauses["set"].args))
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		where, found := clauses["where"]
+		if !found {
+			fmt.Println((&parserError{"EXPECTED 'where' CLAUSE"}).Error())
+			return
+		}
+		conditionStr, err := conditionClause(command, where)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		numUpdated, dbErr := db.Update(assignments, conditionStr)
+		if dbErr != nil {
+			printError(dbErr)
+			return
+		}
+		fmt.Printf("UPDATED %d ENTRIES\n", numUpdated)
+
+	case opcode == "delete":
+		// Command format: delete <db> where <condition>
+		// The condition is taken exactly as written, so keeps it's own quoting
+		// The condition is required, so a missing one can't delete every entry by mistake
+		err := errorIfTooFewArgs(2, values)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		db, err2 := getDB(coll, values[0])
+		if err2 != nil {
+			fmt.Println(err2.Error())
+			return
+		}
+
+		// Everything after the 'where' keyword is the condition string
+		if !isKeyword(args[1], "where") {
+			fmt.Println((&parserError{fmt.Sprintf("EXPECTED 'where', GOT '%s'", values[1])}).Error())
+			return
+		}
+		conditionStr, err := conditionClause(command, &clause{"where", args[2:]})
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		numDeleted, dbErr := db.Delete(conditionStr)
+		if dbErr != nil {
+			printError(dbErr)
+			return
+		}
+		fmt.Printf("DELETED %d ENTRIES\n", numDeleted)
+
+	case opcode == "begin":
+		err := beginTx(coll)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+
+	case opcode == "commit":
+		err := commitTx(coll)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+
+	case opcode == "rollback":
+		err := rollbackTx(coll)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+
+	case opcode == "help":
+		fmt.Println(helpText)
+
 	case opcode == "exit":
+		// A transaction that's still open is rolled back
+		if openTxs[coll] != nil {
+			rollbackTx(coll)
+		}
+		err := coll.Close()
+		if err != nil {
+			fmt.Println(err.Error())
+		}
 		fmt.Println("Exiting...")
 		os.Exit(0)
 
 	default:
-		fmt.Println("INVALID COMMAND: " + opcode)
+		fmt.Println("INVALID COMMAND: " + opcode + " (TYPE 'help' FOR A LIST OF COMMANDS)")
 	}
 }
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang_db/internal"
+	"github.com/golang_db/internal/sql"
+	"slices"
+)
+
+// Parses and executes a string of SQL statements against the collection, printing each statement's results
+// Statements are executed in order, stopping at the first one that fails. Nothing is executed if any statement is malformed
+//
+// PARAMS:
+//
+//	source - the SQL string (see sql.Parse for the grammar accepted)
+//	coll - the collection to execute the statements against
+func executeSQL(source string, coll *internal.Collection) {
+	statements, err := sql.Parse(source)
+	if err != nil {
+		printError(err)
+		return
+	}
+
+	for _, statement := range statements {
+		err = executeStatement(statement, coll)
+		if err != nil {
+			printError(locateConditionError(err, statement, source))
+			return
+		}
+	}
+}
+
+// Makes a ConditionError from one of a statement's conditions point to where the error is in the SQL string,
+// rather than in the condition string, so it's printed under the SQL. Any other error is returned as it is
+//
+// PARAMS:
+//
+//	err - the error from executing the statement
+//	statement - the statement
+//	source - the SQL string the statement was parsed from
+func locateConditionError(err error, statement sql.Statement, source string) error {
+	var condErr *internal.ConditionError
+	if !errors.As(err, &condErr) {
+		return err
+	}
+	offset := -1
+	switch stmt := statement.(type) {
+	case *sql.Select:
+		if condErr.Condition == stmt.Query.Condition {
+			offset = stmt.ConditionOffset
+		} else if condErr.Condition == stmt.Query.Having {
+			offset = stmt.HavingOffset
+		}
+	case *sql.Update:
+		if condErr.Condition == stmt.Condition {
+			offset = stmt.ConditionOffset
+		}
+	case *sql.Delete:
+		if condErr.Condition == stmt.Condition {
+			offset = stmt.ConditionOffset
+		}
+	}
+	if offset >= 0 {
+		condErr.Offset += offset
+		condErr.Condition = source
+	}
+	return err
+}
+
+// Executes a single parsed SQL statement, printing it's results
+// Returns any error from executing the statement
+func executeStatement(statement sql.Statement, coll *internal.Collection) error {
+	switch stmt := statement.(type) {
+
+	case *sql.CreateTable:
+		err := errorIfInTx(coll, "CREATE TABLE")
+		if err != nil {
+			return err
+		}
+		return coll.NewDB(stmt.Table, stmt.Columns...)
+
+	case *sql.DropTable:
+		err := errorIfInTx(coll, "DROP TABLE")
+		if err != nil {
+			return err
+		}
+		return coll.DropDB(stmt.Table)
+
+	case *sql.AlterTable:
+		if stmt.Action == sql.RENAME_TABLE {
+			err := errorIfInTx(coll, "RENAME TO")
+			if err != nil {
+				return err
+			}
+			return coll.RenameDB(stmt.Table, stmt.NewName)
+		}
+		db, err := getDB(coll, stmt.Table)
+		if err != nil {
+			return err
+		}
+		switch stmt.Action {
+		case sql.ADD_COLUMN:
+			return db.AddColumn(stmt.Column, stmt.Type)
+		case sql.DROP_COLUMN:
+			return db.DropColumn(stmt.Column)
+		default: // RENAME_COLUMN
+			return db.RenameColumn(stmt.Column, stmt.NewName)
+		}
+
+	case *sql.Insert:
+		// Several rows are inserted all-or-nothing, in a transaction of their own if the collection has none open
+		// In an open transaction, rows inserted before one that fails stay in the transaction, until it's rolled back
+		if openTxs[coll] == nil && len(stmt.Rows) > 1 {
+			tx, err := coll.Begin()
+			if err != nil {
+				return err
+			}
+			_, err = insertRows(tx.GetDB, stmt)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			err = tx.Commit()
+			if err != nil {
+				return err
+			}
+		} else {
+			inserted, err := insertRows(func(dbName string) (*internal.Database, error) { return getDB(coll, dbName) }, stmt)
+			if err != nil {
+				if inserted > 0 {
+					fmt.Printf("INSERTED %d ENTRIES\n", inserted)
+				}
+				return err
+			}
+		}
+		fmt.Printf("INSERTED %d ENTRIES\n", len(stmt.Rows))
+
+	case *sql.Select:
+		var res *internal.ResultSet
+		var err error
+		if len(stmt.Joins) == 0 {
+			var db *internal.Database
+			db, err = getDB(coll, stmt.From)
+			if err != nil {
+				return err
+			}
+			res, err = db.Select(stmt.Query)
+		} else {
+			res, err = selectJoined(coll, stmt.From, stmt.Joins, stmt.Query)
+		}
+		if err != nil {
+			return err
+		}
+		printResultSet(res)
+
+	case *sql.Update:
+		db, err := getDB(coll, stmt.Table)
+		if err != nil {
+			return err
+		}
+		numUpdated, err := db.Update(stmt.Assignments, stmt.Condition)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("UPDATED %d ENTRIES\n", numUpdated)
+
+	case *sql.Delete:
+		db, err := getDB(coll, stmt.Table)
+		if err != nil {
+			return err
+		}
+		numDeleted, err := db.Delete(stmt.Condition)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("DELETED %d ENTRIES\n", numDeleted)
+
+	case *sql.Transaction:
+		switch stmt.Action {
+		case sql.BEGIN:
+			return beginTx(coll)
+		case sql.COMMIT:
+			return commitTx(coll)
+		default: // ROLLBACK
+			return rollbackTx(coll)
+		}
+	}
+	return nil
+}
+
+// Inserts the rows of an INSERT statement into it's database, in order, stopping at the first one that fails
+//
+// PARAMS:
+//
+//	getDBFn - gets a database by name, from the collection or a transaction
+//	stmt - the statement
+//
+// RETURNS: the number of rows inserted, and the error inserting the row that failed, if any
+func insertRows(getDBFn func(dbName string) (*internal.Database, error), stmt *sql.Insert) (int, error) {
+	db, err := getDBFn(stmt.Table)
+	if err != nil {
+		return 0, err
+	}
+	columns := stmt.Columns
+	if columns == nil { // Values are for every column but id, which is assigned automatically
+		columns, _ = db.Schema()
+		columns = slices.DeleteFunc(columns, func(col string) bool { return col == "id" })
+	}
+	for i, row := range stmt.Rows {
+		err = db.Insert(columns, row)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(stmt.Rows), nil
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"github.com/golang_db/internal"
+	"testing"
+)
+
+func TestInsertAllOrNothing(t *testing.T) {
+	t.Setenv("COLLECTIONS_DIR", t.TempDir())
+	coll := internal.MakeNewCollection("test")
+	t.Cleanup(func() { coll.Close() })
+	executeSQL("CREATE TABLE people (name, age INT);", coll)
+
+	// The 2nd row's age isn't an int, so neither row is inserted
+	executeSQL("INSERT INTO people (name, age) VALUES ('alice', 30), ('bob', 'old');", coll)
+	if got := countPeople(t, coll); got != 0 {
+		t.Errorf("got %d people after an insert w/ an invalid row, want none", got)
+	}
+	if openTxs[coll] != nil {
+		t.Error("insert left a transaction open")
+	}
+
+	executeSQL("INSERT INTO people (name, age) VALUES ('alice', 30), ('bob', 20);", coll)
+	if got := countPeople(t, coll); got != 2 {
+		t.Errorf("got %d people after an insert, want 2", got)
+	}
+}
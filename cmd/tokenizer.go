@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// An argument of a command, as split up by tokenizeCommand
+//
+// FIELDS:
+//
+//	value - The argument w/ quotes removed and escapes resolved, e.g. Jane Doe for 'Jane Doe'
+//	quoted - Whether any part of the argument was quoted or escaped. Quoted arguments are never treated as keywords
+//	start, end - Character offsets of the start of the argument and just past it's end, in the command
+type arg struct {
+	value  string
+	quoted bool
+	start  int
+	end    int
+}
+
+// Splits a command into arguments the way a shell does
+// Arguments are seperated by any amount of whitespace. Within an argument:
+//
+//	'...' - Everything up to the next single quotemark is taken literally
+//	"..." - Everything up to the next unescaped double quotemark is taken literally, apart from \" and \\ which are unescaped
+//	\c - Any other character preceded by a backslash is taken literally (e.g. \  for a space that doesn't end the argument)
+//
+// Quoted parts can be joined onto unquoted parts, e.g. name='Jane Doe' is the single argument name=Jane Doe
+//
+// PARAMS: command - the command
+//
+// RETURNS:
+//
+//	the arguments, in order (the first being the opcode)
+//	parser error if a quote is unterminated or the command ends in a backslash, otherwise nil
+func tokenizeCommand(command string) ([]arg, *parserError) {
+	args := make([]arg, 0, 10)
+	var current *arg
+	var value strings.Builder
+
+	// Starts a new argument at the current position, if one isn't already in progress
+	startArg := func(pos int) {
+		if current == nil {
+			current = &arg{start: pos}
+			value.Reset()
+		}
+	}
+
+	// Ends the argument in progress (if any) at the current position
+	endArg := func(pos int) {
+		if current != nil {
+			current.value, current.end = value.String(), pos
+			args = append(args, *current)
+			current = nil
+		}
+	}
+
+	i := 0
+	for i < len(command) {
+		r, size := utf8.DecodeRuneInString(command[i:])
+		switch {
+		case unicode.IsSpace(r):
+			endArg(i)
+			i += size
+
+		case r == '\\':
+			startArg(i)
+			current.quoted = true
+			if i+size == len(command) {
+				return nil, &parserError{"COMMAND ENDS IN AN UNESCAPED BACKSLASH"}
+			}
+			escaped, escapedSize := utf8.DecodeRuneInString(command[i+size:])
+			value.WriteRune(escaped)
+			i += size + escapedSize
+
+		case r == '\'' || r == '"':
+			startArg(i)
+			current.quoted = true
+			closed := false
+			i += size
+			for i < len(command) && !closed {
+				c, cSize := utf8.DecodeRuneInString(command[i:])
+				switch {
+				case c == r:
+					closed = true
+				case r == '"' && c == '\\' && i+1 < len(command) && (command[i+1] == '"' || command[i+1] == '\\'):
+					value.WriteByte(command[i+1])
+					cSize = 2
+				default:
+					value.WriteRune(c)
+				}
+				i += cSize
+			}
+			if !closed && r == '\'' {
+				return nil, &parserError{"UNTERMINATED SINGLE QUOTE"}
+			}
+			if !closed {
+				return nil, &parserError{"UNTERMINATED DOUBLE QUOTE"}
+			}
+
+		default:
+			startArg(i)
+			value.WriteRune(r)
+			i += size
+		}
+	}
+
+	endArg(len(command))
+	return args, nil
+}
+
+// Gets the values of a list of arguments
+func argValues(args []arg) []string {
+	values := make([]string, len(args))
+	for i, a := range args {
+		values[i] = a.value
+	}
+	return values
+}
+
+// Gets the text of the command spanned by a list of arguments, exactly as it was written (i.e. w/ quotes and escapes left in)
+// Used for arguments such as conditions, which have their own quoting rules
+//
+// PARAMS:
+//
+//	command - the command the arguments came from
+//	args - the arguments, in order
+func rawText(command string, args []arg) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return command[args[0].start:args[len(args)-1].end]
+}
+
+// Checks if an argument is a keyword, i.e. it's unquoted and matches the keyword case-insensitively
+func isKeyword(a arg, keyword string) bool {
+	return !a.quoted && strings.EqualFold(a.value, keyword)
+}
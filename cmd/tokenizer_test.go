@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []arg
+	}{
+		{"", []arg{}},
+		{"   ", []arg{}},
+		{"listdbs", []arg{{"listdbs", false, 0, 7}}},
+		{"dropdb  users", []arg{{"dropdb", false, 0, 6}, {"users", false, 8, 13}}},
+		{"  select\tusers  *  ", []arg{{"select", false, 2, 8}, {"users", false, 9, 14}, {"*", false, 16, 17}}},
+		{"insert people name | 'Jane Doe'", []arg{
+			{"insert", false, 0, 6}, {"people", false, 7, 13}, {"name", false, 14, 18}, {"|", false, 19, 20}, {"Jane Doe", true, 21, 31},
+		}},
+		{`x "a\"b"`, []arg{{"x", false, 0, 1}, {`a"b`, true, 2, 8}}},
+		{`x "a\\b" "a\nb"`, []arg{{"x", false, 0, 1}, {`a\b`, true, 2, 8}, {`a\nb`, true, 9, 15}}},
+		{`x 'a\b' 'it''s'`, []arg{{"x", false, 0, 1}, {`a\b`, true, 2, 7}, {"its", true, 8, 15}}},
+		{`x Jane\ Doe`, []arg{{"x", false, 0, 1}, {"Jane Doe", true, 2, 11}}},
+		{"set name='Jane Doe',age='3'", []arg{{"set", false, 0, 3}, {"name=Jane Doe,age=3", true, 4, 27}}},
+		{"x ''", []arg{{"x", false, 0, 1}, {"", true, 2, 4}}},
+	}
+
+	for _, test := range tests {
+		got, err := tokenizeCommand(test.command)
+		if err != nil {
+			t.Errorf("tokenizeCommand(%q) failed: %v", test.command, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenizeCommand(%q) = %+v, want %+v", test.command, got, test.want)
+		}
+	}
+}
+
+func TestTokenizeCommandErrors(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{`x y\`, "PARSER ERROR: COMMAND ENDS IN AN UNESCAPED BACKSLASH"},
+		{"x 'Jane Doe", "PARSER ERROR: UNTERMINATED SINGLE QUOTE"},
+		{`x "Jane Doe`, "PARSER ERROR: UNTERMINATED DOUBLE QUOTE"},
+		{`x "a\"`, "PARSER ERROR: UNTERMINATED DOUBLE QUOTE"},
+	}
+
+	for _, test := range tests {
+		_, err := tokenizeCommand(test.command)
+		if err == nil {
+			t.Errorf("tokenizeCommand(%q) succeeded, want %q", test.command, test.want)
+			continue
+		}
+		if err.Error() != test.want {
+			t.Errorf("tokenizeCommand(%q) returned %q, want %q", test.command, err.Error(), test.want)
+		}
+	}
+}
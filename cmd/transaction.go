@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/golang_db/internal"
+)
+
+// The transaction opened by a begin command in each collection, while it's open
+// While a collection has a transaction open, every command on the collection operates on the transaction's copies of it's databases
+// (see internal.Tx). Keeping it w/ it's collection means a transaction is never used w/ a collection it wasn't begun in
+var openTxs = make(map[*internal.Collection]*internal.Tx)
+
+// Gets a database in the collection by name, from the collection's open transaction if there is one
+func getDB(coll *internal.Collection, dbName string) (*internal.Database, error) {
+	if tx := openTxs[coll]; tx != nil {
+		return tx.GetDB(dbName)
+	}
+	return coll.GetDB(dbName)
+}
+
+// Runs a select query over joined databases in the collection, in the collection's open transaction if there is one
+func selectJoined(coll *internal.Collection, from string, joins []internal.Join, query internal.SelectQuery) (*internal.ResultSet, error) {
+	if tx := openTxs[coll]; tx != nil {
+		return tx.Select(from, joins, query)
+	}
+	return coll.Select(from, joins, query)
+}
+
+// Opens a transaction in the collection
+// Returns a parserError if the collection already has a transaction open
+func beginTx(coll *internal.Collection) error {
+	if openTxs[coll] != nil {
+		return &parserError{"A TRANSACTION IS ALREADY OPEN"}
+	}
+	tx, err := coll.Begin()
+	if err != nil {
+		return err
+	}
+	openTxs[coll] = tx
+	fmt.Println("BEGAN TRANSACTION")
+	return nil
+}
+
+// Commits the collection's open transaction. It's closed even if the commit fails (as it's been rolled back)
+// Returns a parserError if the collection has no transaction open
+func commitTx(coll *internal.Collection) error {
+	tx := openTxs[coll]
+	if tx == nil {
+		return &parserError{"NO TRANSACTION IS OPEN"}
+	}
+	delete(openTxs, coll)
+	err := tx.Commit()
+	if err != nil {
+		return err
+	}
+	fmt.Println("COMMITTED TRANSACTION")
+	return nil
+}
+
+// Rolls back the collection's open transaction
+// Returns a parserError if the collection has no transaction open
+func rollbackTx(coll *internal.Collection) error {
+	tx := openTxs[coll]
+	if tx == nil {
+		return &parserError{"NO TRANSACTION IS OPEN"}
+	}
+	delete(openTxs, coll)
+	err := tx.Rollback()
+	if err != nil {
+		return err
+	}
+	fmt.Println("ROLLED BACK TRANSACTION")
+	return nil
+}
+
+// Returns a parserError if the collection has a transaction open, for commands that can't be part of a transaction
+// (creating, dropping and renaming databases)
+//
+// PARAMS:
+//
+//	coll - the collection the command is on
+//	opcode - the command, for the error message
+func errorIfInTx(coll *internal.Collection, opcode string) error {
+	if openTxs[coll] != nil {
+		return &parserError{fmt.Sprintf("CAN'T USE %s INSIDE A TRANSACTION", opcode)}
+	}
+	return nil
+}
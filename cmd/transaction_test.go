@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"github.com/golang_db/internal"
+	"testing"
+)
+
+// Counts the entries in a collection's people database, outside any transaction
+func countPeople(t *testing.T, coll *internal.Collection) int {
+	t.Helper()
+	db, err := coll.GetDB("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Select(internal.SelectQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(res.Rows)
+}
+
+func TestTxKeptWithCollection(t *testing.T) {
+	t.Setenv("COLLECTIONS_DIR", t.TempDir())
+	a, b := internal.MakeNewCollection("a"), internal.MakeNewCollection("b")
+	t.Cleanup(func() {
+		delete(openTxs, a)
+		a.Close()
+		b.Close()
+	})
+	for _, coll := range []*internal.Collection{a, b} {
+		err := coll.NewDB("people", "name")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A transaction begun in one collection isn't used by commands on the other
+	err := beginTx(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, coll := range []*internal.Collection{a, b} {
+		db, err := getDB(coll, "people")
+		if err == nil {
+			err = db.Insert([]string{"name"}, []string{"alice"})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := countPeople(t, a); got != 0 {
+		t.Errorf("got %d people outside the transaction, want the insert only in the transaction", got)
+	}
+	if got := countPeople(t, b); got != 1 {
+		t.Errorf("got %d people in the other collection, want the insert made straight away", got)
+	}
+	if errorIfInTx(b, "CREATEDB") != nil {
+		t.Error("other collection is in a transaction, want it not to be")
+	}
+	if rollbackTx(b) == nil {
+		t.Error("rolling back in the other collection succeeded, want an error")
+	}
+
+	err = commitTx(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countPeople(t, a); got != 1 {
+		t.Errorf("got %d people after commit, want the insert", got)
+	}
+}
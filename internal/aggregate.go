@@ -0,0 +1,430 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// AggregateFunction Aggregate function enum
+//
+// COUNT - Number of entries (or of non-empty values in a column, or of distinct non-empty values in a column)
+// SUM - Total of the numeric values in a column
+// AVG - Mean of the numeric values in a column
+// MIN - Smallest value in a column, compared according to the column's type
+// MAX - Largest value in a column, compared according to the column's type
+type AggregateFunction int
+
+const (
+	COUNT AggregateFunction = iota
+	SUM
+	AVG
+	MIN
+	MAX
+)
+
+// Names of aggregate functions, as written in select lists
+var aggregateFunctionNames = map[AggregateFunction]string{
+	COUNT: "count",
+	SUM:   "sum",
+	AVG:   "avg",
+	MIN:   "min",
+	MAX:   "max",
+}
+
+func (f AggregateFunction) String() string {
+	return aggregateFunctionNames[f]
+}
+
+// Aggregate An aggregate to compute over each group of entries in a query
+// Empty cells are ignored by every aggregate apart from count(*)
+//
+// FIELDS:
+//
+//	Function - The aggregate function
+//	Column - The column to aggregate. Empty for count(*), which counts entries
+//	Distinct - Only count distinct values. Only allowed w/ COUNT
+type Aggregate struct {
+	Function AggregateFunction
+	Column   string
+	Distinct bool
+}
+
+// Label Gets the name of the aggregate's column in a result set, e.g. 'sum(price)' or 'count(distinct city)'
+// This is the same as how the aggregate is written in a select list
+func (a Aggregate) Label() string {
+	switch {
+	case a.Column == "":
+		return fmt.Sprintf("%s(*)", a.Function)
+	case a.Distinct:
+		return fmt.Sprintf("%s(distinct %s)", a.Function, a.Column)
+	default:
+		return fmt.Sprintf("%s(%s)", a.Function, a.Column)
+	}
+}
+
+// Matches an aggregate in a select list, capturing the function name and the argument inside the brackets
+var aggregateRegex = regexp.MustCompile(`^(\w+)\s*\((.*)\)$`)
+
+// ParseAggregate Parses an aggregate written as in a select list, e.g. 'count(*)', 'sum(price)', 'count(distinct city)'
+// Function names and 'distinct' are case-insensitive
+//
+// PARAMS: str - the string to parse
+//
+// RETURNS:
+//
+//	the aggregate
+//	false if the string isn't an aggregate at all (i.e. it's a plain column name), otherwise true
+//	a dbError if the string looks like an aggregate but is malformed
+func ParseAggregate(str string) (Aggregate, bool, error) {
+	match := aggregateRegex.FindStringSubmatch(strings.TrimSpace(str))
+	if match == nil {
+		return Aggregate{}, false, nil
+	}
+
+	res := Aggregate{}
+	foundFunction := false
+	for function, name := range aggregateFunctionNames {
+		if strings.EqualFold(match[1], name) {
+			res.Function = function
+			foundFunction = true
+		}
+	}
+	if !foundFunction {
+		return Aggregate{}, true, &dbError{fmt.Sprintf("Unknown aggregate function '%s'", match[1])}
+	}
+
+	arg := strings.Fields(match[2])
+	if len(arg) == 2 && strings.EqualFold(arg[0], "distinct") {
+		res.Distinct = true
+		arg = arg[1:]
+	}
+	switch {
+	case len(arg) != 1:
+		return Aggregate{}, true, &dbError{fmt.Sprintf("Invalid aggregate '%s'", str)}
+	case arg[0] == "*" && (res.Function != COUNT || res.Distinct):
+		return Aggregate{}, true, &dbError{fmt.Sprintf("Only count can be applied to '*', in '%s'", str)}
+	case res.Distinct && res.Function != COUNT:
+		return Aggregate{}, true, &dbError{fmt.Sprintf("Only count can be applied to distinct values, in '%s'", str)}
+	case arg[0] != "*":
+		res.Column = arg[0]
+	}
+	return res, true, nil
+}
+
+// ParseSelectList Parses a comma-seperated select list of columns and aggregates, e.g. "city, count(*), avg(age)"
+// A select list of just '*' selects all columns
+//
+// PARAMS: selectListStr - the select list
+//
+// RETURNS:
+//
+//	the plain columns in the list, in order (nil for '*')
+//	the aggregates in the list, in order
+//	a dbError if an item in the list is malformed
+func ParseSelectList(selectListStr string) ([]string, []Aggregate, error) {
+	if strings.TrimSpace(selectListStr) == "*" {
+		return nil, nil, nil
+	}
+
+	columns := make([]string, 0, 5)
+	aggregates := make([]Aggregate, 0, 5)
+	for _, item := range strings.Split(selectListStr, ",") {
+		item = strings.TrimSpace(item)
+		aggregate, isAggregate, err := ParseAggregate(item)
+		switch {
+		case err != nil:
+			return nil, nil, err
+		case isAggregate:
+			aggregates = append(aggregates, aggregate)
+		case item == "":
+			return nil, nil, &dbError{"Empty item in select list"}
+		default:
+			columns = append(columns, item)
+		}
+	}
+	return columns, aggregates, nil
+}
+
+// Works out the type of the values an aggregate produces
+//
+// PARAMS:
+//
+//	a - the aggregate
+//	types - map with column names as keys and column types as values
+//
+// RETURNS:
+//
+//	the type
+//	a dbError if the aggregate can't be applied to it's column's type (e.g. summing a timestamp column)
+func (a Aggregate) resultType(types map[string]ColumnType) (ColumnType, error) {
+	colType := types[a.Column]
+	switch a.Function {
+	case COUNT:
+		return INT, nil
+	case SUM, AVG:
+		if colType == BOOL || colType == TIMESTAMP {
+			return TEXT, &dbError{fmt.Sprintf("Can't apply %s to %s column '%s'", a.Function, colType, a.Column)}
+		}
+		if a.Function == SUM && colType == INT {
+			return INT, nil
+		}
+		return FLOAT, nil
+	default: // MIN, MAX
+		return colType, nil
+	}
+}
+
+// Running state of an aggregate over the entries of one group
+//
+// ATTRIBUTES:
+//
+//	aggregate - The aggregate being computed
+//	colType - Type of the aggregated column
+//	count - Number of values seen (or entries, for count(*))
+//	sum - Total of the numeric values seen
+//	allInts - Whether every value summed so far was a whole number
+//	extreme - Smallest (for MIN) or largest (for MAX) value seen so far
+//	distinct - Set of distinct values seen, only used for count distinct
+type aggregateState struct {
+	aggregate Aggregate
+	colType   ColumnType
+	count     int
+	sum       float64
+	allInts   bool
+	extreme   string
+	distinct  map[string]bool
+}
+
+func newAggregateState(aggregate Aggregate, colType ColumnType) *aggregateState {
+	state := &aggregateState{aggregate: aggregate, colType: colType, allInts: true}
+	if aggregate.Distinct {
+		state.distinct = make(map[string]bool)
+	}
+	return state
+}
+
+// Adds a value from an entry in the group to the aggregate
+// For count(*) the value is ignored, every entry counts
+func (s *aggregateState) add(value string) {
+	if s.aggregate.Column == "" {
+		s.count++
+		return
+	}
+	if value == "" {
+		return
+	}
+
+	switch s.aggregate.Function {
+	case COUNT:
+		if s.distinct != nil {
+			s.distinct[value] = true
+		} else {
+			s.count++
+		}
+
+	case SUM, AVG:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return // Non-numeric values in text columns are ignored
+		}
+		s.sum += f
+		s.allInts = s.allInts && isInt(value)
+		s.count++
+
+	case MIN:
+		if s.count == 0 || compareValues(value, s.extreme, s.colType) < 0 {
+			s.extreme = value
+		}
+		s.count++
+
+	case MAX:
+		if s.count == 0 || compareValues(value, s.extreme, s.colType) > 0 {
+			s.extreme = value
+		}
+		s.count++
+	}
+}
+
+// Gets the final value of the aggregate over the group
+// Aggregates other than count give an empty value if the group had no (non-empty) values
+func (s *aggregateState) result() string {
+	switch s.aggregate.Function {
+	case COUNT:
+		if s.distinct != nil {
+			return strconv.Itoa(len(s.distinct))
+		}
+		return strconv.Itoa(s.count)
+	case SUM:
+		if s.count == 0 {
+			return ""
+		}
+		return numberOperand(s.sum, s.allInts).value
+	case AVG:
+		if s.count == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(s.sum/float64(s.count), 'g', -1, 64)
+	default: // MIN, MAX
+		return s.extreme
+	}
+}
+
+// Groups entries and computes aggregates over each group
+// Entries are sorted by their group columns first (using an externalSorter, so this works within MemoryBudget),
+// so each group's entries arrive together and only one group has to be aggregated at a time
+// With no group columns, all entries form a single group, so exactly one row is always produced
+//
+// PARAMS:
+//
+//	groupBy - the columns to group by
+//	outColumns - the group columns to include in the results, in order
+//	aggregates - the aggregates to compute
+//	columns - names of the columns the entries have, in order
+//	types - map with column names as keys and column types as values
+//	source - streams the entries to group
+//	rowFn - called w/ each group's result row: outColumns values, then the aggregate results
+//
+// RETURNS: any error from reading the source, or returned by rowFn
+func aggregateEntries(groupBy []string, outColumns []string, aggregates []Aggregate, columns []string,
+	types map[string]ColumnType, source func(entryFn func(values []string) error) error, rowFn func(row []string) error) error {
+
+	groupIdxs := make([]int, len(groupBy))
+	groupOrder := make([]OrderTerm, len(groupBy))
+	for i, col := range groupBy {
+		groupIdxs[i] = slices.Index(columns, col)
+		groupOrder[i] = OrderTerm{Column: col}
+	}
+	outIdxs := make([]int, len(outColumns))
+	for i, col := range outColumns {
+		outIdxs[i] = slices.Index(columns, col)
+	}
+	aggregateIdxs := make([]int, len(aggregates))
+	for i, aggregate := range aggregates {
+		aggregateIdxs[i] = slices.Index(columns, aggregate.Column) // -1 for count(*), whose value is ignored anyway
+	}
+
+	// State of the group currently being aggregated. groupEntry is nil until the first entry arrives
+	var groupEntry []string
+	var states []*aggregateState
+	startGroup := func(values []string) {
+		groupEntry = values
+		states = make([]*aggregateState, len(aggregates))
+		for i, aggregate := range aggregates {
+			states[i] = newAggregateState(aggregate, types[aggregate.Column])
+		}
+	}
+	finishGroup := func() error {
+		row := make([]string, 0, len(outIdxs)+len(states))
+		for _, idx := range outIdxs {
+			row = append(row, groupEntry[idx])
+		}
+		for _, state := range states {
+			row = append(row, state.result())
+		}
+		return rowFn(row)
+	}
+	sameGroup := func(a, b []string) bool {
+		for _, idx := range groupIdxs {
+			if a[idx] != b[idx] {
+				return false
+			}
+		}
+		return true
+	}
+
+	addEntry := func(values []string) error {
+		if groupEntry == nil {
+			startGroup(values)
+		} else if !sameGroup(groupEntry, values) {
+			err := finishGroup()
+			if err != nil {
+				return err
+			}
+			startGroup(values)
+		}
+
+		for i, state := range states {
+			value := ""
+			if aggregateIdxs[i] != -1 {
+				value = values[aggregateIdxs[i]]
+			}
+			state.add(value)
+		}
+		return nil
+	}
+
+	var err error
+	if len(groupBy) == 0 {
+		err = source(addEntry)
+		if err == nil && groupEntry == nil {
+			startGroup(make([]string, len(columns))) // No entries, but still produce a row (e.g. a count of 0)
+		}
+	} else {
+		sorter := newExternalSorter(makeEntryComparer(groupOrder, columns, types))
+		defer sorter.cleanup()
+		err = source(sorter.add)
+		if err == nil {
+			err = sorter.sorted(addEntry)
+		}
+	}
+
+	if err != nil || groupEntry == nil {
+		return err
+	}
+	return finishGroup()
+}
+
+// Gets the columns and types of the rows an aggregate query produces, checking the query is valid
+//
+// PARAMS:
+//
+//	query - the query. Must have aggregates or group columns
+//	columns - names of the columns the entries being queried have, in order
+//	types - map with column names as keys and column types as values
+//
+// RETURNS:
+//
+//	the group columns to include in the results (query.Columns, or all group columns if that's nil)
+//	names of the result columns (the group columns, then the aggregate labels)
+//	map of result column names to their types
+//	a dbError if the query refers to columns that don't exist, selects columns it doesn't group by,
+//	or applies an aggregate to a column of the wrong type
+func aggregateResultColumns(query SelectQuery, columns []string, types map[string]ColumnType) ([]string, []string, map[string]ColumnType, error) {
+	for _, col := range query.GroupBy {
+		if !slices.Contains(columns, col) {
+			return nil, nil, nil, &dbError{fmt.Sprintf("Can't group by column '%s', it does not exist", col)}
+		}
+	}
+
+	outColumns := query.Columns
+	if outColumns == nil {
+		outColumns = query.GroupBy
+	}
+	for _, col := range outColumns {
+		if !slices.Contains(query.GroupBy, col) {
+			return nil, nil, nil, &dbError{fmt.Sprintf("Column '%s' must be grouped by to be selected alongside aggregates", col)}
+		}
+	}
+
+	resultColumns := slices.Clone(outColumns)
+	resultTypes := make(map[string]ColumnType)
+	for _, col := range outColumns {
+		resultTypes[col] = types[col]
+	}
+	for _, aggregate := range query.Aggregates {
+		if aggregate.Column != "" && !slices.Contains(columns, aggregate.Column) {
+			return nil, nil, nil, &dbError{fmt.Sprintf("Column '%s' does not exist", aggregate.Column)}
+		}
+		resultType, err := aggregate.resultType(types)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		resultColumns = append(resultColumns, aggregate.Label())
+		resultTypes[aggregate.Label()] = resultType
+	}
+
+	return outColumns, resultColumns, resultTypes, nil
+}
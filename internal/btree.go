@@ -0,0 +1,603 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Size in bytes of each page of a B+tree file
+const pageSize = 4096
+
+// Longest column value (in bytes) stored in a B+tree key. Longer values are cut short, see bTreeKey
+const maxKeyLen = 512
+
+// Identifies B+tree files, at the start of the header page
+var bTreeMagic = [8]byte{'G', 'D', 'B', 'B', 'T', 'R', 'E', 'E'}
+
+// Held in a B+tree's header in place of an LSN while the tree, or the database file it indexes, is being changed
+// A tree left w/ it when we crash is rebuilt when the database is next loaded (see Database.loadIndexes)
+const changingLSN = math.MaxUint64
+
+// Kinds of B+tree page, stored in the 1st byte of every page apart from the header
+const (
+	leafPage     byte = 1
+	internalPage byte = 2
+)
+
+// A key in a B+tree: a column value and the offset of the entry in the database file that has it
+// Including the offset makes every key unique, even when many entries have the same value
+// Values longer than maxKeyLen are cut short, so keys of long values only give an approximate order (see bTree.truncated)
+type bTreeKey struct {
+	value  string
+	offset int64
+}
+
+// Makes the key for an entry's value, cutting the value short if it's too long
+func makeBTreeKey(value string, offset int64) (bTreeKey, bool) {
+	if len(value) > maxKeyLen {
+		return bTreeKey{value[:maxKeyLen], offset}, true
+	}
+	return bTreeKey{value, offset}, false
+}
+
+// A node of a B+tree, as read from or written to a page
+//
+// ATTRIBUTES:
+//
+//	page - Number of the node's page in the file
+//	leaf - Whether the node is a leaf. Leaves hold every key, internal nodes hold keys seperating their children
+//	keys - The node's keys, in order. In an internal node, keys[i] is the smallest key under children[i+1]
+//	children - Pages of an internal node's children (1 more than the number of keys)
+//	next - Page of the next leaf, so leaves can be scanned in order w/o going back up the tree. 0 for the last leaf
+type bTreeNode struct {
+	page     uint32
+	leaf     bool
+	keys     []bTreeKey
+	children []uint32
+	next     uint32
+}
+
+// Number of bytes a node takes up in it's page
+// Every page has a 7 byte header (kind, number of keys, next leaf or 1st child), followed by each key (see keySize)
+func (n *bTreeNode) size() int {
+	size := 7
+	for _, key := range n.keys {
+		size += n.keySize(key)
+	}
+	return size
+}
+
+// Number of bytes a key takes up in the node's page: it's value's length (2 bytes), it's value and it's offset (8 bytes),
+// followed by the child to it's right if the node is internal (4 bytes)
+func (n *bTreeNode) keySize(key bTreeKey) int {
+	if n.leaf {
+		return 10 + len(key.value)
+	}
+	return 14 + len(key.value)
+}
+
+// Encodes the node into a page
+func (n *bTreeNode) encode() []byte {
+	page := make([]byte, pageSize)
+	page[0] = leafPage
+	if !n.leaf {
+		page[0] = internalPage
+	}
+	binary.LittleEndian.PutUint16(page[1:], uint16(len(n.keys)))
+	if n.leaf {
+		binary.LittleEndian.PutUint32(page[3:], n.next)
+	} else {
+		binary.LittleEndian.PutUint32(page[3:], n.children[0])
+	}
+
+	pos := 7
+	for i, key := range n.keys {
+		binary.LittleEndian.PutUint16(page[pos:], uint16(len(key.value)))
+		pos += 2
+		pos += copy(page[pos:], key.value)
+		binary.LittleEndian.PutUint64(page[pos:], uint64(key.offset))
+		pos += 8
+		if !n.leaf {
+			binary.LittleEndian.PutUint32(page[pos:], n.children[i+1])
+			pos += 4
+		}
+	}
+	return page
+}
+
+// Decodes a node from a page
+func decodeBTreeNode(pageNum uint32, page []byte) (*bTreeNode, error) {
+	if page[0] != leafPage && page[0] != internalPage {
+		return nil, fmt.Errorf("page %d is not a B+tree node", pageNum)
+	}
+	n := &bTreeNode{page: pageNum, leaf: page[0] == leafPage}
+	numKeys := int(binary.LittleEndian.Uint16(page[1:]))
+	if n.leaf {
+		n.next = binary.LittleEndian.Uint32(page[3:])
+	} else {
+		n.children = append(n.children, binary.LittleEndian.Uint32(page[3:]))
+	}
+
+	keySize := 8 // Size of each key apart from it's value and length
+	if !n.leaf {
+		keySize = 12
+	}
+	pos := 7
+	n.keys = make([]bTreeKey, numKeys)
+	for i := range n.keys {
+		if pos+2 > pageSize {
+			return nil, fmt.Errorf("page %d is corrupt", pageNum)
+		}
+		valueLen := int(binary.LittleEndian.Uint16(page[pos:]))
+		pos += 2
+		if pos+valueLen+keySize > pageSize {
+			return nil, fmt.Errorf("page %d is corrupt", pageNum)
+		}
+		n.keys[i].value = string(page[pos : pos+valueLen])
+		pos += valueLen
+		n.keys[i].offset = int64(binary.LittleEndian.Uint64(page[pos:]))
+		pos += 8
+		if !n.leaf {
+			n.children = append(n.children, binary.LittleEndian.Uint32(page[pos:]))
+			pos += 4
+		}
+	}
+	return n, nil
+}
+
+// A B+tree stored in a file of fixed-size pages, mapping the values of a column to the offsets of the entries that have them
+// Keys are kept in the order of the column's type (see compareBTreeKeys), so the entries w/ values in a range can be found
+// by going down the tree to the start of the range, then scanning along the leaves
+//
+// Page 0 of the file is a header holding bTreeMagic, the root's page, the number of pages, whether any key was cut short,
+// and the LSN of the last change to the database the tree is up to date w/ (see Database.setIndexLSNs).
+// Pages are changed in place, so before any are written the LSN is replaced w/ changingLSN, and it isn't put back until the change
+// is recorded in the database's metadata. A tree whose LSN doesn't match the metadata's is rebuilt when the database is loaded
+// The tree is only ever read and written through a file opened for a single operation, as w/ database files
+//
+// ATTRIBUTES:
+//
+//	path - Path to the tree's file
+//	colType - Type of the indexed column, which gives the order of the keys
+//	root - Page of the root node
+//	numPages - Number of pages in the file, including the header
+//	truncated - Whether any key's value was cut short (see maxKeyLen), in which case keys w/ long values
+//		may be out of order relative to each other
+//	lsn - LSN of the last change to the database the tree is up to date w/, or changingLSN
+type bTree struct {
+	path      string
+	colType   ColumnType
+	root      uint32
+	numPages  uint32
+	truncated bool
+	lsn       uint64
+}
+
+// Compares 2 keys by their values, in the order of a column type, then by their offsets
+// Empty values come before any others, as when sorting entries (see makeEntryComparer)
+func compareBTreeKeys(a bTreeKey, b bTreeKey, colType ColumnType) int {
+	cmp := compareValuesEmptyFirst(a.value, b.value, colType)
+	if cmp != 0 {
+		return cmp
+	}
+	switch {
+	case a.offset < b.offset:
+		return -1
+	case a.offset > b.offset:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Reads the header page of a B+tree file into the tree
+func (t *bTree) readHeader(file *os.File) error {
+	header := make([]byte, pageSize)
+	_, err := file.ReadAt(header, 0)
+	if err != nil || [8]byte(header[:8]) != bTreeMagic {
+		return &dbError{fmt.Sprintf("Malformed index file %s", t.path)}
+	}
+	t.root = binary.LittleEndian.Uint32(header[8:])
+	t.numPages = binary.LittleEndian.Uint32(header[12:])
+	t.truncated = header[16] == 1
+	t.lsn = binary.LittleEndian.Uint64(header[17:])
+	return nil
+}
+
+// Writes the tree's header page
+func (t *bTree) writeHeader(file *os.File) error {
+	header := make([]byte, pageSize)
+	copy(header, bTreeMagic[:])
+	binary.LittleEndian.PutUint32(header[8:], t.root)
+	binary.LittleEndian.PutUint32(header[12:], t.numPages)
+	if t.truncated {
+		header[16] = 1
+	}
+	binary.LittleEndian.PutUint64(header[17:], t.lsn)
+	_, err := file.WriteAt(header, 0)
+	return err
+}
+
+// Records that the tree is being changed (see changingLSN) before any of it's pages are written, if it hasn't been already
+func (t *bTree) markChanging(file *os.File) error {
+	if t.lsn == changingLSN {
+		return nil
+	}
+	t.lsn = changingLSN
+	err := t.writeHeader(file)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't write to index file %s", t.path)}
+	}
+	return nil
+}
+
+// Records in the tree's header that it's up to date w/ the change to the database w/ an LSN, or that it's being changed (changingLSN)
+func (t *bTree) setLSN(lsn uint64) error {
+	if t.lsn == lsn {
+		return nil
+	}
+	return t.withFile(true, func(file *os.File) error {
+		t.lsn = lsn
+		return nil
+	})
+}
+
+// Reads the node on a page
+func (t *bTree) readNode(file *os.File, pageNum uint32) (*bTreeNode, error) {
+	page := make([]byte, pageSize)
+	_, err := file.ReadAt(page, int64(pageNum)*pageSize)
+	if err != nil {
+		return nil, &dbError{fmt.Sprintf("Couldn't read page %d of index file %s", pageNum, t.path)}
+	}
+	n, err := decodeBTreeNode(pageNum, page)
+	if err != nil {
+		return nil, &dbError{fmt.Sprintf("Malformed index file %s: %s", t.path, err)}
+	}
+	return n, nil
+}
+
+// Writes a node to it's page
+func (t *bTree) writeNode(file *os.File, n *bTreeNode) error {
+	_, err := file.WriteAt(n.encode(), int64(n.page)*pageSize)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't write page %d of index file %s", n.page, t.path)}
+	}
+	return nil
+}
+
+// Gives a new node a page at the end of the file
+func (t *bTree) allocate(n *bTreeNode) {
+	n.page = t.numPages
+	t.numPages++
+}
+
+// Opens the tree's file and passes it to a callback
+// The header is only read back before a write. Reads go by the tree as it was loaded or last written (under the database's lock),
+// so selects running at the same time never change the tree
+//
+// PARAMS:
+//
+//	write - whether the file will be written to, in which case the header is written back once the callback succeeds
+//	fn - the operation to carry out on the file
+func (t *bTree) withFile(write bool, fn func(file *os.File) error) error {
+	flag := os.O_RDONLY
+	if write {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(t.path, flag, 0644)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open index file %s", t.path)}
+	}
+	defer file.Close()
+
+	if write {
+		err = t.readHeader(file)
+		if err != nil {
+			return err
+		}
+	}
+	err = fn(file)
+	if err != nil || !write {
+		return err
+	}
+	err = t.writeHeader(file)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't write to index file %s", t.path)}
+	}
+	return nil
+}
+
+// Builds a tree's file from scratch out of keys given in sorted order, replacing any existing file once finished
+// Leaves are filled one after another, then each level of internal nodes is built on top of the level below,
+// so every page is only written once
+//
+// ATTRIBUTES:
+//
+//	tree - The tree being built
+//	file - The temporary file the tree is written to, which replaces the tree's file once finished
+//	leaf - The leaf being filled. Each leaf is written once the next one is started, so it can point to it
+//	level - The smallest key under each leaf written so far, and the leaf's page
+type bTreeBuilder struct {
+	tree  *bTree
+	file  *os.File
+	leaf  *bTreeNode
+	level []bTreeLevelEntry
+}
+
+// The smallest key under a node, and the node's page, used to build the level of the tree above it
+type bTreeLevelEntry struct {
+	key  bTreeKey
+	page uint32
+}
+
+// Starts building the tree's file from scratch (see bTreeBuilder)
+func (t *bTree) newBuilder() (*bTreeBuilder, error) {
+	file, err := os.Create(t.path + ".tmp")
+	if err != nil {
+		return nil, &dbError{fmt.Sprintf("Couldn't create file %s.tmp", t.path)}
+	}
+
+	t.numPages, t.truncated, t.lsn = 1, false, changingLSN
+	b := &bTreeBuilder{tree: t, file: file, leaf: &bTreeNode{leaf: true}, level: make([]bTreeLevelEntry, 0, 64)}
+	t.allocate(b.leaf)
+	return b, nil
+}
+
+// Adds the next key, which must not come before any key already added
+//
+// PARAMS:
+//
+//	key - the key
+//	truncated - whether the key's value was cut short (see makeBTreeKey)
+func (b *bTreeBuilder) add(key bTreeKey, truncated bool) error {
+	b.tree.truncated = b.tree.truncated || truncated
+	if b.leaf.size()+b.leaf.keySize(key) > pageSize {
+		newLeaf := &bTreeNode{leaf: true}
+		b.tree.allocate(newLeaf)
+		b.leaf.next = newLeaf.page
+		err := b.tree.writeNode(b.file, b.leaf)
+		if err != nil {
+			return err
+		}
+		b.leaf = newLeaf
+	}
+	if len(b.leaf.keys) == 0 {
+		b.level = append(b.level, bTreeLevelEntry{key, b.leaf.page})
+	}
+	b.leaf.keys = append(b.leaf.keys, key)
+	return nil
+}
+
+// Writes the last leaf and the internal nodes above the leaves, then replaces the tree's file w/ the new one
+func (b *bTreeBuilder) finish() error {
+	err := b.writeUpperLevels()
+	if err == nil {
+		err = b.tree.writeHeader(b.file)
+	}
+	if err == nil {
+		err = b.file.Sync()
+	}
+	b.file.Close()
+	if err == nil {
+		err = os.Rename(b.file.Name(), b.tree.path)
+	}
+	if err != nil {
+		os.Remove(b.file.Name())
+		if _, isDBErr := err.(*dbError); !isDBErr {
+			err = &dbError{fmt.Sprintf("Couldn't write index file %s", b.tree.path)}
+		}
+		return err
+	}
+	return nil
+}
+
+// Abandons the build, deleting the new file
+func (b *bTreeBuilder) abort() {
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
+
+// Writes the last leaf, then builds levels of internal nodes until there's only a root
+func (b *bTreeBuilder) writeUpperLevels() error {
+	t := b.tree
+	err := t.writeNode(b.file, b.leaf)
+	if err != nil {
+		return err
+	}
+	level := b.level
+	if len(level) <= 1 {
+		t.root = b.leaf.page
+		return nil
+	}
+
+	for len(level) > 1 {
+		nextLevel := make([]bTreeLevelEntry, 0, len(level)/8+1)
+		node := &bTreeNode{children: []uint32{level[0].page}}
+		nodeStart := level[0].key
+		for _, entry := range level[1:] {
+			if node.size()+node.keySize(entry.key) > pageSize {
+				t.allocate(node)
+				err = t.writeNode(b.file, node)
+				if err != nil {
+					return err
+				}
+				nextLevel = append(nextLevel, bTreeLevelEntry{nodeStart, node.page})
+				node = &bTreeNode{children: []uint32{entry.page}}
+				nodeStart = entry.key
+				continue
+			}
+			node.keys = append(node.keys, entry.key)
+			node.children = append(node.children, entry.page)
+		}
+		t.allocate(node)
+		err = t.writeNode(b.file, node)
+		if err != nil {
+			return err
+		}
+		nextLevel = append(nextLevel, bTreeLevelEntry{nodeStart, node.page})
+		level = nextLevel
+	}
+	t.root = level[0].page
+	return nil
+}
+
+// Adds a key to the tree, splitting nodes that overflow their pages
+// The tree is marked as being changed first (see changingLSN), as a crash part way through a split would leave it inconsistent
+func (t *bTree) insert(key bTreeKey, truncated bool) error {
+	return t.withFile(true, func(file *os.File) error {
+		err := t.markChanging(file)
+		if err != nil {
+			return err
+		}
+		t.truncated = t.truncated || truncated
+		splitKey, splitPage, err := t.insertInto(file, t.root, key)
+		if err != nil || splitPage == 0 {
+			return err
+		}
+
+		// Root was split, so the tree grows a level
+		root := &bTreeNode{keys: []bTreeKey{splitKey}, children: []uint32{t.root, splitPage}}
+		t.allocate(root)
+		t.root = root.page
+		return t.writeNode(file, root)
+	})
+}
+
+// Adds a key to the subtree under a node
+//
+// RETURNS:
+//
+//	if the node was split, the smallest key under the new node to it's right, and the new node's page (otherwise page 0)
+//	a dbError if we couldn't read or write the file
+func (t *bTree) insertInto(file *os.File, pageNum uint32, key bTreeKey) (bTreeKey, uint32, error) {
+	n, err := t.readNode(file, pageNum)
+	if err != nil {
+		return bTreeKey{}, 0, err
+	}
+
+	pos := t.search(n, key)
+	if n.leaf {
+		n.keys = insertAt(n.keys, pos, key)
+	} else {
+		splitKey, splitPage, err := t.insertInto(file, n.children[pos], key)
+		if err != nil || splitPage == 0 {
+			return bTreeKey{}, 0, err
+		}
+		n.keys = insertAt(n.keys, pos, splitKey)
+		n.children = insertAt(n.children, pos+1, splitPage)
+	}
+
+	if n.size() <= pageSize {
+		return bTreeKey{}, 0, t.writeNode(file, n)
+	}
+	right, splitKey := t.split(n)
+	err = t.writeNode(file, n)
+	if err == nil {
+		err = t.writeNode(file, right)
+	}
+	return splitKey, right.page, err
+}
+
+// Finds where a key belongs in a node
+// For a leaf, this is the position to insert it at. For an internal node, it's the child whose subtree the key belongs in
+func (t *bTree) search(n *bTreeNode, key bTreeKey) int {
+	low, high := 0, len(n.keys)
+	for low < high {
+		mid := (low + high) / 2
+		if compareBTreeKeys(n.keys[mid], key, t.colType) <= 0 {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	return low
+}
+
+// Splits an overflowing node in 2 by size, moving the upper half of it's keys to a new node on a new page
+// Keys are at most maxKeyLen long, so both halves of a node that's overflowed by 1 key always fit in their pages
+//
+// RETURNS:
+//
+//	the new node
+//	the smallest key under the new node, to seperate it from the old node in their parent
+func (t *bTree) split(n *bTreeNode) (*bTreeNode, bTreeKey) {
+	half := n.size() / 2
+	size := 7
+	mid := 0
+	for mid < len(n.keys)-1 && size < half {
+		size += n.keySize(n.keys[mid])
+		mid++
+	}
+
+	right := &bTreeNode{leaf: n.leaf}
+	t.allocate(right)
+	if n.leaf {
+		right.keys = append([]bTreeKey{}, n.keys[mid:]...)
+		right.next = n.next
+		n.keys = n.keys[:mid]
+		n.next = right.page
+		return right, right.keys[0]
+	}
+
+	// The middle key moves up to the parent, rather than being kept in either half
+	splitKey := n.keys[mid]
+	right.keys = append([]bTreeKey{}, n.keys[mid+1:]...)
+	right.children = append([]uint32{}, n.children[mid+1:]...)
+	n.keys = n.keys[:mid]
+	n.children = n.children[:mid+1]
+	return right, splitKey
+}
+
+// Inserts an item into a slice at a position
+func insertAt[T any](items []T, pos int, item T) []T {
+	items = append(items, item)
+	copy(items[pos+1:], items[pos:])
+	items[pos] = item
+	return items
+}
+
+// Scans the tree's keys in order, starting from the first key whose value is at least a given value
+//
+// PARAMS:
+//
+//	from - value to start from. The scan starts from the very first key if this is empty
+//	keyFn - called w/ each key in order. Returns false to stop the scan
+//
+// RETURNS: a dbError if we couldn't read the file
+func (t *bTree) scan(from string, keyFn func(key bTreeKey) bool) error {
+	return t.withFile(false, func(file *os.File) error {
+		start := bTreeKey{from, -1} // Comes before every key w/ the value, as offsets are never negative
+		if len(from) > maxKeyLen {
+			start.value = from[:maxKeyLen]
+		}
+
+		// Go down to the leaf the scan starts in
+		n, err := t.readNode(file, t.root)
+		for err == nil && !n.leaf {
+			n, err = t.readNode(file, n.children[t.search(n, start)])
+		}
+		if err != nil {
+			return err
+		}
+
+		// Scan along the leaves
+		pos := t.search(n, start)
+		for {
+			for _, key := range n.keys[pos:] {
+				if !keyFn(key) {
+					return nil
+				}
+			}
+			if n.next == 0 {
+				return nil
+			}
+			n, err = t.readNode(file, n.next)
+			if err != nil {
+				return err
+			}
+			pos = 0
+		}
+	})
+}
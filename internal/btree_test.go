@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Makes an empty B+tree in a temporary file
+func newTestTree(t *testing.T, colType ColumnType) *bTree {
+	t.Helper()
+	tree := &bTree{path: filepath.Join(t.TempDir(), "test.btree"), colType: colType}
+	builder, err := tree.newBuilder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = builder.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// Checks every node of a tree fits in it's page and has it's keys in order, and returns the keys in the order a scan gives them
+func checkTree(t *testing.T, tree *bTree) []bTreeKey {
+	t.Helper()
+	err := tree.withFile(false, func(file *os.File) error {
+		for page := uint32(1); page < tree.numPages; page++ {
+			n, err := tree.readNode(file, page)
+			if err != nil {
+				return err
+			}
+			if n.size() > pageSize {
+				return fmt.Errorf("page %d takes up %d bytes", page, n.size())
+			}
+			if !n.leaf && len(n.children) != len(n.keys)+1 {
+				return fmt.Errorf("page %d has %d keys and %d children", page, len(n.keys), len(n.children))
+			}
+			for i := 1; i < len(n.keys); i++ {
+				if compareBTreeKeys(n.keys[i-1], n.keys[i], tree.colType) >= 0 {
+					return fmt.Errorf("page %d has keys out of order", page)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]bTreeKey, 0)
+	err = tree.scan("", func(key bTreeKey) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestBTreeInsert(t *testing.T) {
+	tests := []struct {
+		name    string
+		colType ColumnType
+		numKeys int
+		valueFn func(i int) string
+	}{
+		{"small int keys", INT, 5000, func(i int) string { return fmt.Sprint(i % 1000) }},
+		{"long text keys", TEXT, 3000, func(i int) string { return fmt.Sprintf("%04d", i%500) + strings.Repeat("x", 500) }},
+		{"keys cut short", TEXT, 2000, func(i int) string { return strings.Repeat("y", maxKeyLen) + fmt.Sprint(i) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree := newTestTree(t, test.colType)
+			want := make([]bTreeKey, 0, test.numKeys)
+			for _, i := range rand.New(rand.NewSource(1)).Perm(test.numKeys) {
+				key, truncated := makeBTreeKey(test.valueFn(i), int64(i))
+				err := tree.insert(key, truncated)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, key)
+			}
+			slices.SortFunc(want, func(a, b bTreeKey) int { return compareBTreeKeys(a, b, test.colType) })
+
+			got := checkTree(t, tree)
+			if !slices.Equal(got, want) {
+				t.Fatalf("scan gave %d keys, want %d in order", len(got), len(want))
+			}
+
+			// Reload the tree from it's file
+			reloaded := &bTree{path: tree.path, colType: test.colType}
+			err := reloaded.withFile(false, reloaded.readHeader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reloaded.root != tree.root || reloaded.numPages != tree.numPages || reloaded.lsn != changingLSN {
+				t.Errorf("reloaded header is %+v, want %+v", reloaded, tree)
+			}
+		})
+	}
+}
+
+func TestBTreeScanFrom(t *testing.T) {
+	tree := newTestTree(t, INT)
+	for i := range 4000 {
+		err := tree.insert(bTreeKey{fmt.Sprint(i / 2), int64(i)}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		from  string
+		count int
+		first bTreeKey
+	}{
+		{"", 4000, bTreeKey{"0", 0}},
+		{"0", 4000, bTreeKey{"0", 0}},
+		{"1000", 2000, bTreeKey{"1000", 2000}},
+		{"1999", 2, bTreeKey{"1999", 3998}},
+		{"2000", 0, bTreeKey{}},
+		{"-5", 4000, bTreeKey{"0", 0}},
+	}
+	for _, test := range tests {
+		keys := make([]bTreeKey, 0)
+		err := tree.scan(test.from, func(key bTreeKey) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != test.count || (test.count > 0 && keys[0] != test.first) {
+			t.Errorf("scan from %q gave %d keys starting %v, want %d starting %v", test.from, len(keys), keys[0:min(1, len(keys))], test.count, test.first)
+		}
+	}
+}
+
+func TestBTreeRebuiltAfterCrash(t *testing.T) {
+	coll := newTestCollection(t)
+	db := newTestDB(t, coll, "people", []string{"age:int"})
+	err := db.CreateIndex([]string{"age"}, BTREE_INDEX, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2000 {
+		err = db.Insert([]string{"age"}, []string{fmt.Sprint(i % 100)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree := db.indexOn("age").tree
+	if tree.lsn != db.lsn {
+		t.Fatalf("tree's LSN is %d, want the database's LSN %d", tree.lsn, db.lsn)
+	}
+
+	// Leave the tree as a crash part way through a change could: marked as changing, w/ it's pages lost
+	err = tree.withFile(true, func(file *os.File) error {
+		err := tree.markChanging(file)
+		for page := int64(1); page < int64(tree.numPages) && err == nil; page++ {
+			_, err = file.WriteAt(make([]byte, pageSize), page*pageSize)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll.Close()
+
+	coll, err = LoadCollection("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { coll.Close() })
+	db, err = coll.GetDB("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree := db.indexOn("age").tree; tree.lsn != db.lsn {
+		t.Errorf("reloaded tree's LSN is %d, want the database's LSN %d", tree.lsn, db.lsn)
+	}
+	rows := selectRows(t, db, SelectQuery{Columns: []string{"age"}, Condition: "age >= 98"})
+	if len(rows) != 40 {
+		t.Errorf("got %d entries w/ age >= 98, want 40", len(rows))
+	}
+}
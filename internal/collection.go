@@ -1,27 +1,46 @@
 package internal
 
 import (
-	"bufio"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"github.com/joho/godotenv"
 	"log"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // Collection Represents a collection (a group of databases)
 // Used to hold the currently active collection that the user is operating on
 // In the filesystem, a collection is a directory that holds JSON files, each of them representing a database
+// A collection is safe for concurrent use, as long as it's databases are got w/ GetDB rather than from dbs directly
 //
 // FIELDS:
 //
 //		name - name of the collection
 //		path - file path of the directory associated w/ the collection
 //	 dbs - map of databases in collection: key is database name, value is a pointer to database object
+//	 wal - write-ahead log of changes to the collection's databases (see writeAheadLog)
+//	 mu - Held for reading while databases are looked up, and for writing while databases are made, dropped or renamed
+//	 lock - The file the collection's advisory lock is held on (see openLockFile), kept open to hold the lock (see lockCollection)
+//	 readOnly - Whether the collection was loaded read-only (see LoadCollectionReadOnly). If so, it has no write-ahead log
+//	 snapshots - map of the collection's open transactions to their snapshots (see Tx)
+//	 snapshotsMu - Held while snapshots is being read or changed
+//	 gc - The collection's garbage collector, or nil if the collection is read-only (see Collection.collectGarbage)
 type Collection struct {
-	Name string
-	Path string
-	DBs  map[string]*Database
+	Name        string
+	Path        string
+	dbs         map[string]*Database
+	wal         *writeAheadLog
+	mu          sync.RWMutex
+	lock        *os.File
+	readOnly    bool
+	snapshots   map[*Tx]uint64
+	snapshotsMu sync.Mutex
+	gc          *garbageCollector
 }
 
 // CollError Error type for all collection-related errors
@@ -34,42 +53,193 @@ func (e *CollError) Error() string {
 	return fmt.Sprintf("COLLECTION ERROR: %s", e.message)
 }
 
-// LoadCollection Loads an existant collection from the filesystem
-// If collection of specified name does not exist, returns a collectionError
+// Returns a CollError if the collection was loaded read-only, for methods that change it
+func (coll *Collection) checkWritable() error {
+	if coll.readOnly {
+		return &CollError{fmt.Sprintf("COLLECTION '%s' IS READ-ONLY", coll.Name)}
+	}
+	return nil
+}
+
+// LoadCollection Loads an existant collection from the filesystem, to be read and written
+// If collection of specified name does not exist, returns the error from the filesystem (check for it w/ os.IsNotExist()),
+// and if another process has the collection open, returns a CollError
+// Any changes in the collection's write-ahead log that weren't made to the database files (i.e. we crashed part way through)
+// are made, then a checkpoint is made. Transactions that weren't committed are thrown away
+// While the collection is open, a garbage collector removes old versions of entries from it's databases every GCInterval (see entryVersion)
 //
 // PARAMS:
 //
 //	name - name of the collection
 func LoadCollection(name string) (*Collection, error) {
+	return loadCollection(name, false)
+}
+
+// LoadCollectionReadOnly Loads an existant collection from the filesystem, to be read but not written
+// Any number of processes can have a collection open read-only at once, but not while a process has it open to be written
+// Nothing is written to the collection's directory, so if the collection needs recovering from a crash (see LoadCollection)
+// or it's databases are in an older format, a CollError is returned and it must be loaded w/ LoadCollection first
+// Indexes that are out of date aren't used. Otherwise, errors are as in LoadCollection
+//
+// PARAMS:
+//
+//	name - name of the collection
+func LoadCollectionReadOnly(name string) (*Collection, error) {
+	return loadCollection(name, true)
+}
+
+// Does the work of LoadCollection and LoadCollectionReadOnly
+func loadCollection(name string, readOnly bool) (*Collection, error) {
 
 	// Get collection directory
 	// Concatenate collection name onto .env variable for collections directory path
 	godotenv.Load("/Users/devinsidhu/Documents/golang_db/.env")
+	loadMemoryBudget()
+	loadWALSettings()
+	loadGCSettings()
 	collectionPath := fmt.Sprintf("%s/%s", os.Getenv("COLLECTIONS_DIR"), name)
-	collectionDir, err := os.Open(collectionPath)
+
+	// Lock the collection before anything is read from it, so another process can't be part way through writing it
+	lock, err := openLockFile(collectionPath)
+	if err != nil {
+		return nil, err
+	}
+	err = lockCollection(lock, name, readOnly)
 	if err != nil {
+		lock.Close()
 		return nil, err
 	}
 
-	// Get database files from collection directory
-	filenames, err := collectionDir.Readdirnames(0)
+	wal, records, err := openWAL(collectionPath, readOnly)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = collectionDir.Close()
+	if readOnly {
+		err = checkRecovered(collectionPath, name, records)
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		wal = nil // Nothing will be written to the log
+	} else {
+		// Throw away the copies of databases made by transactions that were open when we crashed
+		err = removeTxDirs(collectionPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Get database files from collection directory
+	filenames, err := os.ReadDir(collectionPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// Load databases into dbs map
+	// Only CSV files are databases - the directory also holds other files, such as database metadata files
+	// Entries we crashed part way through appending are cut off first, as they can't be read
 	dbs := make(map[string]*Database)
-	for _, filename := range filenames {
-		dbName := filename[:len(filename)-4] // Remove last 5 characters (i.e. '.json' extension) from filename to get database's name
+	for _, entry := range filenames {
+		filename := entry.Name()
+		if !strings.HasSuffix(filename, ".csv") || entry.IsDir() {
+			continue
+		}
+		dbName := strings.TrimSuffix(filename, ".csv") // Remove '.csv' extension from filename to get database's name
 		dbFilePath := fmt.Sprintf("%s/%s", collectionPath, filename)
-		dbs[dbName] = loadDB(dbFilePath)
+		if readOnly {
+			dbs[dbName] = loadDB(dbFilePath, true)
+			continue
+		}
+
+		err = repairTornAppend(dbFilePath, records)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dbs[dbName] = loadDB(dbFilePath, false)
+		dbs[dbName].wal = wal
+		if dbs[dbName].lsn >= wal.nextLSN {
+			wal.nextLSN = dbs[dbName].lsn + 1 // LSNs carry on from before the log was last truncated
+		}
+	}
+	coll := &Collection{Name: name, Path: collectionPath, dbs: dbs, wal: wal, lock: lock, readOnly: readOnly, snapshots: make(map[*Tx]uint64)}
+	if readOnly {
+		return coll, nil
 	}
+	wal.coll = coll
 
-	return &Collection{Name: name, Path: collectionPath, DBs: dbs}, nil
+	// Replay changes from the log, then make a checkpoint so they aren't replayed again
+	err = coll.replay(records)
+	if err == nil {
+		err = wal.checkpoint()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	coll.startGC()
+	return coll, nil
+}
+
+// Error for a file that another process holds a conflicting lock on (see lockFile)
+var errLocked = errors.New("file is locked by another process")
+
+// Locks a collection's directory, so other processes can't write to the collection while we have it open
+// A collection opened to be written is locked exclusively, and one opened read-only is locked shared
+// Returns a CollError if another process has the collection open in a way that conflicts
+//
+// PARAMS:
+//
+//	lock - the collection's open lock file (see openLockFile). The lock is held until it's closed
+//	name - name of the collection
+//	readOnly - whether the collection is being opened read-only
+func lockCollection(lock *os.File, name string, readOnly bool) error {
+	err := lockFile(lock, readOnly)
+	switch {
+	case errors.Is(err, errLocked) && readOnly:
+		return &CollError{fmt.Sprintf("COLLECTION '%s' IS OPEN FOR WRITING IN ANOTHER PROCESS", name)}
+	case errors.Is(err, errLocked):
+		return &CollError{fmt.Sprintf("COLLECTION '%s' IS OPEN IN ANOTHER PROCESS", name)}
+	case err != nil:
+		return &CollError{fmt.Sprintf("COULDN'T LOCK COLLECTION '%s': %s", name, err)}
+	}
+	return nil
+}
+
+// Close Stops the collection's garbage collector, syncs the collection's write-ahead log and makes a checkpoint,
+// then releases the collection's lock, so other processes can open it
+// The collection can't be used once it's closed
+// Returns an error if the log can't be synced or checkpointed, the lock can't be released,
+// or the garbage collector's last pass over a database failed (see Collection.collectGarbage)
+func (coll *Collection) Close() error {
+	gcErr := coll.stopGC()
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+	var walErr error
+	if coll.wal != nil {
+		walErr = coll.wal.close()
+	}
+	err := coll.lock.Close()
+	if err != nil {
+		return err
+	}
+	if walErr != nil {
+		return walErr
+	}
+	return gcErr
+}
+
+// Sets MemoryBudget from the MEMORY_BUDGET .env variable (a number of bytes), if it's set
+// Must be called after the .env file is loaded
+func loadMemoryBudget() {
+	budgetStr := os.Getenv("MEMORY_BUDGET")
+	if budgetStr == "" {
+		return
+	}
+	budget, err := strconv.ParseInt(budgetStr, 10, 64)
+	if err != nil || budget < 1 {
+		log.Fatalf("MEMORY_BUDGET must be a positive number of bytes, got '%s'", budgetStr)
+	}
+	MemoryBudget = budget
 }
 
 // MakeNewCollection Makes an entirely new collection
@@ -79,6 +249,9 @@ func MakeNewCollection(name string) *Collection {
 	// Make collection directory
 	// Concatenate collection name onto .env variable for collections directory path
 	godotenv.Load("/Users/devinsidhu/Documents/golang_db/.env")
+	loadMemoryBudget()
+	loadWALSettings()
+	loadGCSettings()
 	collection_path := fmt.Sprintf("%s/%s", os.Getenv("COLLECTIONS_DIR"), name)
 	fmt.Println(collection_path)
 	err := os.Mkdir(collection_path, 0755)
@@ -86,20 +259,64 @@ func MakeNewCollection(name string) *Collection {
 		log.Fatal(err)
 	}
 
+	// Lock the new collection for writing, as in LoadCollection
+	lock, err := openLockFile(collection_path)
+	if err == nil {
+		err = lockCollection(lock, name, false)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wal, _, err := openWAL(collection_path, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Empty slice of dbs, since collection is new
 	dbs := make(map[string]*Database)
-	return &Collection{Name: name, Path: collection_path, DBs: dbs}
+	coll := &Collection{Name: name, Path: collection_path, dbs: dbs, wal: wal, lock: lock, snapshots: make(map[*Tx]uint64)}
+	wal.coll = coll
+	coll.startGC()
+	return coll
 }
 
 // NewDB Creates a new database in the filesystem and add it to the collection
+// Returns a CollError if a database w/ the name already exists, or a dbError if a column definition is invalid
+//
 // PARAMS:
 //
 //	DBName - name of new DB
-//	columns - names of new columns for DB (variadic, so can provide 1 slice of strings, or all strings as separate arguments)
-func (coll *Collection) NewDB(DBName string, columns ...string) {
+//	columnDefs - definitions of new columns for DB, each either 'name' or 'name:type' (e.g. 'age:int').
+//	             Columns without a type are text columns. Variadic, so can provide 1 slice of strings, or all strings as separate arguments
+func (coll *Collection) NewDB(DBName string, columnDefs ...string) error {
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+
+	err := coll.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	if _, exists := coll.dbs[DBName]; exists {
+		return &CollError{fmt.Sprintf("DATABASE '%s' ALREADY EXISTS IN COLLECTION '%s'", DBName, coll.Name)}
+	}
 
 	// Add an ID column as first column in DB
-	columns = append([]string{"id"}, columns...)
+	columns := []string{"id"}
+	types := map[string]ColumnType{"id": INT}
+
+	for _, def := range columnDefs {
+		name, colType, err := parseColumnDef(def)
+		if err != nil {
+			return err
+		}
+		if _, exists := types[name]; exists {
+			return &dbError{fmt.Sprintf("Column '%s' defined more than once", name)}
+		}
+		columns = append(columns, name)
+		types[name] = colType
+	}
 
 	// Create JSON file for DB
 	DBPath := fmt.Sprintf("%s/%s.csv", coll.Path, DBName)
@@ -108,9 +325,13 @@ func (coll *Collection) NewDB(DBName string, columns ...string) {
 		log.Fatal(err)
 	}
 
-	// Add columns to first line of newly created CSV file
-	columnsStr := strings.Join(columns, ",") + "\n"
-	_, err = file.WriteString(columnsStr)
+	// Add columns to first line of newly created CSV file, followed by the columns for entries' timestamps
+	writer := csv.NewWriter(file)
+	err = writer.Write(slices.Concat(columns, versionColumns))
+	if err == nil {
+		writer.Flush()
+		err = writer.Error()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -120,8 +341,16 @@ func (coll *Collection) NewDB(DBName string, columns ...string) {
 		log.Fatal(closeErr)
 	}
 
+	// Create metadata file for DB
+	db := &Database{FilePath: DBPath, Columns: columns, Types: types, wal: coll.wal}
+	metaErr := db.saveMetadata()
+	if metaErr != nil {
+		log.Fatal(metaErr)
+	}
+
 	// Add DB to active collection
-	coll.DBs[DBName] = &Database{FilePath: DBPath, Columns: columns}
+	coll.dbs[DBName] = db
+	return nil
 }
 
 // Loads a database from an existing file into a database object
@@ -131,22 +360,103 @@ func (coll *Collection) NewDB(DBName string, columns ...string) {
 // Unlike NewDB(), this is a standalone function (not a collection struct method)
 // and so doesn't add the DB to the collection's DB map
 //
-// PARAMS: filePath - path to JSON file associated with DB to load
-func loadDB(filePath string) *Database {
-	// Load DB file
-	file, err := os.Open(filePath)
-	if err != nil {
+// PARAMS:
+//
+//	filePath - path to JSON file associated with DB to load
+//	readOnly - whether the DB is being loaded read-only, in which case nothing is written to it's files (see LoadCollectionReadOnly)
+func loadDB(filePath string, readOnly bool) *Database {
+
+	// Load DB's metadata file. DBs made before metadata files existed won't have one
+	meta, err := loadMetadata(filePath)
+	if err != nil && !os.IsNotExist(err) {
 		log.Fatal(err)
 	}
-	defer file.Close()
-	lineScanner := bufio.NewScanner(file)
+
+	// Bring DB files stored in an older format up to date before reading anything from them
+	migrated := (meta == nil || meta.Format < currentFileFormat) && !readOnly
+	if migrated {
+		if meta == nil || meta.Format < 1 {
+			err = migrateLegacyFile(filePath)
+		}
+		if err == nil && (meta == nil || meta.Format < 2) {
+			err = addVersionColumns(filePath)
+		}
+		if err == nil {
+			err = padXmaxColumn(filePath)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Read CSV columns from 1st line of file
-	lineScanner.Scan()
-	columnStr := lineScanner.Text()
-	columns := strings.Split(columnStr, ",")
+	columns, err := readColumns(filePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	res := &Database{FilePath: filePath, Columns: columns, Types: make(map[string]ColumnType), readOnly: readOnly}
+
+	// Load column types from DB's metadata file
+	// Columns with no recorded type (e.g. in DBs that predate typed columns) are text, apart from the id column
+	for _, col := range columns {
+		typeName, typeRecorded := "", false
+		if meta != nil {
+			typeName, typeRecorded = meta.Types[col]
+		}
+
+		switch {
+		case typeRecorded:
+			res.Types[col], err = ParseColumnType(typeName)
+			if err != nil {
+				log.Fatal(err)
+			}
+		case col == "id":
+			res.Types[col] = INT
+		default:
+			res.Types[col] = TEXT
+		}
+	}
+
+	// Load id sequence and last change from DB's metadata file
+	if meta != nil {
+		res.sequence = meta.Sequence
+		res.lsn = meta.LSN
+	} else {
+		// DB predates metadata files, so carry on the sequence from the highest id already in the DB
+		idIdx := slices.Index(columns, "id")
+		err = res.readEntries(func(values []string) error {
+			id, convErr := strconv.Atoi(values[idIdx])
+			if convErr == nil && id > res.sequence {
+				res.sequence = id
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Load indexes recorded in DB's metadata file
+	// Entries moved when the DB file was migrated, which it's indexes' modification times can't always show, so they're rebuilt
+	if meta != nil {
+		err = res.loadIndexes(meta.Indexes)
+		if err == nil && migrated {
+			err = res.buildIndexes(res.indexes...)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Record that DB file is now in the current format
+	if !readOnly {
+		err = res.saveMetadata()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	res := &Database{FilePath: filePath, Columns: columns}
 	return res
 }
 
@@ -157,39 +467,107 @@ func loadDB(filePath string) *Database {
 //
 //	dbName - name of DB to drop
 func (coll *Collection) DropDB(dbName string) error {
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+
+	err := coll.checkWritable()
+	if err != nil {
+		return err
+	}
+
+	// Wait for any selects or changes on the DB to finish, then make a checkpoint, so the write-ahead log
+	// has no changes to the DB that could be replayed onto a later DB w/ the same name
+	if db, loaded := coll.dbs[dbName]; loaded {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		err = coll.wal.checkpoint()
+		if err != nil {
+			return err
+		}
+	}
 
 	// Delete DB file
 	filepath := fmt.Sprintf("%s/%s.csv", coll.Path, dbName)
-	err := os.Remove(filepath)
+	err = os.Remove(filepath)
 	if err != nil {
 		return &CollError{fmt.Sprintf("NO DATABASE CALLED '%s' IN COLLECTION '%s'", dbName, coll.Name)}
 	}
 
+	// Delete DB metadata file. Older DBs may not have one
+	err = os.Remove(metadataPath(filepath))
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+
+	// Delete DB's index files
+	if db, loaded := coll.dbs[dbName]; loaded {
+		for _, idx := range db.indexes {
+			err = os.Remove(idx.path)
+			if err != nil && !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+		}
+	}
+
 	// Remove DB from collection object's DB map
-	delete(coll.DBs, dbName)
+	delete(coll.dbs, dbName)
 	return nil
 }
 
 // RenameDB Rename a database in the collection
+// Returns a CollError if the database doesn't exist, or a database already has the new name
 //
 // PARAMS:
 //
 //	oldDBName - current name of DB to rename
 //	newDBName - New name for DB
 func (coll *Collection) RenameDB(oldDBName string, newDBName string) error {
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+
+	err := coll.checkWritable()
+	if err != nil {
+		return err
+	}
 
 	// Rename DB in collection by adding new pair under new name and deleting old entry
-	db, foundKey := coll.DBs[oldDBName]
+	db, foundKey := coll.dbs[oldDBName]
 	if !foundKey {
 		return &CollError{fmt.Sprintf("NO DATABASE CALLED '%s' IN COLLECTION '%s'", oldDBName, coll.Name)}
 	}
-	coll.DBs[newDBName] = db
-	delete(coll.DBs, oldDBName)
+	if _, exists := coll.dbs[newDBName]; exists {
+		return &CollError{fmt.Sprintf("DATABASE '%s' ALREADY EXISTS IN COLLECTION '%s'", newDBName, coll.Name)}
+	}
+
+	// Wait for any selects or changes on the DB to finish
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Make a checkpoint first, as changes in the write-ahead log refer to the DB by it's old name
+	err = coll.wal.checkpoint()
+	if err != nil {
+		return err
+	}
+	coll.dbs[newDBName] = db
+	delete(coll.dbs, oldDBName)
 
 	// Rename DB file
 	oldPath := db.FilePath
 	newPath := fmt.Sprintf("%s/%s.csv", coll.Path, newDBName)
-	err := os.Rename(oldPath, newPath)
+	err = os.Rename(oldPath, newPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.FilePath = newPath
+
+	// Rename DB metadata file along with it
+	err = os.Rename(metadataPath(oldPath), metadataPath(newPath))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Rename DB index files along with it
+	err = db.moveIndexFiles()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -197,9 +575,29 @@ func (coll *Collection) RenameDB(oldDBName string, newDBName string) error {
 	return nil
 }
 
+// GetDB Gets a database in the collection by name
+// Returns a collection error if there is no database of that name in the collection
+//
+// PARAMS:
+//
+//	dbName - name of DB to get
+func (coll *Collection) GetDB(dbName string) (*Database, error) {
+	coll.mu.RLock()
+	defer coll.mu.RUnlock()
+
+	db, foundKey := coll.dbs[dbName]
+	if !foundKey {
+		return nil, &CollError{fmt.Sprintf("NO DATABASE CALLED '%s' IN COLLECTION '%s'", dbName, coll.Name)}
+	}
+	return db, nil
+}
+
 // ListDBs Outputs a list of all databases in the collection
 func (coll *Collection) ListDBs() {
-	for name, _ := range coll.DBs {
+	coll.mu.RLock()
+	defer coll.mu.RUnlock()
+
+	for name, _ := range coll.dbs {
 		fmt.Println(name)
 	}
 }
@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Runs a number of workers at once, alongside readers that run over and over until the workers have all finished
+func runConcurrently(workers int, workFn func(worker int), readers int, readFn func()) {
+	done := make(chan struct{})
+	var readersWG, workersWG sync.WaitGroup
+	for range readers {
+		readersWG.Add(1)
+		go func() {
+			defer readersWG.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					readFn()
+				}
+			}
+		}()
+	}
+	for worker := range workers {
+		workersWG.Add(1)
+		go func() {
+			defer workersWG.Done()
+			workFn(worker)
+		}()
+	}
+	workersWG.Wait()
+	close(done)
+	readersWG.Wait()
+}
+
+// Checks no entry appears more than once in a result set, as it would if a select saw 2 versions of it
+func checkIDsUnique(t *testing.T, res *ResultSet) {
+	t.Helper()
+	ids := make(map[string]bool)
+	for _, row := range res.Rows {
+		if ids[row[0]] {
+			t.Errorf("entry w/ id %s appears more than once in %q", row[0], rowStrings(res))
+			return
+		}
+		ids[row[0]] = true
+	}
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	coll := newTestCollection(t)
+	db := newTestDB(t, coll, "people", []string{"name", "n:int"})
+	const workers, changes = 4, 30
+
+	// Each worker inserts it's own entries, updates each one, and deletes every 3rd one, while selects run alongside
+	runConcurrently(workers, func(worker int) {
+		name := fmt.Sprintf("w%d", worker)
+		for i := range changes {
+			err := db.Insert([]string{"name", "n"}, []string{name, fmt.Sprint(i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			count, err := db.Update(map[string]string{"n": fmt.Sprint(i + 1000)}, fmt.Sprintf("name = '%s' and n = %d", name, i))
+			if err == nil && count != 1 {
+				err = fmt.Errorf("update changed %d entries, want 1", count)
+			}
+			if err == nil && i%3 == 0 {
+				count, err = db.Delete(fmt.Sprintf("name = '%s' and n = %d", name, i+1000))
+				if err == nil && count != 1 {
+					err = fmt.Errorf("delete removed %d entries, want 1", count)
+				}
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}, 2, func() {
+		res, err := db.Select(SelectQuery{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		checkIDsUnique(t, res)
+	})
+
+	rows := selectRows(t, db, SelectQuery{Columns: []string{"name", "n"}})
+	slices.Sort(rows)
+	want := make([]string, 0)
+	for worker := range workers {
+		for i := range changes {
+			if i%3 != 0 {
+				want = append(want, fmt.Sprintf("w%d|%d", worker, i+1000))
+			}
+		}
+	}
+	slices.Sort(want)
+	if !slices.Equal(rows, want) {
+		t.Errorf("got rows\n%q\nwant\n%q", rows, want)
+	}
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	coll := newTestCollection(t)
+	const workers, commits = 4, 10
+	entries := make([][]string, workers*2)
+	for i := range entries {
+		entries[i] = []string{"0"}
+	}
+	newTestDB(t, coll, "a", []string{"n:int"}, entries...)
+	newTestDB(t, coll, "b", []string{"n:int"}, entries...)
+
+	// Even workers change their entries in both databases in transactions, getting the databases in opposite orders so their commits
+	// lock them in opposite orders if they don't sort them. Odd workers change their entries outside transactions,
+	// while joins over both databases run alongside
+	runConcurrently(workers, func(worker int) {
+		order := []string{"a", "b"}
+		if worker%4 == 2 {
+			order = []string{"b", "a"}
+		}
+		for i := range commits {
+			assignments := map[string]string{"n": fmt.Sprint(i + 1)}
+			condition := fmt.Sprintf("id = %d or id = %d", worker*2+1, worker*2+2)
+			if worker%2 == 1 {
+				for _, name := range order {
+					db, err := coll.GetDB(name)
+					if err == nil {
+						_, err = db.Update(assignments, condition)
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				continue
+			}
+
+			tx, err := coll.Begin()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, name := range order {
+				var db *Database
+				db, err = tx.GetDB(name)
+				if err == nil {
+					_, err = db.Update(assignments, condition)
+				}
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}, 2, func() {
+		res, err := coll.Select("a", []Join{{INNER_JOIN, "b", []JoinKey{{"a.id", "b.id"}}}}, SelectQuery{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(res.Rows) != workers*2 {
+			t.Errorf("join gave %d rows, want %d", len(res.Rows), workers*2)
+		}
+	})
+
+	for _, name := range []string{"a", "b"} {
+		db, err := coll.GetDB(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := selectRows(t, db, SelectQuery{Columns: []string{"n"}})
+		if want := slices.Repeat([]string{fmt.Sprint(commits)}, workers*2); !slices.Equal(rows, want) {
+			t.Errorf("got rows %q in %s, want %q", rows, name, want)
+		}
+	}
+	if horizon := coll.gcHorizon(); horizon != math.MaxUint64 {
+		t.Errorf("GC horizon is %d once every transaction has finished, want no horizon", horizon)
+	}
+}
+
+func TestConcurrentDBChanges(t *testing.T) {
+	coll := newTestCollection(t)
+	newTestDB(t, coll, "people", []string{"name"}, []string{"alice"})
+	const workers, rounds = 4, 10
+
+	// Each worker makes, renames and drops it's own databases, while selects on another database and transactions run alongside
+	runConcurrently(workers, func(worker int) {
+		for i := range rounds {
+			name, newName := fmt.Sprintf("d%d_%d", worker, i), fmt.Sprintf("e%d_%d", worker, i)
+			err := coll.NewDB(name, "x:int")
+			if err == nil {
+				var db *Database
+				db, err = coll.GetDB(name)
+				if err == nil {
+					err = db.Insert([]string{"x"}, []string{fmt.Sprint(i)})
+				}
+			}
+			if err == nil {
+				err = coll.RenameDB(name, newName)
+			}
+			if err == nil {
+				var res *ResultSet
+				res, err = coll.Select(newName, nil, SelectQuery{})
+				if err == nil && !slices.Equal(rowStrings(res), []string{fmt.Sprintf("1|%d", i)}) {
+					err = fmt.Errorf("got rows %q in renamed database", rowStrings(res))
+				}
+			}
+			if err == nil && i%2 == 0 {
+				err = coll.DropDB(newName)
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}, 2, func() {
+		res, err := coll.Select("people", nil, SelectQuery{})
+		if err == nil && !slices.Equal(rowStrings(res), []string{"1|alice"}) {
+			err = fmt.Errorf("got rows %q in people", rowStrings(res))
+		}
+		if err == nil {
+			var tx *Tx
+			tx, err = coll.Begin()
+			if err == nil {
+				_, err = tx.Select("people", nil, SelectQuery{})
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	names := make([]string, 0)
+	coll.mu.RLock()
+	for name := range coll.dbs {
+		names = append(names, name)
+	}
+	coll.mu.RUnlock()
+	slices.Sort(names)
+	want := []string{"people"}
+	for worker := range workers {
+		for i := 1; i < rounds; i += 2 {
+			want = append(want, fmt.Sprintf("e%d_%d", worker, i))
+		}
+	}
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("got databases %q, want %q", names, want)
+	}
+}
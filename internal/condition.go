@@ -1,17 +1,24 @@
 package internal
 
 import (
-	"github.com/golang_db/internal/utils"
+	"fmt"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 // TokenType Condition string token type enum
 //
 // OPERATOR - A condition operator (i.e. '=', '<', '>', '!=', '<=','>=', &, |)
-// COLUMN_OPERAND - A db column name (note that this condition module doesn't check for the validity of database columns)
-// LITERAL_OPERAND - A string literal
+// COLUMN_OPERAND - A db column name. Either a plain word, or any text in double quotemarks (e.g. "first name")
+// LITERAL_OPERAND - A string literal in single quotemarks (e.g. 'bob'). A quotemark inside is escaped by doubling it
 // BRACKET - An opening - '(' - or closing - ')' - bracket
 // WHITESPACE - A string of whitespace chars (spaces, tabs etc.) of any length
+// KEYWORD - A word with a special meaning in conditions (i.e. not, in, between, like, matches, is, empty, and, or). Case-insensitive
+// COMMA - A comma, seperating the items of a list
+// ARITHMETIC_OPERATOR - An arithmetic operator (i.e. '+', '-', '*', '/')
+// NUMERIC_OPERAND - A number written without quotemarks (e.g. 30 or 2.5)
 type TokenType int
 
 const (
@@ -21,6 +28,10 @@ const (
 	OPENING_BRACKET
 	CLOSING_BRACKET
 	WHITESPACE
+	KEYWORD
+	COMMA
+	ARITHMETIC_OPERATOR
+	NUMERIC_OPERAND
 )
 
 // Token A token from the user-inputted condition string
@@ -29,48 +40,63 @@ const (
 //
 //	content - The actual underlying string of the token
 //	kind - Type of token (operator, operand, bracket, whitespace) in form of the TokenType enum
+//	pos - Character offset of the start of the token in the condition string
 type Token struct {
 	content string
 	kind    TokenType
+	pos     int
 }
 
-// Uses RegEx to parse a user-inputted condition string into a stream of tokens
-// Returns nil if encountered an error in the condition string
-func conditionStringToTokenStream(conditionStr string) []Token {
+// A regex rule matching one kind of token
+// All regexes here are anchored to beginning of string - so, when regexp.FindStringIndex()
+// is called, they will always find a match that starts at the cursor position
+type tokenRule struct {
+	kind  TokenType
+	regex *regexp.Regexp
+}
 
-	// Define a regex rule (in form of a string) for each token type
-	// Note that all regexes here are anchored to beginning of string - so, when regexp.FindString()
-	// is called, they will always find a match that starts at the cursor position
-	regexRules := map[TokenType]string{
+// Regex rules for each token type, compiled once up front. Rules are tried in order, first match wins
+var tokenRules = []tokenRule{
+	{OPERATOR, regexp.MustCompile(`^((<|>)=?|!?=|&|\|)`)},
+	{ARITHMETIC_OPERATOR, regexp.MustCompile(`^[+\-*/]`)},
 
-		OPERATOR: `^((<|>)=?|!?=|&|\|)`,
+	{OPENING_BRACKET, regexp.MustCompile(`^\(`)},
+	{CLOSING_BRACKET, regexp.MustCompile(`^\)`)},
+	{COMMA, regexp.MustCompile(`^,`)},
+	{WHITESPACE, regexp.MustCompile(`^\s+`)}, // Captures strings with all whitespace chars (spaces, tabs etc.) of any length
 
-		OPENING_BRACKET: `^\(`,
-		CLOSING_BRACKET: `^\)`,
-		WHITESPACE:      `^\s+`, // Captures strings with all whitespace chars (spaces, tabs etc.) of any length
+	{LITERAL_OPERAND, regexp.MustCompile(`^'([^']|'')*'`)}, // Literal operands must be formatted like single-quotemark strings
+	{COLUMN_OPERAND, regexp.MustCompile(`^"([^"]|"")*"`)},  // Quoted column names can contain any characters
 
-		LITERAL_OPERAND: `^'.*?'`, // Literal operands must be formatted like single-quotemark strings
-		COLUMN_OPERAND:  `^\w+`,   // Column names can only have alphanumeric chars and underscores (i.e. only word characters)
-	}
+	// Numbers and keywords must be tried before unquoted column names, as they're made up of word characters too
+	{NUMERIC_OPERAND, regexp.MustCompile(`^\d+(\.\d+)?\b`)},
+	{KEYWORD, regexp.MustCompile(`(?i)^(not|in|between|like|matches|is|empty|and|or)\b`)},
+	// Unquoted column names can only have alphanumeric chars and underscores (i.e. only word characters),
+	// optionally qualified w/ a database name in queries over joined databases (e.g. users.name)
+	{COLUMN_OPERAND, regexp.MustCompile(`^\w+(\.\w+)?`)},
+}
+
+// Uses RegEx to parse a user-inputted condition string into a stream of tokens
+// Returns a ConditionError if part of the condition string isn't a valid token
+func conditionStringToTokenStream(conditionStr string) ([]Token, error) {
 
 	remainingMatchStr := conditionStr
-	tokenStream := make([]Token, 5)
+	tokenStream := make([]Token, 0, 5)
 	for len(remainingMatchStr) > 0 {
 
 		// Determine the kind of token (operator, operand, bracket, whitespace) present at the cursor position
 		// By running all regex rules against the string
 		foundMatchingTokenType := false
-		for tokenType, ruleStr := range regexRules {
+		for _, rule := range tokenRules {
 
-			rule, _ := regexp.Compile(ruleStr)                  // Compile rule string to regexp object
-			matchIdx := rule.FindStringIndex(remainingMatchStr) // Get position of match (if there is one)
+			matchIdx := rule.regex.FindStringIndex(remainingMatchStr) // Get position of match (if there is one)
 
 			if matchIdx != nil { // If we found a match for the rule
 
 				matchedStr := remainingMatchStr[matchIdx[0]:matchIdx[1]]
 
-				if tokenType != WHITESPACE { // Don't add whitespace tokens to stream - these are superfluous
-					tokenStream = append(tokenStream, Token{matchedStr, tokenType})
+				if rule.kind != WHITESPACE { // Don't add whitespace tokens to stream - these are superfluous
+					tokenStream = append(tokenStream, Token{matchedStr, rule.kind, len(conditionStr) - len(remainingMatchStr)})
 				}
 
 				remainingMatchStr = remainingMatchStr[matchIdx[1]:] // Trim off just examined part of remaining match string
@@ -82,90 +108,926 @@ func conditionStringToTokenStream(conditionStr string) []Token {
 
 		// If we didn't find a matching token type, must be something wrong with condition string
 		if !foundMatchingTokenType {
-			return nil
+			offset := len(conditionStr) - len(remainingMatchStr)
+			if remainingMatchStr[0] == '\'' {
+				return nil, &ConditionError{"UNTERMINATED LITERAL", remainingMatchStr, offset, ""}
+			}
+			if remainingMatchStr[0] == '"' {
+				return nil, &ConditionError{"UNTERMINATED COLUMN NAME", remainingMatchStr, offset, ""}
+			}
+			return nil, &ConditionError{"UNRECOGNISED CHARACTER", remainingMatchStr[:1], offset, ""}
 		}
 	}
 
-	return tokenStream
+	return tokenStream, nil
 }
 
-// ResolveCondition resolves a condition specified by a condition string on a database entry
+// Matches up the brackets in a token stream, checking every opening bracket has a matching closing bracket, and vice versa
 //
-// PARAMS:
+// RETURNS:
 //
-//	conditionStr - The user-inputted condition string
-//	entry - A hashmap with db column names as keys and the entry's row values for those columns as values
+//	for each token, the index of the closing bracket matching it if it's an opening bracket, otherwise -1
+//	a ConditionError naming the first unmatched bracket, otherwise nil
+func matchBrackets(tokens []Token) ([]int, error) {
+	closing := make([]int, len(tokens))
+	openBrackets := make([]int, 0, 5) // Indexes of opening brackets not yet closed, innermost last
+	for i, token := range tokens {
+		closing[i] = -1
+		switch token.kind {
+		case OPENING_BRACKET:
+			openBrackets = append(openBrackets, i)
+		case CLOSING_BRACKET:
+			if len(openBrackets) == 0 {
+				return nil, &ConditionError{"UNMATCHED CLOSING BRACKET", token.content, token.pos, ""}
+			}
+			closing[openBrackets[len(openBrackets)-1]] = i
+			openBrackets = openBrackets[:len(openBrackets)-1]
+		}
+	}
+
+	if len(openBrackets) > 0 {
+		unclosed := tokens[openBrackets[len(openBrackets)-1]]
+		return nil, &ConditionError{"UNCLOSED OPENING BRACKET", unclosed.content, unclosed.pos, ""}
+	}
+	return closing, nil
+}
+
+// Removes the quotemarks from around a quoted token, and unescapes any doubled quotemarks inside it
+// e.g. "say ""hi""" becomes say "hi". Doubled single quotemarks in literals are unescaped the same way
+func unquote(quoted string) string {
+	quote := quoted[:1]
+	return strings.ReplaceAll(quoted[1:len(quoted)-1], quote+quote, quote)
+}
+
+// An operand of a comparison, along with the type it should be compared as
 //
-// RETURNS:
-// - true if condition is true
-// - false if not
-func ResolveCondition(conditionStr string, entry map[string]string) bool {
+// ATTRIBUTES:
+//
+//	value - The operand's value (with any quotemarks around a literal removed)
+//	kind - The type of the column the operand came from. Quoted literals are TEXT, unquoted numbers are INT or FLOAT
+type operand struct {
+	value string
+	kind  ColumnType
+}
 
-	tokens := conditionStringToTokenStream(conditionStr) // Convert string to token stream first
+// Works out which type 2 operands should be compared as
+// Text operands (e.g. quoted literals) take on the other operand's type, so with an int column 'age',
+// age < '10' compares numerically (so '9' < '10') rather than alphabetically
+// When both operands have different non-text types (e.g. comparing an int column w/ a timestamp column),
+// they're compared numerically if both are numbers (int or float), otherwise as text
+func comparisonType(kind1 ColumnType, kind2 ColumnType) ColumnType {
+	switch {
+	case kind1 == kind2:
+		return kind1
+	case kind1 == TEXT:
+		return kind2
+	case kind2 == TEXT:
+		return kind1
+	case (kind1 == INT || kind1 == FLOAT) && (kind2 == INT || kind2 == FLOAT):
+		return FLOAT
+	default:
+		return TEXT
+	}
+}
 
-	// Symbol and operand stack hold strings representing the actual content of tokens
-	// operand stack contains operand strings
-	// symbol stack contains operator strings and bracket strings
-	symbolStack := utils.MakeStack[string]()
-	operandStack := utils.MakeStack[string]()
-	boolStack := utils.MakeStack[bool]()
+// Compares 2 operands with a comparison operator, as the type given by comparisonType()
+// Empty values (e.g. empty cells) are only equal to other empty values, and are never less or greater than anything,
+// so e.g. age < '30' doesn't match entries with no age
+func compareOperands(operator string, o1 operand, o2 operand) bool {
+	if o1.value == "" || o2.value == "" {
+		switch operator {
+		case "=":
+			return o1.value == o2.value
+		case "!=":
+			return o1.value != o2.value
+		default:
+			return false
+		}
+	}
+	cmp := compareValues(o1.value, o2.value, comparisonType(o1.kind, o2.kind))
 
-	for _, token := range tokens {
-		switch token.kind {
+	switch operator {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
 
-		case OPERATOR: // Push operators and opening brackets onto symbol stack
-			symbolStack.Push(token.content)
-		case OPENING_BRACKET:
-			symbolStack.Push(token.content)
-
-		case COLUMN_OPERAND: // Put entry's value at that column on operand stack
-			operandStack.Push(entry[token.content])
-
-		case LITERAL_OPERAND: // Put literals on operand stack
-			operandStack.Push(token.content)
-
-		case CLOSING_BRACKET: // If closing bracket, apply operation at top of stack
-
-			operator := symbolStack.Pop() // Pop last-read operator
-			_ = symbolStack.Pop()         // Symbol before an actual operator token (that was just popped) should always be an opening bracket token, so pop that opening bracket as well
-			var res bool
-
-			// If operator is AND/OR, pop top 2 elems from bool stack, apply operation, then push the result back to bool stack
-			// If operator isn't AND/OR, do the same but pop the top 2 elems from operand stack instead of bool stack
-			if operator == "&" {
-				o1 := boolStack.Pop()
-				o2 := boolStack.Pop()
-				res = o1 && o2
-			} else if operator == "|" {
-				o1 := boolStack.Pop()
-				o2 := boolStack.Pop()
-				res = o1 || o2
-			} else {
-
-				o1 := operandStack.Pop()
-				o2 := operandStack.Pop()
-
-				switch operator {
-				case "=":
-					res = o1 == o2
-				case "!=":
-					res = o1 != o2
-				case "<":
-					res = o1 < o2
-				case "<=":
-					res = o1 <= o2
-				case ">":
-					res = o1 > o2
-				case ">=":
-					res = o1 >= o2
-				}
-			}
-			boolStack.Push(res)
+// ConditionError Error type for all condition-related errors
+// This type is exported, so that callers can point the user to where in the condition string the error is
+//
+// FIELDS:
+//
+//	message - Description of the error
+//	Token - The offending token (empty if the error is at the end of the condition string)
+//	Offset - Character offset of the offending token in the condition string
+//	Condition - The condition string the error is in
+type ConditionError struct {
+	message   string
+	Token     string
+	Offset    int
+	Condition string
+}
+
+func (e *ConditionError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("CONDITION ERROR: %s AT END OF CONDITION (CHARACTER %d)", e.message, e.Offset)
+	}
+	return fmt.Sprintf("CONDITION ERROR: %s AT '%s' (CHARACTER %d)", e.message, e.Token, e.Offset)
+}
+
+// A node in the tree that a condition string is compiled into
+// Evaluates to true or false for a database entry
+//
+// PARAMS (of eval): row - The entry's values, in the order of the columns the condition was compiled against
+type conditionNode interface {
+	eval(row []string) bool
+}
+
+// A node that produces an operand for a comparison
+type valueNode interface {
+	value(row []string) operand
+}
+
+// An AND ('&') or OR ('|') of 2 sub-conditions
+type logicalNode struct {
+	operator    string
+	left, right conditionNode
+}
+
+func (n *logicalNode) eval(row []string) bool {
+	if n.operator == "&" {
+		return n.left.eval(row) && n.right.eval(row)
+	}
+	return n.left.eval(row) || n.right.eval(row)
+}
+
+// A negated sub-condition (e.g. not age > '30')
+type notNode struct {
+	child conditionNode
+}
+
+func (n *notNode) eval(row []string) bool {
+	return !n.child.eval(row)
+}
+
+// A comparison of 2 operands (e.g. age > '30')
+type comparisonNode struct {
+	operator    string
+	left, right valueNode
+}
+
+func (n *comparisonNode) eval(row []string) bool {
+	return compareOperands(n.operator, n.left.value(row), n.right.value(row))
+}
+
+// A check that an operand is equal to any operand in a list (e.g. status in ('a', 'b'))
+type inNode struct {
+	operand valueNode
+	list    []valueNode
+}
+
+func (n *inNode) eval(row []string) bool {
+	o := n.operand.value(row)
+	for _, item := range n.list {
+		if compareOperands("=", o, item.value(row)) {
+			return true
+		}
+	}
+	return false
+}
+
+// A check that an operand lies in a range, inclusive of both ends (e.g. age between '18' and '30')
+type betweenNode struct {
+	operand      valueNode
+	lower, upper valueNode
+}
+
+func (n *betweenNode) eval(row []string) bool {
+	o := n.operand.value(row)
+	return compareOperands(">=", o, n.lower.value(row)) && compareOperands("<=", o, n.upper.value(row))
+}
+
+// A check that an operand matches a pattern - either a SQL-style LIKE pattern, or a regular expression
+// If the pattern is a literal, it's compiled once along w/ the rest of the condition
+type patternNode struct {
+	operand  valueNode
+	pattern  valueNode
+	isLike   bool
+	compiled *regexp.Regexp // nil if the pattern has to be compiled for each row
+}
+
+func (n *patternNode) eval(row []string) bool {
+	regex := n.compiled
+	if regex == nil {
+		var err error
+		regex, err = compilePattern(n.pattern.value(row).value, n.isLike)
+		if err != nil {
+			return false // A row's value that isn't a valid pattern matches nothing
+		}
+	}
+	return regex.MatchString(n.operand.value(row).value)
+}
+
+// Compiles a LIKE pattern or regular expression to a regexp
+// In LIKE patterns '%' matches any sequence of characters, '_' matches any one character,
+// and the whole value must match the pattern. Regular expressions match anywhere in the value, unless anchored
+func compilePattern(pattern string, isLike bool) (*regexp.Regexp, error) {
+	if !isLike {
+		return regexp.Compile(pattern)
+	}
+
+	var regexStr strings.Builder
+	regexStr.WriteString(`(?s)^`)
+	for _, char := range pattern {
+		switch char {
+		case '%':
+			regexStr.WriteString(`.*`)
+		case '_':
+			regexStr.WriteString(`.`)
+		default:
+			regexStr.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	regexStr.WriteString(`$`)
+	return regexp.Compile(regexStr.String())
+}
+
+// A check that an operand is an empty cell (e.g. email is empty)
+type emptyNode struct {
+	operand valueNode
+}
+
+func (n *emptyNode) eval(row []string) bool {
+	return n.operand.value(row).value == ""
+}
+
+// An arithmetic operation on 2 operands (e.g. price * qty)
+// If either operand isn't a number (e.g. an empty cell), or on division by zero, the result is empty
+// The result is an int if both operands are ints (apart from for division), otherwise a float
+type arithmeticNode struct {
+	operator    string
+	left, right valueNode
+}
+
+func (n *arithmeticNode) value(row []string) operand {
+	left, right := n.left.value(row), n.right.value(row)
+	f1, err1 := strconv.ParseFloat(left.value, 64)
+	f2, err2 := strconv.ParseFloat(right.value, 64)
+	if err1 != nil || err2 != nil {
+		return operand{"", FLOAT}
+	}
+
+	var res float64
+	switch n.operator {
+	case "+":
+		res = f1 + f2
+	case "-":
+		res = f1 - f2
+	case "*":
+		res = f1 * f2
+	case "/":
+		if f2 == 0 {
+			return operand{"", FLOAT}
+		}
+		res = f1 / f2
+	}
+	return numberOperand(res, isInt(left.value) && isInt(right.value) && n.operator != "/")
+}
+
+// A call to a function (see conditionFunctions), e.g. lower(name)
+type functionNode struct {
+	function conditionFunction
+	args     []valueNode
+}
+
+func (n *functionNode) value(row []string) operand {
+	args := make([]operand, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.value(row)
+	}
+	return n.function.call(args)
+}
+
+// A column operand, which takes the entry's value for that column
+// The column's position in the row is worked out when the condition is compiled, so no lookup by name is needed per row
+type columnNode struct {
+	index int
+	kind  ColumnType
+}
+
+func (n *columnNode) value(row []string) operand {
+	return operand{row[n.index], n.kind}
+}
+
+// A literal operand, with it's surrounding quotemarks already removed
+type literalNode struct {
+	literal string
+	kind    ColumnType
+}
+
+func (n *literalNode) value(row []string) operand {
+	return operand{n.literal, n.kind}
+}
+
+// Recursive descent parser that turns a token stream into a tree of condition nodes
+// Operators bind in order of precedence, tightest first: comparisons, then NOT, then AND ('&'), then OR ('|')
+// Brackets can be used to group any part of a condition, but aren't required
+//
+// Grammar (keywords are case-insensitive):
+//
+//	condition := andChain ( ( '|' | OR ) andChain )*
+//	andChain  := notTerm ( ( '&' | AND ) notTerm )*
+//	notTerm   := NOT notTerm | term
+//	term      := '(' condition ')' | test
+//	test      := operand ( '=' | '!=' | '<' | '<=' | '>' | '>=' ) operand
+//	           | operand [NOT] IN '(' operand ( ',' operand )* ')'
+//	           | operand [NOT] BETWEEN operand ( '&' | AND ) operand
+//	           | operand [NOT] ( LIKE | MATCHES ) operand
+//	           | operand IS [NOT] EMPTY
+//	operand   := product ( ( '+' | '-' ) product )*
+//	product   := unary ( ( '*' | '/' ) unary )*
+//	unary     := '-' unary | primary
+//	primary   := COLUMN_OPERAND | LITERAL_OPERAND | NUMERIC_OPERAND | '(' operand ')'
+//	           | COLUMN_OPERAND '(' [ operand ( ',' operand )* ] ')'    (a function call, name can't be quoted)
+//
+// A bracket at the start of a term could open either a grouped condition or an operand (e.g. (price + tax) > '10'),
+// so the parser looks at the token after the matching closing bracket to decide which (see conditionParser.opensOperand)
+//
+// ATTRIBUTES:
+//
+//	tokens - The token stream being parsed
+//	closing - For each token, the index of the matching closing bracket if it's an opening bracket, otherwise -1
+//	pos - Index of the next token to be parsed
+//	source - The condition string the tokens came from
+//	columns - Names of the columns that rows will have, in order. Column operands must be one of these
+//	types - A hashmap with db column names as keys and the column types as values
+type conditionParser struct {
+	tokens  []Token
+	closing []int
+	pos     int
+	source  string
+	columns []string
+	types   map[string]ColumnType
+}
+
+// Gets the next token without consuming it
+// Returns nil if all tokens have been consumed
+func (p *conditionParser) peek() *Token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+// Makes a ConditionError pointing at the next token (or the end of the condition if all tokens have been consumed)
+func (p *conditionParser) errorAtNext(message string) *ConditionError {
+	next := p.peek()
+	if next == nil {
+		return &ConditionError{message, "", len(p.source), ""}
+	}
+	return &ConditionError{message, next.content, next.pos, ""}
+}
+
+// Checks if the next token is a particular operator, consuming it if so
+func (p *conditionParser) acceptOperator(operator string) bool {
+	next := p.peek()
+	if next != nil && next.kind == OPERATOR && next.content == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Checks if the next token is a particular arithmetic operator, consuming it if so
+func (p *conditionParser) acceptArithmetic(operator string) bool {
+	next := p.peek()
+	if next != nil && next.kind == ARITHMETIC_OPERATOR && next.content == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Checks if the next token is a particular keyword (case-insensitive), consuming it if so
+func (p *conditionParser) acceptKeyword(keyword string) bool {
+	next := p.peek()
+	if next != nil && next.kind == KEYWORD && strings.EqualFold(next.content, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Checks if the next token is a particular kind of token, consuming it if so
+func (p *conditionParser) acceptKind(kind TokenType) bool {
+	next := p.peek()
+	if next != nil && next.kind == kind {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Parses a whole condition, making sure there are no tokens left over afterwards
+func (p *conditionParser) parse() (conditionNode, error) {
+	node, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != nil {
+		return nil, p.errorAtNext("UNEXPECTED TOKEN")
+	}
+	return node, nil
+}
+
+func (p *conditionParser) parseCondition() (conditionNode, error) {
+	left, err := p.parseAndChain()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOperator("|") || p.acceptKeyword("or") {
+		right, err := p.parseAndChain()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{"|", left, right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAndChain() (conditionNode, error) {
+	left, err := p.parseNotTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOperator("&") || p.acceptKeyword("and") {
+		right, err := p.parseNotTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{"&", left, right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseNotTerm() (conditionNode, error) {
+	if p.acceptKeyword("not") {
+		child, err := p.parseNotTerm()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child}, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *conditionParser) parseTerm() (conditionNode, error) {
+	next := p.peek()
+	if next == nil || next.kind != OPENING_BRACKET || p.opensOperand() {
+		return p.parseTest()
+	}
+
+	p.pos++
+	node, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	if !p.acceptKind(CLOSING_BRACKET) {
+		return nil, p.errorAtNext("EXPECTED ')'")
+	}
+	return node, nil
+}
+
+// Checks if the opening bracket at the parser's position starts an operand rather than a grouped condition,
+// i.e. the token after the matching closing bracket carries on a test (e.g. '=' in (price + tax) = '10')
+func (p *conditionParser) opensOperand() bool {
+	after := p.closing[p.pos] + 1
+	if after >= len(p.tokens) {
+		return false
+	}
+	token := p.tokens[after]
+	switch token.kind {
+	case ARITHMETIC_OPERATOR:
+		return true
+	case OPERATOR:
+		return token.content != "&" && token.content != "|"
+	case KEYWORD:
+		return !strings.EqualFold(token.content, "and") && !strings.EqualFold(token.content, "or")
+	default:
+		return false
+	}
+}
+
+func (p *conditionParser) parseTest() (conditionNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	// IS [NOT] EMPTY
+	if p.acceptKeyword("is") {
+		negated := p.acceptKeyword("not")
+		if !p.acceptKeyword("empty") {
+			return nil, p.errorAtNext("EXPECTED 'empty'")
+		}
+		return negateIf(negated, &emptyNode{left}), nil
+	}
+
+	// Tests that can be negated by a NOT before their keyword
+	negated := p.acceptKeyword("not")
+	switch {
+	case p.acceptKeyword("in"):
+		node, err := p.parseInList(left)
+		if err != nil {
+			return nil, err
+		}
+		return negateIf(negated, node), nil
+
+	case p.acceptKeyword("between"):
+		lower, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptOperator("&") && !p.acceptKeyword("and") {
+			return nil, p.errorAtNext("EXPECTED 'and'")
+		}
+		upper, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return negateIf(negated, &betweenNode{left, lower, upper}), nil
 
+	case p.acceptKeyword("like"):
+		node, err := p.parsePattern(left, true)
+		if err != nil {
+			return nil, err
+		}
+		return negateIf(negated, node), nil
+
+	case p.acceptKeyword("matches"):
+		node, err := p.parsePattern(left, false)
+		if err != nil {
+			return nil, err
+		}
+		return negateIf(negated, node), nil
+
+	case negated:
+		return nil, p.errorAtNext("EXPECTED 'in', 'between', 'like' OR 'matches'")
+	}
+
+	// Otherwise must be a plain comparison
+	next := p.peek()
+	if next == nil || next.kind != OPERATOR || next.content == "&" || next.content == "|" {
+		return nil, p.errorAtNext("EXPECTED COMPARISON OPERATOR")
+	}
+	operator := next.content
+	p.pos++
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &comparisonNode{operator, left, right}, nil
+}
+
+// Parses the bracketed list of operands after an IN keyword
+func (p *conditionParser) parseInList(operand valueNode) (conditionNode, error) {
+	if !p.acceptKind(OPENING_BRACKET) {
+		return nil, p.errorAtNext("EXPECTED '('")
+	}
+
+	list := make([]valueNode, 0, 5)
+	for {
+		item, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+
+		if p.acceptKind(CLOSING_BRACKET) {
+			return &inNode{operand, list}, nil
+		}
+		if !p.acceptKind(COMMA) {
+			return nil, p.errorAtNext("EXPECTED ',' OR ')'")
+		}
+	}
+}
+
+// Parses the pattern after a LIKE or MATCHES keyword
+// Literal patterns are compiled now, so a malformed regular expression is reported as an error in the condition
+func (p *conditionParser) parsePattern(operand valueNode, isLike bool) (conditionNode, error) {
+	patternToken := p.peek()
+	pattern, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &patternNode{operand: operand, pattern: pattern, isLike: isLike}
+	if literal, isLiteral := pattern.(*literalNode); isLiteral {
+		node.compiled, err = compilePattern(literal.literal, isLike)
+		if err != nil {
+			return nil, &ConditionError{"INVALID PATTERN", patternToken.content, patternToken.pos, ""}
+		}
+	}
+	return node, nil
+}
+
+// Wraps a node in a NOT if negated is true
+func negateIf(negated bool, node conditionNode) conditionNode {
+	if negated {
+		return &notNode{node}
+	}
+	return node
+}
+
+func (p *conditionParser) parseOperand() (valueNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var operator string
+		switch {
+		case p.acceptArithmetic("+"):
+			operator = "+"
+		case p.acceptArithmetic("-"):
+			operator = "-"
 		default:
+			return left, nil
+		}
+
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithmeticNode{operator, left, right}
+	}
+}
+
+func (p *conditionParser) parseProduct() (valueNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var operator string
+		switch {
+		case p.acceptArithmetic("*"):
+			operator = "*"
+		case p.acceptArithmetic("/"):
+			operator = "/"
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithmeticNode{operator, left, right}
+	}
+}
+
+func (p *conditionParser) parseUnary() (valueNode, error) {
+	if p.acceptArithmetic("-") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &arithmeticNode{"-", &literalNode{"0", INT}, operand}, nil // Negate by subtracting from 0
+	}
+	return p.parsePrimary()
+}
+
+func (p *conditionParser) parsePrimary() (valueNode, error) {
+	next := p.peek()
+	if next == nil {
+		return nil, p.errorAtNext("EXPECTED OPERAND")
+	}
+
+	switch next.kind {
+	case OPENING_BRACKET:
+		p.pos++
+		node, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptKind(CLOSING_BRACKET) {
+			return nil, p.errorAtNext("EXPECTED ')'")
+		}
+		return node, nil
+
+	case COLUMN_OPERAND:
+		// An unquoted name followed by an opening bracket is a function call, rather than a column,
+		// unless the call as written is itself the name of a column (e.g. count(*) in the results of an aggregate query)
+		quoted := next.content[0] == '"'
+		if !quoted && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == OPENING_BRACKET {
+			index, numTokens := p.matchCallColumn()
+			if index != -1 {
+				p.pos += numTokens
+				return &columnNode{index, p.types[p.columns[index]]}, nil
+			}
+			return p.parseFunctionCall()
+		}
+
+		column := next.content
+		if quoted {
+			column = unquote(column)
+		}
+		index := slices.Index(p.columns, column)
+		if index == -1 {
+			return nil, p.errorAtNext("UNKNOWN COLUMN")
+		}
+		p.pos++
+		return &columnNode{index, p.types[column]}, nil
+
+	case LITERAL_OPERAND:
+		p.pos++
+		return &literalNode{unquote(next.content), TEXT}, nil
+
+	case NUMERIC_OPERAND:
+		p.pos++
+		if strings.Contains(next.content, ".") {
+			return &literalNode{next.content, FLOAT}, nil
+		}
+		return &literalNode{next.content, INT}, nil
+
+	default:
+		return nil, p.errorAtNext("EXPECTED OPERAND")
+	}
+}
+
+// Checks if the function call at the parser's position, as written, is the name of a column
+// Whitespace and case are ignored, so 'COUNT( * )' matches a column named 'count(*)'
+//
+// RETURNS: the index of the column (-1 if there isn't one), and the number of tokens the call spans
+func (p *conditionParser) matchCallColumn() (int, int) {
+	depth := 0
+	for i := p.pos + 1; i < len(p.tokens); i++ {
+		switch p.tokens[i].kind {
+		case OPENING_BRACKET:
+			depth++
+		case CLOSING_BRACKET:
+			depth--
+		}
+		if depth > 0 {
 			continue
 		}
+
+		call := normaliseCall(p.source[p.tokens[p.pos].pos : p.tokens[i].pos+1])
+		index := slices.IndexFunc(p.columns, func(col string) bool {
+			return normaliseCall(col) == call
+		})
+		return index, i - p.pos + 1
+	}
+	return -1, 0
+}
+
+// Lowercases a function call and removes all whitespace from it, for comparing calls
+func normaliseCall(call string) string {
+	return strings.ToLower(strings.Join(strings.Fields(call), ""))
+}
+
+// Parses a function call, checking that the function exists and is given an acceptable number of arguments
+func (p *conditionParser) parseFunctionCall() (valueNode, error) {
+	nameToken := p.tokens[p.pos]
+	function, exists := conditionFunctions[strings.ToLower(nameToken.content)]
+	if !exists {
+		return nil, p.errorAtNext("UNKNOWN FUNCTION")
+	}
+	p.pos += 2 // Consume name and opening bracket
+
+	args := make([]valueNode, 0, 3)
+	if !p.acceptKind(CLOSING_BRACKET) {
+		for {
+			arg, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if p.acceptKind(CLOSING_BRACKET) {
+				break
+			}
+			if !p.acceptKind(COMMA) {
+				return nil, p.errorAtNext("EXPECTED ',' OR ')'")
+			}
+		}
+	}
+
+	if len(args) < function.minArgs || len(args) > function.maxArgs {
+		return nil, &ConditionError{fmt.Sprintf("WRONG NUMBER OF ARGUMENTS (%d) FOR FUNCTION", len(args)), nameToken.content, nameToken.pos, ""}
+	}
+	return &functionNode{function, args}, nil
+}
+
+// Predicate A condition that has been compiled from a condition string, ready to be evaluated against many rows
+// Compiling a condition once, rather than re-parsing the condition string for every row, is what makes table scans fast
+//
+// ATTRIBUTES:
+//
+//	root - Root node of the condition's tree. nil for the empty condition, which matches every row
+type Predicate struct {
+	root conditionNode
+}
+
+// CompileCondition Compiles a condition string into a Predicate, for rows that have a given set of columns
+// Conditions are made up of tests, joined by AND ('&') and OR ('|'), e.g. age > '30' & name = 'bob' | admin = 'true'
+// As well as comparisons, tests can be: status in ('a', 'b'), age between '18' and '30', name like 'b%',
+// name matches '^b.*b$', email is empty. Any test can be negated w/ NOT
+// Operands can be arithmetic (price * qty > '100') and function calls (lower(name) = 'bob', year(born) < '2000'),
+// see conditionFunctions for the functions available
+// Literals are either text in single quotemarks (w/ any quotemarks inside doubled up) or bare numbers (30, 2.5). Column names w/ special characters
+// go in double quotemarks ("first name"). See compareOperands() for how operands of different types are compared
+// Tests bind tightest, then NOT, then AND, then OR. Brackets can be used for grouping (see conditionParser for the full grammar)
+//
+// PARAMS:
+//
+//	conditionStr - The user-inputted condition string. An empty condition string matches every row
+//	columns - Names of the columns rows will have, in order (e.g. Database.Columns). Every column in the condition must be one of these
+//	types - A hashmap with column names as keys and the column types as values. Columns not in it are treated as text
+//
+// RETURNS:
+//
+//	The compiled predicate
+//	A ConditionError if the condition string is malformed or refers to an unknown column, otherwise nil
+func CompileCondition(conditionStr string, columns []string, types map[string]ColumnType) (*Predicate, error) {
+	tokens, err := conditionStringToTokenStream(conditionStr)
+	if err != nil {
+		return nil, withCondition(err, conditionStr)
+	}
+	if len(tokens) == 0 {
+		return &Predicate{}, nil
+	}
+
+	closing, err := matchBrackets(tokens)
+	if err != nil {
+		return nil, withCondition(err, conditionStr)
 	}
 
-	return boolStack.Pop() // Final result is only element left on boolstack
+	parser := &conditionParser{tokens: tokens, closing: closing, source: conditionStr, columns: columns, types: types}
+	root, err := parser.parse()
+	if err != nil {
+		return nil, withCondition(err, conditionStr)
+	}
+	return &Predicate{root}, nil
+}
+
+// Records the condition string a ConditionError is in, so the error can be shown in context
+func withCondition(err error, conditionStr string) error {
+	if condErr, ok := err.(*ConditionError); ok {
+		condErr.Condition = conditionStr
+	}
+	return err
+}
+
+// Eval Evaluates the predicate against a row
+//
+// PARAMS: row - The row's values, in the order of the columns the predicate was compiled for
+//
+// RETURNS: true if the row matches the condition, false if not
+func (p *Predicate) Eval(row []string) bool {
+	if p.root == nil {
+		return true
+	}
+	return p.root.eval(row)
+}
+
+// ResolveCondition resolves a condition specified by a condition string on a single database entry
+// To evaluate the same condition on many entries, compile it once w/ CompileCondition() instead
+//
+// PARAMS:
+//
+//	conditionStr - The user-inputted condition string
+//	entry - A hashmap with db column names as keys and the entry's row values for those columns as values
+//	types - A hashmap with db column names as keys and the column types as values. Every column in the condition must be in it
+//
+// RETURNS:
+//
+//	true if condition is true, false if not
+//	A ConditionError if the condition string is malformed or refers to an unknown column, otherwise nil
+func ResolveCondition(conditionStr string, entry map[string]string, types map[string]ColumnType) (bool, error) {
+	columns := make([]string, 0, len(types))
+	row := make([]string, 0, len(types))
+	for col := range types {
+		columns = append(columns, col)
+		row = append(row, entry[col])
+	}
+
+	predicate, err := CompileCondition(conditionStr, columns, types)
+	if err != nil {
+		return false, err
+	}
+	return predicate.Eval(row), nil
 }
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A function that can be called inside a condition, e.g. lower(name) = 'bob'
+// Functions are given operands and return an operand, so calls can be nested and compared like any other operand
+// An argument that isn't valid for the function (e.g. a non-numeric value passed to abs) gives an empty result
+//
+// ATTRIBUTES:
+//
+//	minArgs, maxArgs - Range of the number of arguments the function accepts
+//	call - Applies the function to it's arguments
+type conditionFunction struct {
+	minArgs, maxArgs int
+	call             func(args []operand) operand
+}
+
+// All functions available in conditions, keyed by name. Names are case-insensitive, so keys are lowercase
+var conditionFunctions = map[string]conditionFunction{
+
+	// String functions
+	"lower": {1, 1, func(args []operand) operand {
+		return operand{strings.ToLower(args[0].value), TEXT}
+	}},
+	"upper": {1, 1, func(args []operand) operand {
+		return operand{strings.ToUpper(args[0].value), TEXT}
+	}},
+	"trim": {1, 1, func(args []operand) operand {
+		return operand{strings.TrimSpace(args[0].value), TEXT}
+	}},
+	"length": {1, 1, func(args []operand) operand {
+		return operand{strconv.Itoa(utf8.RuneCountInString(args[0].value)), INT}
+	}},
+	"substr": {2, 3, substr},
+	"concat": {1, math.MaxInt, func(args []operand) operand {
+		var res strings.Builder
+		for _, arg := range args {
+			res.WriteString(arg.value)
+		}
+		return operand{res.String(), TEXT}
+	}},
+
+	// Numeric functions
+	"abs": {1, 1, func(args []operand) operand {
+		return numericFunction(args[0], math.Abs)
+	}},
+	"round": {1, 1, func(args []operand) operand {
+		return numericFunction(args[0], math.Round)
+	}},
+
+	// Date functions
+	"now": {0, 0, func(args []operand) operand {
+		return operand{time.Now().UTC().Format(time.RFC3339Nano), TIMESTAMP}
+	}},
+	"date": {1, 1, func(args []operand) operand {
+		return timestampFunction(args[0], func(t time.Time) operand {
+			midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+			return operand{midnight.Format(time.RFC3339Nano), TIMESTAMP}
+		})
+	}},
+	"year": {1, 1, func(args []operand) operand {
+		return timestampFunction(args[0], func(t time.Time) operand {
+			return operand{strconv.Itoa(t.Year()), INT}
+		})
+	}},
+	"month": {1, 1, func(args []operand) operand {
+		return timestampFunction(args[0], func(t time.Time) operand {
+			return operand{strconv.Itoa(int(t.Month())), INT}
+		})
+	}},
+	"day": {1, 1, func(args []operand) operand {
+		return timestampFunction(args[0], func(t time.Time) operand {
+			return operand{strconv.Itoa(t.Day()), INT}
+		})
+	}},
+}
+
+// substr(str, start) or substr(str, start, length)
+// Positions count characters from 1, as in SQL. Out of range positions are clamped to the string
+func substr(args []operand) operand {
+	chars := []rune(args[0].value)
+	start, err := strconv.Atoi(args[1].value)
+	if err != nil {
+		return operand{"", TEXT}
+	}
+	start = max(start-1, 0)
+	start = min(start, len(chars))
+
+	end := len(chars)
+	if len(args) == 3 {
+		length, err := strconv.Atoi(args[2].value)
+		if err != nil || length < 0 {
+			return operand{"", TEXT}
+		}
+		end = min(start+length, len(chars))
+	}
+	return operand{string(chars[start:end]), TEXT}
+}
+
+// Applies a function on numbers to an operand
+// The result is an int if the operand was an int and the function kept it whole
+func numericFunction(arg operand, fn func(float64) float64) operand {
+	f, err := strconv.ParseFloat(arg.value, 64)
+	if err != nil {
+		return operand{"", FLOAT}
+	}
+	return numberOperand(fn(f), isInt(arg.value))
+}
+
+// Applies a function on timestamps to an operand
+func timestampFunction(arg operand, fn func(time.Time) operand) operand {
+	t, err := parseTimestamp(arg.value)
+	if err != nil {
+		return operand{"", TEXT}
+	}
+	return fn(t)
+}
+
+// Checks if a value is a whole number
+func isInt(value string) bool {
+	_, err := strconv.ParseInt(value, 10, 64)
+	return err == nil
+}
+
+// Makes an operand holding a number
+//
+// PARAMS:
+//
+//	f - the number
+//	wantInt - whether the result should be an int. Only honoured if f is a whole number
+func numberOperand(f float64, wantInt bool) operand {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return operand{"", FLOAT}
+	}
+	if wantInt && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return operand{strconv.FormatInt(int64(f), 10), INT}
+	}
+	return operand{strconv.FormatFloat(f, 'g', -1, 64), FLOAT}
+}
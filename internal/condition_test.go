@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+var testColumns = []string{"name", "price", "tax"}
+var testTypes = map[string]ColumnType{"name": TEXT, "price": INT, "tax": INT}
+
+func TestCompileCondition(t *testing.T) {
+	row := []string{"bob", "10", "2"}
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{"", true},
+		{"price = 10", true},
+		{"(price = 10)", true},
+		{"(price = 10) and name = 'bob'", true},
+		{"(price = 11) or (name = 'bob' & tax = 2)", true},
+		{"(price + tax) = 12", true},
+		{"(price + tax) * 2 = 24", true},
+		{"((price + tax)) = 12", true},
+		{"((price + tax) > 11)", true},
+		{"not (price = 10)", false},
+		{"(price) between 5 and 10", true},
+		{"(name) in ('alice', 'bob')", true},
+		{"(name) is not empty", true},
+		{strings.Repeat("(", 30) + "price = 10" + strings.Repeat(")", 30), true},
+		{strings.Repeat("(", 30) + "price" + strings.Repeat(")", 30) + " = 10", true},
+		{strings.Repeat("(", 30) + "price = 11" + strings.Repeat(") or (price = 10)", 30), true},
+		{strings.Repeat("(", 15) + strings.Repeat("(", 15) + "price + 1" + strings.Repeat(")", 15) + " = 11" + strings.Repeat(")", 15), true},
+	}
+
+	for _, test := range tests {
+		predicate, err := CompileCondition(test.condition, testColumns, testTypes)
+		if err != nil {
+			t.Errorf("CompileCondition(%q) failed: %v", test.condition, err)
+			continue
+		}
+		if got := predicate.Eval(row); got != test.want {
+			t.Errorf("CompileCondition(%q) evaluated to %v, want %v", test.condition, got, test.want)
+		}
+	}
+}
+
+func TestCompileConditionErrors(t *testing.T) {
+	tests := []struct {
+		condition string
+		offset    int
+	}{
+		{"(price = 10", 0},
+		{"price = 10)", 10},
+		{"(price = ) and name = 'bob'", 9},
+		{"(price = 10 name = 'bob')", 12},
+		{"(price + tax) and name = 'bob'", 12},
+		{"(price = 10) = 10", 7},
+		{"price = 'unterminated", 8},
+		{strings.Repeat("(", 30) + "price = " + strings.Repeat(")", 30), 38},
+	}
+
+	for _, test := range tests {
+		_, err := CompileCondition(test.condition, testColumns, testTypes)
+		condErr, ok := err.(*ConditionError)
+		if !ok {
+			t.Errorf("CompileCondition(%q) returned %v, want a ConditionError", test.condition, err)
+			continue
+		}
+		if condErr.Offset != test.offset {
+			t.Errorf("CompileCondition(%q) failed at character %d, want %d: %v", test.condition, condErr.Offset, test.offset, err)
+		}
+	}
+}
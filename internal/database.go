@@ -3,21 +3,71 @@ package internal
 import (
 	"fmt"
 	"github.com/golang_db/internal/utils"
-	"log"
-	"math/rand/v2"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // Database Struct for a database
+// A database is safe for concurrent use: any number of selects can run at once, while changes run one at a time.
+// Each entry is stored as a series of versions (see entryVersion), so a select only holds the database up while it makes a view of it,
+// then reads the view while changes carry on. Columns and Types are changed by column changes, so they shouldn't be read directly
+// while another goroutine may be changing the database's columns (see Database.Schema)
+//
 // FIELDS:
 //
 //		FilePath - Absolute (i.e. from root) path to the CSV file (with '.csv' suffix included) in which data is saved
 //	 Columns - In-order list of the names of the databases columns
-//	 Indexes - Array of indexes in the DB
+//	 Types - map with column names as keys and the type of each column as values
+//	 indexes - Array of indexes in the DB (see index). Indexes have every version of every entry in the DB file, including versions
+//		the DB can't see, until the garbage collector removes them (see buildIndexes)
+//	 sequence - Last id given to an entry, mirrored in the DB's metadata file (see dbMetadata)
+//	 wal - Write-ahead log of the DB's collection, which changes are recorded in before they're made (see writeAheadLog)
+//	 lsn - LSN of the last change made to the DB's files, mirrored in the DB's metadata file
+//	 mu - Held for reading by selects, and for writing by changes
+//	 seqMu - Held while sequence is read or changed, as a transaction's copy of the DB takes ids from the DB w/o holding mu
+//	 readOnly - Whether the DB was loaded read-only, in which case it can't be changed (see LoadCollectionReadOnly)
+//	 tx - For a transaction's copy of a DB, the transaction, which decides which versions of entries are seen (see Database.visible)
+//	 original - For a transaction's copy of a DB, the collection's DB that was copied
+//	 pendingChanges - For a transaction's copy of a DB, number of changes made to it, which number their pending timestamps (see pendingTimestamp)
+//	 view - For a view of the DB made by a select, the DB file as it was when the view was made (see Database.makeView)
+//	 oldestExpiry - Earliest timestamp a version of an entry in the DB file was expired at, for the garbage collector.
+//		0 if it isn't known, or the largest possible timestamp if no version has expired
 type Database struct {
-	FilePath string
-	Columns  []string
-	// indexes []index;
+	FilePath       string
+	Columns        []string
+	Types          map[string]ColumnType
+	indexes        []*index
+	sequence       int
+	wal            *writeAheadLog
+	lsn            uint64
+	mu             sync.RWMutex
+	seqMu          sync.Mutex
+	readOnly       bool
+	tx             *Tx
+	original       *Database
+	pendingChanges int
+	view           *fileView
+	oldestExpiry   uint64
+}
+
+// A database file kept open by a view of the database (see Database.makeView)
+// The file stays readable even once it's been replaced by a rewrite, and versions expired in place since are still seen (see lsn),
+// so the view never sees a change made after it
+//
+// FIELDS:
+//
+//	file - the open file
+//	size - size of the file when the view was made. Entries appended since are past the end of the view
+//	lsn - LSN of the last change made to the DB when the view was made. Versions expired by later changes are still seen as unexpired
+//	pendingChanges - For a view of a transaction's copy of a DB, number of changes made to the copy when the view was made, as for lsn
+type fileView struct {
+	file           *os.File
+	size           int64
+	lsn            uint64
+	pendingChanges int
 }
 
 // Error type for all db-related errors
@@ -29,8 +79,26 @@ func (e *dbError) Error() string {
 	return fmt.Sprintf("DATABASE ERROR: %s", e.message)
 }
 
+// Returns a dbError if the database was loaded read-only, for methods that change it
+func (db *Database) checkWritable() error {
+	if db.readOnly {
+		return &dbError{fmt.Sprintf("Database '%s' is read-only", db.name())}
+	}
+	return nil
+}
+
+// Returns a dbError if the database is a transaction's copy, for changes that can't be made in a transaction
+// Only changes to entries are made to the collection's databases when a transaction commits (see Tx.Commit)
+func (db *Database) checkNotInTx() error {
+	if db.tx != nil {
+		return &dbError{"Columns and indexes can't be changed inside a transaction"}
+	}
+	return nil
+}
+
 // Insert Inserts a new entry into the DB, given some values and the columns they correspond to
-// Returns a dbError if bad list of columns and values provided, or if we can't open or write to the database file
+// Returns a dbError if bad list of columns and values provided, if the entry would have the same key as another entry
+// in a unique index, or if we can't open or write to the database file
 // Columns not specified in the parameters will be set to an empty cell for the new entry.
 //
 // PARAMS:
@@ -38,6 +106,13 @@ func (e *dbError) Error() string {
 //	providedCols - a list of (user-provided) columns to add values for.
 //	values - values[i] is the value to be added into the entry for column[i]
 func (db *Database) Insert(providedCols []string, values []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.checkWritable()
+	if err != nil {
+		return err
+	}
 
 	// Mismatch between columns and values
 	if len(providedCols) != len(values) {
@@ -50,67 +125,356 @@ func (db *Database) Insert(providedCols []string, values []string) error {
 		return &dbError{fmt.Sprintf("Column '%s' does not exist in database", invalidCol)}
 	}
 
-	// Create CSV entry
 	colValuesMap := utils.SlicesToMap(providedCols, values)
-	entry := ""
-	for _, col := range db.Columns {
 
-		//  If col is a key in colValuesMap, the user has provided a value for this column
-		value, valueProvided := colValuesMap[col]
-		if valueProvided {
-			entry += value
+	// Values must parse as the types of their columns
+	for col, value := range colValuesMap {
+		normalised, err := normaliseValue(value, db.Types[col])
+		if err != nil {
+			return &dbError{fmt.Sprintf("Value '%s' is not a valid %s for column '%s'", value, db.Types[col], col)}
 		}
+		colValuesMap[col] = normalised
+	}
+
+	// Entry can't have the same key as another entry in a unique index.
+	// If the entry's id isn't provided, it's empty here, but a new id can't be taken anyway
+	err = db.checkNewEntryUnique(db.entryValues(colValuesMap))
+	if err != nil {
+		return err
+	}
 
-		// Add an id for the entry
-		if col == "id" {
-			// Replace the random number w/ an auto-increment feature
-			// with the counter stored in DB metadata file
-			entry += fmt.Sprintf("%d", rand.IntN(100))
+	// Give the entry an id. If the user provided one explicitly, it can't already belong to another entry
+	// Otherwise, the next id in the DB's sequence is used
+	idStr, idProvided := colValuesMap["id"]
+	if idProvided {
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id < 1 {
+			return &dbError{fmt.Sprintf("Id must be a positive integer, got '%s'", idStr)}
 		}
 
-		// If cell not at last column, add comma to end, Otherwise add newline
-		if col != db.Columns[len(db.Columns)-1] {
-			entry += ","
-		} else {
-			entry += "\n"
+		taken, err := db.idExists(idStr)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return &dbError{fmt.Sprintf("An entry with id %s already exists in database", idStr)}
 		}
+
+		// Make sure the sequence never hands out this id later on
+		db.reserveID(id)
+	} else {
+		idStr = db.nextID()
 	}
+	colValuesMap["id"] = idStr
 
-	// Open db file
-	file, err := os.OpenFile(db.FilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// Record the entry (w/ it's id) in the write-ahead log before writing it, so that if we crash before it's written,
+	// it's written when the collection is next loaded, and the id is never handed out twice
+	entryValues := db.entryValues(colValuesMap)
+	info, err := os.Stat(db.FilePath)
 	if err != nil {
 		return &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
 	}
-	defer file.Close()
+	record := &walRecord{Op: WAL_INSERT, Offset: info.Size(), Values: entryValues}
+	err = db.logChange(record)
+	if err != nil {
+		return err
+	}
+	return db.finishChange(record, db.applyInsert(entryValues, db.changeTimestamp(record)))
+}
 
-	// Write entry to CSV file directly
-	_, err = file.WriteString(entry)
+// Appends an entry to the database file and adds it to the database's indexes
+//
+// PARAMS:
+//
+//	entryValues - values of the entry, in the order of the database's columns
+//	timestamp - timestamp of the insert (see entryVersion)
+func (db *Database) applyInsert(entryValues []string, timestamp string) error {
+	offset, err := db.appendEntry(entryValues, timestamp)
 	if err != nil {
-		log.Fatal(err)
-		return &dbError{fmt.Sprintf("Couldn't write to file %s", db.FilePath)}
+		return err
 	}
 
+	for _, idx := range db.indexes {
+		err = idx.add(indexKey(keyValues(entryValues, idx.columnIdxs(db.Columns))), offset)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Select Returns some selected entries from a database that match a given condition string
+// Takes the next id in the database's sequence
+// A transaction's copy of a database takes ids from the collection's database, so ids given in and out of transactions never clash
+func (db *Database) nextID() string {
+	if db.original != nil {
+		return db.original.nextID()
+	}
+	db.seqMu.Lock()
+	defer db.seqMu.Unlock()
+	db.sequence++
+	return strconv.Itoa(db.sequence)
+}
+
+// Makes sure the database's sequence never gives an id that was given to an entry explicitly
+func (db *Database) reserveID(id int) {
+	if db.original != nil {
+		db.original.reserveID(id)
+		return
+	}
+	db.seqMu.Lock()
+	defer db.seqMu.Unlock()
+	if id > db.sequence {
+		db.sequence = id
+	}
+}
+
+// Makes the CSV entry for a map of column values
+// Columns not in the map get an empty cell
+func (db *Database) entryValues(colValuesMap map[string]string) []string {
+	entryValues := make([]string, len(db.Columns))
+	for i, col := range db.Columns {
+		entryValues[i] = colValuesMap[col]
+	}
+	return entryValues
+}
+
+// Checks if an entry with a given id exists in the database
 //
-// PARAMS: conditionStr - condition string
-// RETURNS: A slice of strings that each represent an entry matching the condition
+// PARAMS: id - the id to look for
 //
-//	The strings in the slice are arranged in order of the columns to which they belong
-//	(first string in slice will belong to first column, etc.)
-/* func (db *Database) Select(conditionStr string) []string {
+// RETURNS:
+//
+//	true if an entry w/ that id exists, otherwise false
+//	dbError if we can't read the database file
+func (db *Database) idExists(id string) (bool, error) {
+	if idx := db.indexOn("id"); idx != nil {
+		offsets, err := db.lookup(idx, id)
+		return len(offsets) > 0, err
+	}
 
+	idIdx := slices.Index(db.Columns, "id")
+	found := false
+	err := db.readEntries(func(values []string) error {
+		if values[idIdx] == id {
+			found = true
+		}
+		return nil
+	})
+	return found, err
 }
-*/
 
 // Update Updates column values of all entries from a database that match a given condition string
-// PARAMS: conditionStr - condition string
-func (db *Database) Update(conditionStr string) {
+// In a transaction's copy of a database, an entry that was changed outside the transaction after it began can't be updated,
+// as the first change to an entry wins
+//
+// PARAMS:
+//
+//	assignments - map with the columns to update as keys, and the new values for those columns as values
+//	conditionStr - condition string. An empty condition string matches every entry
+//
+// RETURNS:
+//
+//	The number of entries updated
+//	A dbError if an invalid column is assigned to, if updated entries would have the same key in a unique index,
+//		if a matching entry was changed outside the transaction (as above), or if we can't write to the database file
+//	A ConditionError if the condition string is malformed
+func (db *Database) Update(assignments map[string]string, conditionStr string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+
+	// Ids identify entries, so can't be changed
+	_, idAssigned := assignments["id"]
+	if idAssigned {
+		return 0, &dbError{"Column 'id' can't be updated"}
+	}
+
+	// Invalid column(s) assigned to
+	assignedCols := make([]string, 0, len(assignments))
+	for col := range assignments {
+		assignedCols = append(assignedCols, col)
+	}
+	columnsValid, invalidCol := utils.IsSubset(assignedCols, db.Columns)
+	if !columnsValid {
+		return 0, &dbError{fmt.Sprintf("Column '%s' does not exist in database", invalidCol)}
+	}
+
+	// New values must parse as the types of their columns
+	normalisedAssignments := make(map[string]string)
+	for col, value := range assignments {
+		normalised, err := normaliseValue(value, db.Types[col])
+		if err != nil {
+			return 0, &dbError{fmt.Sprintf("Value '%s' is not a valid %s for column '%s'", value, db.Types[col], col)}
+		}
+		normalisedAssignments[col] = normalised
+	}
+	assignments = normalisedAssignments
+
+	predicate, err := CompileCondition(conditionStr, db.Columns, db.Types)
+	if err != nil {
+		return 0, err
+	}
+
+	// New version of a matching entry
+	update := func(values []string) []string {
+		newValues := slices.Clone(values)
+		for i, col := range db.Columns {
+			if value, assigned := assignments[col]; assigned {
+				newValues[i] = value
+			}
+		}
+		return newValues
+	}
 
+	// Updated entries can't end up w/ the same key as another entry in a unique index on an assigned column.
+	// This is checked before the database file is changed, so a failed update changes nothing
+	uniqueIndexes := make([]*index, 0)
+	for _, idx := range db.indexes {
+		if !idx.unique {
+			continue
+		}
+		for _, col := range idx.columns {
+			if _, assigned := assignments[col]; assigned {
+				uniqueIndexes = append(uniqueIndexes, idx)
+				break
+			}
+		}
+	}
+	if len(uniqueIndexes) > 0 {
+		err = db.checkUnique(uniqueIndexes, func(values []string) []string {
+			if !predicate.Eval(values) {
+				return values
+			}
+			return update(values)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	change, err := db.matchingChange(predicate, update)
+	if err != nil {
+		return 0, err
+	}
+	return len(change.Expired), db.makeChange(WAL_UPDATE, change)
 }
 
 // Delete Deletes all entries from a database that match a given condition string
-// PARAMS: conditionStr - condition string
-func (db *Database) Delete(conditionStr string) {}
+// As in Update, an entry that was changed outside a transaction after it began can't be deleted in the transaction
+//
+// PARAMS: conditionStr - condition string. An empty condition string matches every entry
+//
+// RETURNS:
+//
+//	The number of entries deleted
+//	A dbError if a matching entry was changed outside the transaction, or if we can't write to the database file
+//	A ConditionError if the condition string is malformed
+func (db *Database) Delete(conditionStr string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+
+	predicate, err := CompileCondition(conditionStr, db.Columns, db.Types)
+	if err != nil {
+		return 0, err
+	}
+
+	change, err := db.matchingChange(predicate, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(change.Expired), db.makeChange(WAL_DELETE, change)
+}
+
+// Works out the versions an update or delete changes: the versions of the entries the database can see that match a condition
+// are expired, and for an update, new versions of the entries are made
+// The versions are worked out before the change is recorded in the write-ahead log, so replaying the change makes the same change
+// to the same versions, rather than depending on what the condition matches by then
+//
+// PARAMS:
+//
+//	predicate - the compiled condition
+//	updateFn - gives the new values of a matching entry, for an update. nil for a delete
+//
+// RETURNS: the change, and a dbError if a matching entry has been changed since the transaction the database is a copy for began,
+// or if we can't read the database file
+func (db *Database) matchingChange(predicate *Predicate, updateFn func(values []string) []string) (versionChange, error) {
+	change := versionChange{}
+	idIdx := slices.Index(db.Columns, "id")
+	err := db.scanVersions(func(offset int64, entry entryVersion) error {
+		if !db.visible(entry) || !predicate.Eval(entry.values) {
+			return nil
+		}
+		err := db.checkNotExpired(entry)
+		if err != nil {
+			return err
+		}
+		change.Expired = append(change.Expired, versionRef{ID: entry.values[idIdx], Created: entry.xmin})
+		if updateFn != nil {
+			change.Inserted = append(change.Inserted, updateFn(entry.values))
+		}
+		return nil
+	})
+	return change, err
+}
+
+// Records an update or delete in the write-ahead log, then makes it to the database file (see applyChange)
+// Does nothing if the change doesn't change any versions
+//
+// PARAMS:
+//
+//	op - WAL_UPDATE or WAL_DELETE
+//	change - the versions changed (see matchingChange)
+//
+// RETURNS: a dbError if the change couldn't be recorded or made
+func (db *Database) makeChange(op walOp, change versionChange) error {
+	if len(change.Expired) == 0 {
+		return nil
+	}
+	info, err := os.Stat(db.FilePath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
+	}
+	record := &walRecord{Op: op, Offset: info.Size(), Expired: change.Expired, Inserted: change.Inserted}
+	err = db.logChange(record)
+	if err != nil {
+		return err
+	}
+	err = db.applyChange(db.changeTimestamp(record), change)
+	return db.finishChange(record, err)
+}
+
+// Locks several databases at once, for reading or writing, returning a function that unlocks them
+// Databases are always locked in the same order (by file path), so 2 goroutines locking the same databases can't deadlock
+//
+// PARAMS:
+//
+//	dbs - the databases, which must all be different
+//	write - whether to lock them for writing
+func lockDBs(dbs []*Database, write bool) func() {
+	dbs = slices.SortedFunc(slices.Values(dbs), func(a, b *Database) int { return strings.Compare(a.FilePath, b.FilePath) })
+	for _, db := range dbs {
+		if write {
+			db.mu.Lock()
+		} else {
+			db.mu.RLock()
+		}
+	}
+	return func() {
+		for _, db := range dbs {
+			if write {
+				db.mu.Unlock()
+			} else {
+				db.mu.RUnlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+// Makes a new, empty collection in a temporary directory, which is closed once the test finishes
+func newTestCollection(t *testing.T) *Collection {
+	t.Helper()
+	t.Setenv("COLLECTIONS_DIR", t.TempDir())
+	coll := MakeNewCollection("test")
+	t.Cleanup(func() { coll.Close() })
+	return coll
+}
+
+// Makes a new database in a collection, and inserts entries into it
+//
+// PARAMS:
+//
+//	coll - the collection
+//	name - name of the database
+//	columnDefs - definitions of the database's columns, as in Collection.NewDB
+//	entries - values of each entry, for every column except id
+func newTestDB(t *testing.T, coll *Collection, name string, columnDefs []string, entries ...[]string) *Database {
+	t.Helper()
+	err := coll.NewDB(name, columnDefs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := coll.GetDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, values := range entries {
+		err = db.Insert(db.Columns[1:], values)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// Joins each row of a result set into a single string, w/ values seperated by '|'
+func rowStrings(res *ResultSet) []string {
+	rows := make([]string, len(res.Rows))
+	for i, row := range res.Rows {
+		rows[i] = strings.Join(row, "|")
+	}
+	return rows
+}
+
+// Gets every row of a select query over a database as strings (see rowStrings), failing the test if the select fails
+func selectRows(t *testing.T, db *Database, query SelectQuery) []string {
+	t.Helper()
+	res, err := db.Select(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rowStrings(res)
+}
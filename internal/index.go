@@ -0,0 +1,827 @@
+package internal
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// IndexKind Index kind enum
+//
+// HASH_INDEX - Maps each value to the entries that have it. Only finds entries equal to a value
+// BTREE_INDEX - Keeps values in order in a B+tree (see bTree), so can also find entries in a range of values,
+// and give entries in order of the column
+type IndexKind int
+
+const (
+	HASH_INDEX IndexKind = iota
+	BTREE_INDEX
+)
+
+// Names of index kinds, as used in commands and metadata files
+var indexKindNames = map[IndexKind]string{
+	HASH_INDEX:  "hash",
+	BTREE_INDEX: "btree",
+}
+
+func (k IndexKind) String() string {
+	return indexKindNames[k]
+}
+
+// ParseIndexKind Gets the index kind with a given name (e.g. 'btree')
+// Returns a dbError if there is no index kind with that name
+//
+// PARAMS: name - name of the index kind (case-insensitive)
+func ParseIndexKind(name string) (IndexKind, error) {
+	for kind, kindName := range indexKindNames {
+		if strings.EqualFold(name, kindName) {
+			return kind, nil
+		}
+	}
+	return HASH_INDEX, &dbError{fmt.Sprintf("Unknown index kind '%s'", name)}
+}
+
+// An index on one or more columns of a database, used to find entries w/ certain values for the columns w/o a full scan
+// Entries are identified by their byte offset in the database's CSV file, so they can be read directly
+// An index on more than 1 column (a composite index) is keyed by the entry's values for all of it's columns together,
+// so is only used when all of them are known. Composite indexes are always hash indexes
+//
+// A unique index also stops more than 1 entry having the same key, i.e. the same values for all of the index's columns.
+// Entries w/ an empty value for any of the columns aren't checked, as empty values never equal anything
+//
+// In the filesystem, an index is kept in a file alongside the database's CSV file, named '<db>.<columns>.idx' for a hash index
+// or '<db>.<column>.btree' for a B+tree index, where a composite index's columns are seperated by commas.
+// A hash index's file is a CSV file where each line is an entry's key (see indexKey) and the entry's offset,
+// and new entries are appended to it. A B+tree index's file is made of pages (see bTree).
+// Inserts and updates append versions to the database file, which are added to the index, and versions are expired in place,
+// so the index has every version in the file and is kept up to date w/o being rebuilt. Only a rewrite of the database file
+// (by the garbage collector, a column change or a migration) moves entries, so the whole index is rebuilt after it
+//
+// ATTRIBUTES:
+//
+//	columns - Names of the indexed columns
+//	kind - Kind of index
+//	unique - Whether the index is unique
+//	path - Path to the index's file
+//	offsets - For a hash index, map of keys (see indexKey) to the offsets of the entries w/ that key, in increasing order
+//	tree - For a B+tree index, the tree
+type index struct {
+	columns []string
+	kind    IndexKind
+	unique  bool
+	path    string
+	offsets map[string][]int64
+	tree    *bTree
+}
+
+// Gets the path of the file of an index on columns of a database
+// Column names are escaped, so any column names give a valid file name
+//
+// PARAMS:
+//
+//	dbFilePath - path to the database's CSV file (with '.csv' suffix included)
+//	columns - names of the indexed columns
+//	kind - kind of index
+func indexPath(dbFilePath string, columns []string, kind IndexKind) string {
+	suffix := "idx"
+	if kind == BTREE_INDEX {
+		suffix = "btree"
+	}
+	escaped := make([]string, len(columns))
+	for i, column := range columns {
+		escaped[i] = strings.ReplaceAll(url.PathEscape(column), ",", "%2C")
+	}
+	return fmt.Sprintf("%s.%s.%s", strings.TrimSuffix(dbFilePath, ".csv"), strings.Join(escaped, ","), suffix)
+}
+
+// Makes an (unbuilt) index on columns of the database
+func (db *Database) newIndex(columns []string, kind IndexKind, unique bool) *index {
+	idx := &index{columns: columns, kind: kind, unique: unique, path: indexPath(db.FilePath, columns, kind)}
+	if kind == BTREE_INDEX {
+		idx.tree = &bTree{path: idx.path, colType: db.Types[columns[0]]}
+	}
+	return idx
+}
+
+// Gets the database's index on exactly the given columns (in order), or nil if there isn't one
+func (db *Database) indexOnColumns(columns []string) *index {
+	for _, idx := range db.indexes {
+		if slices.Equal(idx.columns, columns) {
+			return idx
+		}
+	}
+	return nil
+}
+
+// Gets the database's index on just a column, or nil if the column doesn't have one
+func (db *Database) indexOn(column string) *index {
+	return db.indexOnColumns([]string{column})
+}
+
+// Makes the key a hash index maps an entry's values for it's columns to
+// The key of a single column index is just the value, otherwise each value is prefixed w/ it's length
+// so values can't run into each other
+func indexKey(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	var key strings.Builder
+	for _, value := range values {
+		key.WriteString(strconv.Itoa(len(value)))
+		key.WriteByte(':')
+		key.WriteString(value)
+	}
+	return key.String()
+}
+
+// Gets an entry's values for the index's columns
+//
+// PARAMS:
+//
+//	values - the entry's values
+//	colIdxs - positions of the index's columns in the entry
+func keyValues(values []string, colIdxs []int) []string {
+	key := make([]string, len(colIdxs))
+	for i, colIdx := range colIdxs {
+		key[i] = values[colIdx]
+	}
+	return key
+}
+
+// Gets the positions of the index's columns among a database's columns
+func (idx *index) columnIdxs(columns []string) []int {
+	colIdxs := make([]int, len(idx.columns))
+	for i, column := range idx.columns {
+		colIdxs[i] = slices.Index(columns, column)
+	}
+	return colIdxs
+}
+
+// CreateIndex Creates an index on one or more columns of the database, built from the entries already in it
+// Once created, the index is kept up to date as entries are inserted, updated and deleted.
+// Selects w/ a condition that requires the columns to equal values use the index to find matching entries w/o a full scan.
+// A B+tree index is also used for conditions that require the column to be in a range (w/ <, <=, >, >= or BETWEEN),
+// and for selects ordered by just the column
+//
+// PARAMS:
+//
+//	columns - names of the columns to index. An index on more than 1 column must be a hash index
+//	kind - kind of index
+//	unique - whether no 2 entries may have the same values for all the columns (see index)
+//
+// RETURNS: a dbError if a column doesn't exist, if the columns are already indexed, if the index is unique
+// but entries already share a key, if the database is a transaction's copy, or if we can't write the index's file
+func (db *Database) CreateIndex(columns []string, kind IndexKind, unique bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.checkWritable()
+	if err == nil {
+		err = db.checkNotInTx()
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(columns) == 0 {
+		return &dbError{"Missing column name"}
+	}
+	for i, column := range columns {
+		if !slices.Contains(db.Columns, column) {
+			return &dbError{fmt.Sprintf("Column '%s' does not exist in database", column)}
+		}
+		if slices.Contains(columns[:i], column) {
+			return &dbError{fmt.Sprintf("Column '%s' is listed more than once", column)}
+		}
+	}
+	if len(columns) > 1 && kind != HASH_INDEX {
+		return &dbError{"An index on more than 1 column must be a hash index"}
+	}
+	if db.indexOnColumns(columns) != nil {
+		return &dbError{fmt.Sprintf("Columns (%s) are already indexed", strings.Join(columns, ", "))}
+	}
+
+	idx := db.newIndex(columns, kind, unique)
+	if unique {
+		err := db.checkUnique([]*index{idx}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.buildIndexes(idx)
+	if err != nil {
+		return err
+	}
+
+	db.indexes = append(db.indexes, idx)
+	return db.saveMetadata()
+}
+
+// Rebuilds indexes from the entries in the database file, and rewrites their files
+// Used when an index is created, and after the database file is rewritten (which moves entries)
+// Every version of every entry in the file is indexed, whether the database can see it or not, as versions are expired in place
+// w/o changing the indexes (see Database.applyChange), and views and transactions' copies of the database see other versions than it does
+// All the indexes are built in a single scan of the database file. B+tree indexes sort their keys w/ an externalSorter
+// before building the tree, so they're built w/in MemoryBudget
+//
+// PARAMS: indexes - the indexes to build
+func (db *Database) buildIndexes(indexes ...*index) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	colIdxs := make([][]int, len(indexes))
+	sorters := make([]*externalSorter, len(indexes))
+	for i, idx := range indexes {
+		colIdxs[i] = idx.columnIdxs(db.Columns)
+		switch idx.kind {
+		case HASH_INDEX:
+			idx.offsets = make(map[string][]int64)
+		case BTREE_INDEX:
+			idx.tree.colType = db.Types[idx.columns[0]]
+			sorters[i] = newExternalSorter(makeBTreeKeyComparer(idx.tree.colType))
+			defer sorters[i].cleanup()
+		}
+	}
+	err := db.scanVersions(func(offset int64, entry entryVersion) error {
+		for i, idx := range indexes {
+			key := indexKey(keyValues(entry.values, colIdxs[i]))
+			if idx.kind == BTREE_INDEX {
+				err := sorters[i].add([]string{key, strconv.FormatInt(offset, 10)})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			idx.offsets[key] = append(idx.offsets[key], offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, idx := range indexes {
+		if idx.kind == BTREE_INDEX {
+			err = idx.buildTree(sorters[i])
+		} else {
+			err = idx.save()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes a comparison function that sorts (value, offset) pairs into the order of B+tree keys
+// Pairs are added in order of offset, so pairs w/ the same (cut short) value only need to be kept in the order they were added
+func makeBTreeKeyComparer(colType ColumnType) func(a, b []string) int {
+	return func(a, b []string) int {
+		keyA, _ := makeBTreeKey(a[0], 0)
+		keyB, _ := makeBTreeKey(b[0], 0)
+		return compareValuesEmptyFirst(keyA.value, keyB.value, colType)
+	}
+}
+
+// Builds a B+tree index's file from the sorted (value, offset) pairs of an externalSorter
+func (idx *index) buildTree(sorter *externalSorter) error {
+	builder, err := idx.tree.newBuilder()
+	if err != nil {
+		return err
+	}
+	err = sorter.sorted(func(values []string) error {
+		offset, err := strconv.ParseInt(values[1], 10, 64)
+		if err != nil {
+			return &dbError{"Malformed temporary file for sorting"}
+		}
+		return builder.add(makeBTreeKey(values[0], offset))
+	})
+	if err != nil {
+		builder.abort()
+		return err
+	}
+	return builder.finish()
+}
+
+// Writes the whole of a hash index to it's file
+func (idx *index) save() error {
+	return writeFileAtomically(idx.path, func(writer *csv.Writer) error {
+		for value, offsets := range idx.offsets {
+			for _, offset := range offsets {
+				err := writer.Write([]string{value, strconv.FormatInt(offset, 10)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Reads an index from it's file. For a B+tree index, only the tree's header is read, as the tree is read from it's file when used
+// Returns the error from the filesystem if the file doesn't exist, so callers can check for it w/ os.IsNotExist()
+func (idx *index) load() error {
+	if idx.kind == BTREE_INDEX {
+		return idx.tree.withFile(false, idx.tree.readHeader)
+	}
+
+	file, err := os.Open(idx.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	idx.offsets = make(map[string][]int64)
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &dbError{fmt.Sprintf("Malformed index file %s", idx.path)}
+		}
+		offset, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			return &dbError{fmt.Sprintf("Malformed index file %s", idx.path)}
+		}
+		idx.offsets[record[0]] = append(idx.offsets[record[0]], offset)
+	}
+
+	// Entries are appended to the file in order, but a rebuilt file is written in no particular order
+	for _, offsets := range idx.offsets {
+		slices.Sort(offsets)
+	}
+	return nil
+}
+
+// Adds a newly appended entry to the index, writing it to the index's file too
+//
+// PARAMS:
+//
+//	value - the entry's key, i.e. it's value for the indexed column, or see indexKey for a composite index
+//	offset - offset of the entry in the database file
+func (idx *index) add(value string, offset int64) error {
+	if idx.kind == BTREE_INDEX {
+		return idx.tree.insert(makeBTreeKey(value, offset))
+	}
+
+	file, err := os.OpenFile(idx.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open index file %s", idx.path)}
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	err = writer.Write([]string{value, strconv.FormatInt(offset, 10)})
+	if err == nil {
+		writer.Flush()
+		err = writer.Error()
+	}
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't write to index file %s", idx.path)}
+	}
+
+	idx.offsets[value] = append(idx.offsets[value], offset)
+	return nil
+}
+
+// Loads a database's indexes, rebuilding any that are missing or out of date
+// An index file older than the database file missed a change to the database (e.g. we crashed before it could be updated),
+// as did a B+tree whose header doesn't have the LSN of the database's last change (see bTree)
+// A read-only database can't rebuild indexes, so it goes w/o them instead
+//
+// PARAMS: indexes - the indexes, as recorded in the database's metadata
+func (db *Database) loadIndexes(indexes []indexMetadata) error {
+	dbInfo, err := os.Stat(db.FilePath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
+	}
+
+	stale := make([]*index, 0)
+	for _, meta := range indexes {
+		kind, err := ParseIndexKind(meta.Kind)
+		if err != nil {
+			return err
+		}
+		idx := db.newIndex(meta.Columns, kind, meta.Unique)
+		info, err := os.Stat(idx.path)
+		if err == nil && !info.ModTime().Before(dbInfo.ModTime()) {
+			err = idx.load()
+		} else {
+			err = os.ErrNotExist
+		}
+		if err == nil && idx.kind == BTREE_INDEX && idx.tree.lsn != db.lsn {
+			err = os.ErrNotExist // Changed part way, or missed a change
+		}
+		switch {
+		case err != nil && db.readOnly:
+			continue
+		case err != nil:
+			stale = append(stale, idx)
+		}
+		db.indexes = append(db.indexes, idx)
+	}
+	return db.buildIndexes(stale...)
+}
+
+// Records in the headers of the database's B+tree indexes that they're up to date w/ the change to the database w/ an LSN,
+// or that they're being changed (changingLSN). Hash indexes don't record an LSN
+func (db *Database) setIndexLSNs(lsn uint64) error {
+	for _, idx := range db.indexes {
+		if idx.kind != BTREE_INDEX {
+			continue
+		}
+		err := idx.tree.setLSN(lsn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the database's indexes on a column (including composite indexes it's part of), deleting their files
+// Does nothing if the column isn't indexed
+func (db *Database) dropIndexes(column string) error {
+	for _, idx := range slices.Clone(db.indexes) {
+		if !slices.Contains(idx.columns, column) {
+			continue
+		}
+		db.indexes = slices.DeleteFunc(db.indexes, func(other *index) bool { return other == idx })
+		err := os.Remove(idx.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &dbError{fmt.Sprintf("Couldn't delete index file %s", idx.path)}
+		}
+	}
+	return nil
+}
+
+// Moves the database's index files to match a new database file path or column names
+// Used when a database or an indexed column is renamed
+func (db *Database) moveIndexFiles() error {
+	for _, idx := range db.indexes {
+		newPath := indexPath(db.FilePath, idx.columns, idx.kind)
+		if newPath == idx.path {
+			continue
+		}
+		err := os.Rename(idx.path, newPath)
+		if err != nil {
+			return &dbError{fmt.Sprintf("Couldn't rename index file %s", idx.path)}
+		}
+		idx.path = newPath
+		if idx.tree != nil {
+			idx.tree.path = newPath
+		}
+	}
+	return nil
+}
+
+// Gets the offsets of the entries that have exactly a given key in an index, in increasing order
+// Only entries the database can see are included (see Database.visible)
+//
+// PARAMS:
+//
+//	idx - the index
+//	key - the key, i.e. the value for the indexed column, or see indexKey for a composite index
+func (db *Database) lookup(idx *index, key string) ([]int64, error) {
+	offsets := idx.offsets[key]
+	truncated := false
+	if idx.kind == BTREE_INDEX {
+		var start bTreeKey
+		start, truncated = makeBTreeKey(key, 0)
+		offsets = make([]int64, 0)
+		err := idx.tree.scan(key, func(treeKey bTreeKey) bool {
+			if compareValuesEmptyFirst(treeKey.value, start.value, idx.tree.colType) != 0 {
+				return false
+			}
+			if treeKey.value == start.value { // Equal values can be stored differently, e.g. times in different zones
+				offsets = append(offsets, treeKey.offset)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		slices.Sort(offsets)
+	}
+
+	// The entries are read to check the database can see them, as the index also has versions that have expired,
+	// and versions made since a transaction began that it's copy of the database can't see (see buildIndexes).
+	// Keys cut short only share their start w/ the key, so the entries' full values are checked too
+	colIdx := slices.Index(db.Columns, idx.columns[0])
+	matching := make([]int64, 0)
+	err := db.scanEntriesAt(offsets, func(offset int64, values []string) error {
+		if !truncated || values[colIdx] == key {
+			matching = append(matching, offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matching, nil
+}
+
+// Checks that a new entry wouldn't have the same key as an existing entry in any of the database's unique indexes
+//
+// PARAMS: values - the new entry's values, in the order of the database's columns
+//
+// RETURNS: a dbError naming the key if it's already taken, or if we can't read an index
+func (db *Database) checkNewEntryUnique(values []string) error {
+	for _, idx := range db.indexes {
+		if !idx.unique {
+			continue
+		}
+		key := keyValues(values, idx.columnIdxs(db.Columns))
+		if slices.Contains(key, "") {
+			continue
+		}
+		offsets, err := db.lookup(idx, indexKey(key))
+		if err != nil {
+			return err
+		}
+		if len(offsets) > 0 {
+			return duplicateKeyError(idx, key)
+		}
+	}
+	return nil
+}
+
+// Checks that no 2 entries have the same key in any of a list of unique indexes, optionally once an update is applied to the entries
+// Each index's keys are sorted w/ an externalSorter, so entries w/ the same key come out next to each other
+//
+// PARAMS:
+//
+//	indexes - the indexes to check
+//	update - gives an entry's values once updated, or nil to check the entries as they are
+//
+// RETURNS: a dbError naming the 1st key found more than once, or if we can't read the database file
+func (db *Database) checkUnique(indexes []*index, update func(values []string) []string) error {
+	colIdxs := make([][]int, len(indexes))
+	sorters := make([]*externalSorter, len(indexes))
+	for i, idx := range indexes {
+		colIdxs[i] = idx.columnIdxs(db.Columns)
+		sorters[i] = newExternalSorter(slices.Compare[[]string])
+		defer sorters[i].cleanup()
+	}
+
+	err := db.readEntries(func(values []string) error {
+		if update != nil {
+			values = update(values)
+		}
+		for i := range indexes {
+			key := keyValues(values, colIdxs[i])
+			if slices.Contains(key, "") {
+				continue
+			}
+			err := sorters[i].add(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, idx := range indexes {
+		var prev []string
+		err = sorters[i].sorted(func(key []string) error {
+			if slices.Equal(key, prev) {
+				return duplicateKeyError(idx, key)
+			}
+			prev = key
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes the error for a key that more than 1 entry would have in a unique index, e.g. Duplicate key (tenant, slug)=('acme', 'home')
+func duplicateKeyError(idx *index, key []string) *dbError {
+	quoted := make([]string, len(key))
+	for i, value := range key {
+		quoted[i] = "'" + value + "'"
+	}
+	return &dbError{fmt.Sprintf("Duplicate key (%s)=(%s) in unique index",
+		strings.Join(idx.columns, ", "), strings.Join(quoted, ", "))}
+}
+
+// A way of using an index to find the entries that can match a query, chosen by Database.planIndexScan
+// The entries found are a superset of those matching the query's condition, so the condition must still be checked
+//
+// FIELDS:
+//
+//	idx - the index to use
+//	lower, upper - the lowest and highest values the column can have. For a hash index, both are the key to look up (see indexKey)
+//	hasLower, hasUpper - whether there is a lowest or highest value. A B+tree index w/ neither is scanned in full
+//	ordered - whether the entries must be given in the order of the column, rather than the order of the database file
+type indexScan struct {
+	idx                *index
+	lower, upper       string
+	hasLower, hasUpper bool
+	ordered            bool
+}
+
+// Works out how an index can be used to find the entries that can match a query, w/o a full scan of the database file
+//
+// For a hash index, only top-level equality tests (possibly ANDed w/ other tests) between the indexed columns and literals are used,
+// w/ a test needed for each of the index's columns, and only if the literals compare equal to exactly the values that are stored identically to them
+// (e.g. for an int column, '007' is looked up as 7, but for a timestamp column, equal times can be stored w/ different zones)
+//
+// For a B+tree index, top-level tests w/ =, <, <=, >, >= or BETWEEN between the indexed column and literals are used
+// to narrow the range of the column that's scanned, as long as the literals compare in the order of the column's type
+// (e.g. a number compared w/ a text column compares numerically, so doesn't follow the index's order).
+// If the query is ordered by just the indexed column, ascending, the index also gives entries in order so they needn't be sorted
+//
+// PARAMS:
+//
+//	predicate - the compiled condition
+//	query - the query
+//
+// RETURNS: the scan to use, or nil if no index can be used
+func (db *Database) planIndexScan(predicate *Predicate, query SelectQuery) *indexScan {
+	if len(db.indexes) == 0 {
+		return nil
+	}
+
+	// Gather the tests that must all be true
+	tests := make([]conditionNode, 0)
+	if predicate.root != nil {
+		tests = append(tests, predicate.root)
+	}
+	for i := 0; i < len(tests); i++ {
+		if logical, ok := tests[i].(*logicalNode); ok && logical.operator == "&" {
+			tests = append(tests, logical.left, logical.right)
+		}
+	}
+
+	// Split tests into comparisons between a column and a literal, w/ the column on the left
+	type bound struct {
+		column   *columnNode
+		operator string
+		literal  *literalNode
+	}
+	flipped := map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+	bounds := make([]bound, 0)
+	for _, test := range tests {
+		switch test := test.(type) {
+		case *comparisonNode:
+			column, isColumn := test.left.(*columnNode)
+			literal, isLiteral := test.right.(*literalNode)
+			operator := test.operator
+			if !isColumn || !isLiteral {
+				column, isColumn = test.right.(*columnNode)
+				literal, isLiteral = test.left.(*literalNode)
+				operator = flipped[operator]
+			}
+			if isColumn && isLiteral && operator != "" {
+				bounds = append(bounds, bound{column, operator, literal})
+			}
+
+		case *betweenNode:
+			column, isColumn := test.operand.(*columnNode)
+			lower, isLowerLiteral := test.lower.(*literalNode)
+			upper, isUpperLiteral := test.upper.(*literalNode)
+			if isColumn && isLowerLiteral && isUpperLiteral {
+				bounds = append(bounds, bound{column, ">=", lower}, bound{column, "<=", upper})
+			}
+		}
+	}
+
+	// Equality tests on all the columns of a hash index narrow the entries down the most
+	equalTo := make(map[string]string)
+	for _, b := range bounds {
+		switch {
+		case b.operator != "=" || b.column.kind == TIMESTAMP:
+			continue
+		case b.column.kind == TEXT && b.literal.kind != TEXT:
+			continue // A number is compared numerically w/ text values, so e.g. 7 equals '07'
+		}
+		value, err := normaliseValue(b.literal.literal, b.column.kind)
+		if err != nil {
+			continue // e.g. 7.5 can't equal any value in an int column, but 7.0 can, so just don't use the index
+		}
+		equalTo[db.Columns[b.column.index]] = value
+	}
+	for _, idx := range db.indexes {
+		if idx.kind != HASH_INDEX {
+			continue
+		}
+		key := make([]string, 0, len(idx.columns))
+		for _, column := range idx.columns {
+			if value, ok := equalTo[column]; ok {
+				key = append(key, value)
+			}
+		}
+		if len(key) == len(idx.columns) {
+			return &indexScan{idx: idx, lower: indexKey(key), upper: indexKey(key), hasLower: true, hasUpper: true}
+		}
+	}
+
+	// Otherwise, narrow the range of the 1st B+tree index that has any bounds
+	var scan *indexScan
+	for _, b := range bounds {
+		idx := db.indexOn(db.Columns[b.column.index])
+		if idx == nil || idx.kind != BTREE_INDEX || (scan != nil && scan.idx != idx) || !followsIndexOrder(b.literal, b.column.kind) {
+			continue
+		}
+		if scan == nil {
+			scan = &indexScan{idx: idx}
+		}
+		value := b.literal.literal
+		if b.operator != "<" && b.operator != "<=" && (!scan.hasLower || compareValues(value, scan.lower, b.column.kind) > 0) {
+			scan.lower, scan.hasLower = value, true
+		}
+		if b.operator != ">" && b.operator != ">=" && (!scan.hasUpper || compareValues(value, scan.upper, b.column.kind) < 0) {
+			scan.upper, scan.hasUpper = value, true
+		}
+	}
+
+	// A B+tree index on the only column the query is ordered by gives entries in order,
+	// unless keys were cut short (in which case long values may be out of order)
+	if len(query.OrderBy) == 1 && !query.OrderBy[0].Descending && len(query.Aggregates) == 0 && len(query.GroupBy) == 0 {
+		idx := db.indexOn(query.OrderBy[0].Column)
+		if idx != nil && idx.kind == BTREE_INDEX && !idx.tree.truncated && (scan == nil || scan.idx == idx) {
+			if scan == nil {
+				scan = &indexScan{idx: idx}
+			}
+			scan.ordered = true
+		}
+	}
+	return scan
+}
+
+// Checks if comparing a column w/ a literal compares in the order of the column's type, so a B+tree index on the column can be used
+// The literal must be non-empty (as nothing is less or greater than an empty value), and valid for the column's type
+func followsIndexOrder(literal *literalNode, colType ColumnType) bool {
+	if literal.literal == "" {
+		return false
+	}
+	switch comparisonType(colType, literal.kind) {
+	case colType:
+	case FLOAT:
+		if colType != INT {
+			return false
+		}
+	default:
+		return false
+	}
+
+	var err error
+	switch colType {
+	case INT, FLOAT:
+		_, err = strconv.ParseFloat(literal.literal, 64)
+	case BOOL:
+		_, err = strconv.ParseBool(literal.literal)
+	case TIMESTAMP:
+		_, err = parseTimestamp(literal.literal)
+	}
+	return err == nil
+}
+
+// Gets the offsets of the entries found by an index scan, in the order they should be read
+// Versions the database can't see are included, as the index has every version in the database file (see buildIndexes),
+// so must be left out once they're read
+//
+// PARAMS: scan - the scan (see indexScan)
+func (db *Database) indexScanOffsets(scan *indexScan) ([]int64, error) {
+	if scan.idx.kind == HASH_INDEX {
+		return slices.Clone(scan.idx.offsets[scan.lower]), nil
+	}
+
+	// Values in the scan's range are cut short the same way as keys, so every key in range is found.
+	// Empty values are never in a range
+	offsets := make([]int64, 0)
+	upper, _ := makeBTreeKey(scan.upper, 0)
+	err := scan.idx.tree.scan(scan.lower, func(key bTreeKey) bool {
+		switch {
+		case scan.hasUpper && compareValuesEmptyFirst(key.value, upper.value, scan.idx.tree.colType) > 0:
+			return false
+		case key.value == "" && (scan.hasLower || scan.hasUpper):
+			return true
+		}
+		offsets = append(offsets, key.offset)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !scan.ordered {
+		slices.Sort(offsets) // Read entries in the order of the database file, as a full scan would
+	}
+	return offsets, nil
+}
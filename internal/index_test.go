@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUniqueIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		fn      func(db *Database) error
+		wantErr bool
+	}{
+		{"insert taken key", []string{"email"}, func(db *Database) error {
+			return db.Insert([]string{"tenant", "slug", "email"}, []string{"c", "z", "a@x"})
+		}, true},
+		{"insert new key", []string{"email"}, func(db *Database) error {
+			return db.Insert([]string{"tenant", "slug", "email"}, []string{"c", "z", "c@x"})
+		}, false},
+		{"insert empty key", []string{"email"}, func(db *Database) error {
+			return db.Insert([]string{"tenant", "slug"}, []string{"c", "z"})
+		}, false},
+		{"insert taken composite key", []string{"tenant", "slug"}, func(db *Database) error {
+			return db.Insert([]string{"tenant", "slug", "email"}, []string{"acme", "home", "c@x"})
+		}, true},
+		{"insert composite key w/ 1 column taken", []string{"tenant", "slug"}, func(db *Database) error {
+			return db.Insert([]string{"tenant", "slug", "email"}, []string{"acme", "blog", "c@x"})
+		}, false},
+		{"update to taken key", []string{"email"}, func(db *Database) error {
+			_, err := db.Update(map[string]string{"email": "a@x"}, "email = 'b@x'")
+			return err
+		}, true},
+		{"update every entry to the same key", []string{"email"}, func(db *Database) error {
+			_, err := db.Update(map[string]string{"email": "c@x"}, "id > 0")
+			return err
+		}, true},
+		{"update to own key", []string{"email"}, func(db *Database) error {
+			_, err := db.Update(map[string]string{"email": "a@x"}, "email = 'a@x'")
+			return err
+		}, false},
+		{"update to taken composite key", []string{"tenant", "slug"}, func(db *Database) error {
+			_, err := db.Update(map[string]string{"tenant": "acme"}, "tenant = 'globex'")
+			return err
+		}, true},
+		{"insert key of deleted entry", []string{"email"}, func(db *Database) error {
+			_, err := db.Delete("email = 'a@x'")
+			if err == nil {
+				err = db.Insert([]string{"tenant", "slug", "email"}, []string{"c", "z", "a@x"})
+			}
+			return err
+		}, false},
+	}
+
+	for _, kind := range []IndexKind{HASH_INDEX, BTREE_INDEX} {
+		for _, test := range tests {
+			if kind == BTREE_INDEX && len(test.columns) > 1 { // Only hash indexes can have more than 1 column
+				continue
+			}
+			t.Run(kind.String()+"/"+test.name, func(t *testing.T) {
+				coll := newTestCollection(t)
+				db := newTestDB(t, coll, "pages", []string{"tenant", "slug", "email"},
+					[]string{"acme", "home", "a@x"}, []string{"globex", "home", "b@x"})
+				err := db.CreateIndex(test.columns, kind, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				before := selectRows(t, db, SelectQuery{})
+				err = test.fn(db)
+				if test.wantErr {
+					if err == nil {
+						t.Fatal("change succeeded, want a duplicate key error")
+					}
+					if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, before) {
+						t.Errorf("got rows %q after a failed change, want %q", got, before)
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestCreateUniqueIndexOverDuplicates(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		wantErr bool
+	}{
+		{"duplicate key", []string{"slug"}, true},
+		{"duplicate composite key", []string{"tenant", "slug"}, true},
+		{"composite key w/ 1 column duplicated", []string{"tenant", "email"}, false},
+		{"duplicates w/ empty values", []string{"email"}, false},
+	}
+
+	for _, kind := range []IndexKind{HASH_INDEX, BTREE_INDEX} {
+		for _, test := range tests {
+			if kind == BTREE_INDEX && len(test.columns) > 1 { // Only hash indexes can have more than 1 column
+				continue
+			}
+			t.Run(kind.String()+"/"+test.name, func(t *testing.T) {
+				coll := newTestCollection(t)
+				db := newTestDB(t, coll, "pages", []string{"tenant", "slug", "email"},
+					[]string{"acme", "home", "a@x"}, []string{"acme", "home", ""}, []string{"globex", "home", ""})
+				err := db.CreateIndex(test.columns, kind, true)
+				if !test.wantErr {
+					if err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				if err == nil {
+					t.Fatal("made a unique index over duplicate keys, want an error")
+				}
+
+				// No index is left behind, so the duplicates can still be added to
+				err = db.Insert([]string{"tenant", "slug"}, []string{"acme", "home"})
+				if err != nil {
+					t.Errorf("insert after the index wasn't made failed: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestUniqueIndexCommit(t *testing.T) {
+	for _, kind := range []IndexKind{HASH_INDEX, BTREE_INDEX} {
+		t.Run(kind.String(), func(t *testing.T) {
+			coll := newTestCollection(t)
+			db := newTestDB(t, coll, "people", []string{"name", "email"}, []string{"alice", "a@x"})
+			err := db.CreateIndex([]string{"email"}, kind, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 2 transactions insert the same key. Neither sees the other's insert, so only the 2nd commit finds the clash
+			insertBob := func(db *Database) error { return db.Insert([]string{"name", "email"}, []string{"bob", "b@x"}) }
+			a, err := coll.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := coll.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = changeInTx(a, insertBob)
+			if err == nil {
+				err = changeInTx(b, insertBob)
+			}
+			if err == nil {
+				err = a.Commit()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Commit() == nil {
+				t.Error("2nd commit of the same key succeeded, want a duplicate key error")
+			}
+			if got := selectRows(t, db, SelectQuery{Columns: []string{"name", "email"}}); !slices.Equal(got, []string{"alice|a@x", "bob|b@x"}) {
+				t.Errorf("got rows %q, want alice's and the 1st bob's", got)
+			}
+
+			// A key freed by a delete in the transaction can be taken by another entry in it
+			tx, err := coll.Begin()
+			if err == nil {
+				err = changeInTx(tx, func(db *Database) error {
+					_, err := db.Delete("name = 'alice'")
+					if err == nil {
+						err = db.Insert([]string{"name", "email"}, []string{"carol", "a@x"})
+					}
+					return err
+				})
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selectRows(t, db, SelectQuery{Columns: []string{"name"}, Condition: "email = 'a@x'"}); !slices.Equal(got, []string{"carol"}) {
+				t.Errorf("got rows %q w/ alice's old email, want carol's", got)
+			}
+		})
+	}
+}
+
+func TestIndexAfterChanges(t *testing.T) {
+	for _, kind := range []IndexKind{HASH_INDEX, BTREE_INDEX} {
+		t.Run(kind.String(), func(t *testing.T) {
+			coll := newTestCollection(t)
+			db := newTestDB(t, coll, "people", []string{"name", "age:int"},
+				[]string{"alice", "30"}, []string{"bob", "20"}, []string{"carol", "50"})
+			err := db.CreateIndex([]string{"age"}, kind, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Update(map[string]string{"age": "21"}, "name = 'bob'")
+			if err == nil {
+				_, err = db.Delete("name = 'alice'")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Counts the versions the index has w/ an age, whether the database can see them or not
+			indexed := func(age string) int {
+				db.mu.RLock()
+				defer db.mu.RUnlock()
+				offsets, err := db.indexScanOffsets(&indexScan{idx: db.indexes[0], lower: age, upper: age, hasLower: true, hasUpper: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return len(offsets)
+			}
+			checkRows := func() {
+				t.Helper()
+				for age, want := range map[string][]string{"20": {}, "21": {"2|bob|21"}, "30": {}, "50": {"3|carol|50"}} {
+					if got := selectRows(t, db, SelectQuery{Condition: "age = " + age}); !slices.Equal(got, want) {
+						t.Errorf("got rows %q w/ age = %s, want %q", got, age, want)
+					}
+				}
+			}
+
+			// The expired versions stay in the index until the garbage collector removes them
+			checkRows()
+			if indexed("20") != 1 || indexed("30") != 1 {
+				t.Errorf("index has %d versions w/ age = 20 and %d w/ age = 30, want the expired versions", indexed("20"), indexed("30"))
+			}
+			db.mu.Lock()
+			err = db.collectGarbage()
+			db.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRows()
+			if indexed("20") != 0 || indexed("30") != 0 {
+				t.Errorf("index has %d versions w/ age = 20 and %d w/ age = 30 after garbage collection, want none", indexed("20"), indexed("30"))
+			}
+		})
+	}
+}
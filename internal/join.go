@@ -0,0 +1,414 @@
+package internal
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JoinKind Join kind enum
+//
+// INNER_JOIN - Only combinations of entries whose join keys match are returned
+// LEFT_JOIN - As INNER_JOIN, but entries on the left w/ no match are also returned, w/ empty values for the joined database
+type JoinKind int
+
+const (
+	INNER_JOIN JoinKind = iota
+	LEFT_JOIN
+)
+
+// JoinKey A pair of columns whose values must be equal for entries to be joined
+// Column names are qualified w/ their database's name (e.g. 'orders.user_id'), and can be given in either order
+type JoinKey struct {
+	Left  string
+	Right string
+}
+
+// Join A database joined onto the databases before it in a query
+//
+// FIELDS:
+//
+//	Kind - Kind of join
+//	DB - Name of the database to join
+//	On - Pairs of columns that must be equal, each pairing a column of DB w/ a column of a database before it.
+//		Entries are joined when all pairs are equal. Empty values never equal anything
+type Join struct {
+	Kind JoinKind
+	DB   string
+	On   []JoinKey
+}
+
+// Select Runs a select query over one or more databases in the collection, joined together
+// Every column in the query must be qualified w/ it's database's name (e.g. 'users.name'), including in conditions.
+// Selecting all columns (nil query.Columns) returns every column of every database, in the order the databases are given
+// Each join is a hash join if the joined database fits in MemoryBudget, otherwise a (block) nested loop join
+//
+// PARAMS:
+//
+//	from - name of the first database
+//	joins - databases to join onto it, in order
+//	query - the query to run over the joined entries (see SelectQuery)
+//
+// RETURNS:
+//
+//	The matching (joined) entries, or the aggregated rows
+//	A CollError if a database doesn't exist
+//	A dbError if a join is invalid, or as in Database.Select
+//	A ConditionError if the condition or having string is malformed
+func (coll *Collection) Select(from string, joins []Join, query SelectQuery) (*ResultSet, error) {
+	return selectJoined(coll.GetDB, from, joins, query)
+}
+
+// Runs a select query over joined databases, as in Collection.Select, getting each database by name w/ getDB
+// This lets a transaction run queries over it's own copies of the databases (see Tx.Select)
+// The databases are locked together while views of them are made (see Database.makeView), then the query runs on the views,
+// so it sees all of the databases as they were at the same moment
+func selectJoined(getDB func(dbName string) (*Database, error), from string, joins []Join, query SelectQuery) (*ResultSet, error) {
+	dbNames := []string{from}
+	dbs := make([]*Database, 0, len(joins)+1)
+	for _, join := range joins {
+		if slices.Contains(dbNames, join.DB) {
+			return nil, &dbError{fmt.Sprintf("Database '%s' appears more than once in the query", join.DB)}
+		}
+		dbNames = append(dbNames, join.DB)
+	}
+	for _, name := range dbNames {
+		db, err := getDB(name)
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+	unlock := lockDBs(dbs, false)
+	for i, db := range dbs {
+		view, err := db.makeView()
+		if err != nil {
+			unlock()
+			for _, view := range dbs[:i] {
+				view.closeView()
+			}
+			return nil, err
+		}
+		dbs[i] = view
+	}
+	unlock()
+	defer func() {
+		for _, view := range dbs {
+			view.closeView()
+		}
+	}()
+
+	columns, types := qualifiedColumns(from, dbs[0])
+	source := dbs[0].readEntries
+
+	for i, join := range joins {
+		right := dbs[i+1]
+		rightColumns, rightTypes := qualifiedColumns(join.DB, right)
+
+		leftIdxs, rightIdxs, err := resolveJoinKeys(join, columns, rightColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		keyTypes := make([]ColumnType, len(leftIdxs))
+		for j := range keyTypes {
+			keyTypes[j] = comparisonType(types[columns[leftIdxs[j]]], rightTypes[rightColumns[rightIdxs[j]]])
+		}
+
+		source = joinEntries(join.Kind, source, right, joinColumns{leftIdxs, rightIdxs, keyTypes})
+		columns = slices.Concat(columns, rightColumns)
+		maps.Copy(types, rightTypes)
+	}
+
+	return runQuery(query, columns, types, source)
+}
+
+// Gets a database's column names qualified w/ a name for the database (e.g. 'users.name'), and their types
+func qualifiedColumns(dbName string, db *Database) ([]string, map[string]ColumnType) {
+	columns := make([]string, len(db.Columns))
+	types := make(map[string]ColumnType)
+	for i, col := range db.Columns {
+		columns[i] = dbName + "." + col
+		types[columns[i]] = db.Types[col]
+	}
+	return columns, types
+}
+
+// Works out which columns of the left and right entries a join compares
+//
+// PARAMS:
+//
+//	join - the join
+//	leftColumns - qualified names of the columns of the entries being joined onto
+//	rightColumns - qualified names of the columns of the database being joined
+//
+// RETURNS:
+//
+//	positions of the compared columns in the left entries
+//	positions of the compared columns in the right entries, in the same order
+//	a dbError if the join has no keys, or a key doesn't pair a left column w/ a right column
+func resolveJoinKeys(join Join, leftColumns []string, rightColumns []string) ([]int, []int, error) {
+	if len(join.On) == 0 {
+		return nil, nil, &dbError{fmt.Sprintf("Join of '%s' has no columns to join on", join.DB)}
+	}
+
+	leftIdxs := make([]int, len(join.On))
+	rightIdxs := make([]int, len(join.On))
+	for i, key := range join.On {
+		leftIdx, rightIdx := slices.Index(leftColumns, key.Left), slices.Index(rightColumns, key.Right)
+		if leftIdx == -1 || rightIdx == -1 { // Try the other way round
+			leftIdx, rightIdx = slices.Index(leftColumns, key.Right), slices.Index(rightColumns, key.Left)
+		}
+		if leftIdx == -1 || rightIdx == -1 {
+			return nil, nil, &dbError{fmt.Sprintf("Can't join on '%s = %s', expected a column of '%s' and a column of a database before it",
+				key.Left, key.Right, join.DB)}
+		}
+		leftIdxs[i], rightIdxs[i] = leftIdx, rightIdx
+	}
+	return leftIdxs, rightIdxs, nil
+}
+
+// The columns a join compares
+//
+// FIELDS:
+//
+//	left, right - positions of the compared columns in the left and right entries (see resolveJoinKeys)
+//	types - the type each pair of columns is compared as (see comparisonType)
+type joinColumns struct {
+	left  []int
+	right []int
+	types []ColumnType
+}
+
+// Makes a key out of an entry's values in the given columns, such that 2 entries' keys are equal
+// only if all of their values are equal as the types the columns are compared as (see joinValue)
+// Returns false if any of the values are empty, as empty values never match
+func joinKey(values []string, idxs []int, types []ColumnType) (string, bool) {
+	var key strings.Builder
+	for i, idx := range idxs {
+		if values[idx] == "" {
+			return "", false
+		}
+		value := joinValue(values[idx], types[i])
+		key.WriteString(strconv.Itoa(len(value))) // Length prefix keeps values from running into each other
+		key.WriteByte(':')
+		key.WriteString(value)
+	}
+	return key.String(), true
+}
+
+// Gets the form of a value that a join compares, so values that are equal as a type have the same form,
+// e.g. int 1 and float 1.0, or the same time w/ different UTC offsets. Values that don't parse as the type are compared as text
+func joinValue(value string, colType ColumnType) string {
+	if colType == TIMESTAMP {
+		t, err := parseTimestamp(value)
+		if err != nil {
+			return value
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	normalised, err := normaliseValue(value, colType)
+	if err != nil {
+		return value
+	}
+	return normalised
+}
+
+// Makes a source of the entries produced by joining a database onto a source of entries
+// Each joined entry is the left entry's values followed by the right entry's values
+//
+// PARAMS:
+//
+//	kind - kind of join
+//	left - streams the entries being joined onto
+//	right - the database being joined
+//	on - the columns the join compares
+//
+// RETURNS: function streaming the joined entries, in the same form as Database.readEntries
+func joinEntries(kind JoinKind, left func(entryFn func(values []string) error) error, right *Database,
+	on joinColumns) func(entryFn func(values []string) error) error {
+
+	emptyRight := make([]string, len(right.Columns))
+
+	return func(entryFn func(values []string) error) error {
+		table, fits, err := buildHashTable(right, on.right, on.types)
+		if err != nil {
+			return err
+		}
+		if !fits {
+			return nestedLoopJoin(kind, left, right, on, entryFn)
+		}
+
+		// Hash join: look up each left entry's matches in the table
+		return left(func(values []string) error {
+			var matches [][]string
+			if key, ok := joinKey(values, on.left, on.types); ok {
+				matches = table[key]
+			}
+			if len(matches) == 0 && kind == LEFT_JOIN {
+				return entryFn(slices.Concat(values, emptyRight))
+			}
+			for _, match := range matches {
+				err := entryFn(slices.Concat(values, match))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// Reads a database's entries into a hash table keyed by their values in the join columns
+// Entries w/ an empty value in a join column can never match, so are left out
+//
+// PARAMS:
+//
+//	db - the database
+//	idxs - positions of the join columns in the database's entries
+//	types - the types the join columns are compared as
+//
+// RETURNS:
+//
+//	the table
+//	false if the entries don't fit in MemoryBudget, in which case the table is incomplete and shouldn't be used
+//	any error from reading the database
+func buildHashTable(db *Database, idxs []int, types []ColumnType) (map[string][][]string, bool, error) {
+	table := make(map[string][][]string)
+	var size int64
+	err := db.readEntries(func(values []string) error {
+		key, ok := joinKey(values, idxs, types)
+		if !ok {
+			return nil
+		}
+		size += entrySize(values)
+		if size > MemoryBudget {
+			return errStopScan
+		}
+		table[key] = append(table[key], values)
+		return nil
+	})
+
+	switch {
+	case err == errStopScan:
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	default:
+		return table, true, nil
+	}
+}
+
+// Joins a database onto a source of entries w/ a block nested loop join, for when the database doesn't fit in memory
+// Left entries are read in blocks that fit in MemoryBudget, and the database is scanned once per block. A block's matches are
+// gathered before they're passed on, so joined entries come out in the same order as from a hash join: in the order of the left entries,
+// then of the right entries each one is joined w/
+// Joined entries are passed to entryFn, stopping and returning the error if it returns one
+func nestedLoopJoin(kind JoinKind, left func(entryFn func(values []string) error) error, right *Database,
+	on joinColumns, entryFn func(values []string) error) error {
+
+	emptyRight := make([]string, len(right.Columns))
+	block := make([][]string, 0, 64)
+	keys := make([]string, 0, 64) // Join keys of the entries in the block. Empty if the entry can't match
+	var blockSize int64
+
+	// Passes on the joined entries for a left entry and it's matches, or for an unmatched left entry in a left join
+	emit := func(values []string, matches [][]string) error {
+		if len(matches) == 0 && kind == LEFT_JOIN {
+			return entryFn(slices.Concat(values, emptyRight))
+		}
+		for _, match := range matches {
+			err := entryFn(slices.Concat(values, match))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Joins part of the block against every entry in the database, returning how many of the part's entries were joined
+	// If the part's matches don't fit in MemoryBudget, only the 1st half of it is joined. A single entry's matches
+	// are passed straight on as they're found instead, which keeps them in order w/o holding them
+	var joinPart func(part [][]string, partKeys []string) (int, error)
+	joinPart = func(part [][]string, partKeys []string) (int, error) {
+		if len(part) == 1 {
+			matched := false
+			err := right.readEntries(func(rightValues []string) error {
+				rightKey, ok := joinKey(rightValues, on.right, on.types)
+				if !ok || rightKey != partKeys[0] {
+					return nil
+				}
+				matched = true
+				return entryFn(slices.Concat(part[0], rightValues))
+			})
+			if err == nil && !matched {
+				err = emit(part[0], nil)
+			}
+			return 1, err
+		}
+
+		matches := make([][][]string, len(part))
+		var size int64
+		err := right.readEntries(func(rightValues []string) error {
+			rightKey, ok := joinKey(rightValues, on.right, on.types)
+			if !ok {
+				return nil
+			}
+			for i, key := range partKeys {
+				if key != rightKey {
+					continue
+				}
+				size += entrySize(rightValues)
+				if size > MemoryBudget {
+					return errStopScan
+				}
+				matches[i] = append(matches[i], rightValues)
+			}
+			return nil
+		})
+		if err == errStopScan {
+			return joinPart(part[:len(part)/2], partKeys[:len(part)/2])
+		}
+		if err != nil {
+			return 0, err
+		}
+		for i, values := range part {
+			err = emit(values, matches[i])
+			if err != nil {
+				return 0, err
+			}
+		}
+		return len(part), nil
+	}
+
+	// Joins the whole block, a part at a time, then empties it
+	joinBlock := func() error {
+		for start := 0; start < len(block); {
+			joined, err := joinPart(block[start:], keys[start:])
+			if err != nil {
+				return err
+			}
+			start += joined
+		}
+		block, keys, blockSize = block[:0], keys[:0], 0
+		return nil
+	}
+
+	err := left(func(values []string) error {
+		key, _ := joinKey(values, on.left, on.types) // Empty if any join value is empty, and no right key is empty
+		block = append(block, values)
+		keys = append(keys, key)
+		blockSize += entrySize(values)
+		if blockSize > MemoryBudget {
+			return joinBlock()
+		}
+		return nil
+	})
+	if err == nil && len(block) > 0 {
+		err = joinBlock()
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestJoin(t *testing.T) {
+	coll := newTestCollection(t)
+	newTestDB(t, coll, "users", []string{"name", "code:int", "joined:timestamp"},
+		[]string{"alice", "10000000", "2024-01-01T10:00:00+01:00"},
+		[]string{"bob", "2", "2024-01-02T00:00:00Z"},
+		[]string{"carol", "", "2024-01-03T00:00:00Z"},
+	)
+	newTestDB(t, coll, "orders", []string{"code:float", "placed:timestamp", "total:int"},
+		[]string{"1e7", "2024-01-01T09:00:00Z", "5"},
+		[]string{"10000000.0", "2024-01-01T12:00:00+03:00", "7"},
+		[]string{"3", "2024-01-02T00:00:00Z", "9"},
+	)
+	budget := MemoryBudget
+	t.Cleanup(func() { MemoryBudget = budget })
+
+	tests := []struct {
+		name  string
+		joins []Join
+		want  []string
+	}{
+		{
+			"int matches float",
+			[]Join{{INNER_JOIN, "orders", []JoinKey{{"users.code", "orders.code"}}}},
+			[]string{"1|alice|10000000|2024-01-01T10:00:00+01:00|1|1e+07|2024-01-01T09:00:00Z|5",
+				"1|alice|10000000|2024-01-01T10:00:00+01:00|2|1e+07|2024-01-01T12:00:00+03:00|7"},
+		},
+		{
+			"timestamps in different offsets match",
+			[]Join{{INNER_JOIN, "orders", []JoinKey{{"orders.placed", "users.joined"}}}},
+			[]string{"1|alice|10000000|2024-01-01T10:00:00+01:00|1|1e+07|2024-01-01T09:00:00Z|5",
+				"1|alice|10000000|2024-01-01T10:00:00+01:00|2|1e+07|2024-01-01T12:00:00+03:00|7",
+				"2|bob|2|2024-01-02T00:00:00Z|3|3|2024-01-02T00:00:00Z|9"},
+		},
+		{
+			"left join w/ no match",
+			[]Join{{LEFT_JOIN, "orders", []JoinKey{{"users.code", "orders.code"}}}},
+			[]string{"1|alice|10000000|2024-01-01T10:00:00+01:00|1|1e+07|2024-01-01T09:00:00Z|5",
+				"1|alice|10000000|2024-01-01T10:00:00+01:00|2|1e+07|2024-01-01T12:00:00+03:00|7",
+				"2|bob|2|2024-01-02T00:00:00Z||||",
+				"3|carol||2024-01-03T00:00:00Z||||"},
+		},
+	}
+
+	// A tiny budget means the joined database never fits in a hash table, so the nested loop join is used
+	for _, join := range []struct {
+		name   string
+		budget int64
+	}{{"hash join", budget}, {"nested loop join", 1}} {
+		for _, test := range tests {
+			t.Run(join.name+"/"+test.name, func(t *testing.T) {
+				MemoryBudget = join.budget
+				res, err := coll.Select("users", test.joins, SelectQuery{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := rowStrings(res)
+				slices.Sort(got)
+				if !slices.Equal(got, test.want) {
+					t.Errorf("got rows\n%q\nwant\n%q", got, test.want)
+				}
+			})
+		}
+	}
+}
+
+func TestNestedLoopJoinOrder(t *testing.T) {
+	coll := newTestCollection(t)
+	users := make([][]string, 12)
+	for i := range users {
+		users[i] = []string{fmt.Sprintf("user%d", i), fmt.Sprint(i % 5)}
+	}
+	orders := make([][]string, 30)
+	for i := range orders {
+		orders[i] = []string{fmt.Sprint((i * 7) % 6), fmt.Sprint(i)}
+	}
+	newTestDB(t, coll, "users", []string{"name", "team:int"}, users...)
+	newTestDB(t, coll, "orders", []string{"team:int", "n:int"}, orders...)
+	budget := MemoryBudget
+	t.Cleanup(func() { MemoryBudget = budget })
+
+	for _, kind := range []JoinKind{INNER_JOIN, LEFT_JOIN} {
+		joins := []Join{{kind, "orders", []JoinKey{{"users.team", "orders.team"}}}}
+		MemoryBudget = budget
+		res, err := coll.Select("users", joins, SelectQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := rowStrings(res)
+
+		// Budgets too small for a hash table of the orders, but big enough for blocks of several users,
+		// some of which have more matches than fit in the budget
+		for _, joinBudget := range []int64{1, 300, 1000} {
+			MemoryBudget = joinBudget
+			res, err = coll.Select("users", joins, SelectQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rowStrings(res); !slices.Equal(got, want) {
+				t.Errorf("nested loop join (kind %d, budget %d) gave rows\n%q\nwant the hash join's\n%q", kind, joinBudget, got, want)
+			}
+		}
+	}
+}
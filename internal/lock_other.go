@@ -0,0 +1,19 @@
+//go:build !unix && !windows
+
+package internal
+
+import (
+	"errors"
+	"os"
+)
+
+// Opens the file a collection's lock is taken on (see lockFile), which is the collection's directory
+func openLockFile(collectionPath string) (*os.File, error) {
+	return os.Open(collectionPath)
+}
+
+// Advisory locks aren't supported on this platform, so a collection can't be locked. Collections aren't opened
+// w/o a lock, as another process could be writing to the same collection at once
+func lockFile(file *os.File, shared bool) error {
+	return errors.New("file locks aren't supported on this platform")
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Opens the file a collection's lock is taken on (see lockFile), which is the collection's directory
+func openLockFile(collectionPath string) (*os.File, error) {
+	return os.Open(collectionPath)
+}
+
+// Takes an advisory lock (flock) on an open file, without waiting
+// Returns errLocked if another process holds a lock that conflicts w/ it
+//
+// PARAMS:
+//
+//	file - the file to lock. The lock is released when it's closed
+//	shared - whether to take a shared lock, which other shared locks can be held alongside, rather than an exclusive one
+func lockFile(file *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errLocked
+	}
+	return err
+}
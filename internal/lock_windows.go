@@ -0,0 +1,52 @@
+//go:build windows
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// Name of the file in a collection's directory that the collection's lock is taken on
+// A directory can't be locked on Windows, so a file in it is locked instead
+const lockFileName = "collection.lock"
+
+// LockFileEx flags, and the error it gives when another process holds a conflicting lock
+const (
+	lockfileFailImmediately               = 0x1
+	lockfileExclusiveLock                 = 0x2
+	errorLockViolation      syscall.Errno = 33
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// Opens the file a collection's lock is taken on (see lockFile), creating it if it doesn't exist
+func openLockFile(collectionPath string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(collectionPath, lockFileName), os.O_RDONLY|os.O_CREATE, 0644)
+}
+
+// Locks the 1st byte of an open file (LockFileEx), without waiting
+// Returns errLocked if another process holds a lock that conflicts w/ it
+//
+// PARAMS:
+//
+//	file - the file to lock. The lock is released when it's closed
+//	shared - whether to take a shared lock, which other shared locks can be held alongside, rather than an exclusive one
+func lockFile(file *os.File, shared bool) error {
+	flags := lockfileFailImmediately
+	if !shared {
+		flags |= lockfileExclusiveLock
+	}
+	overlapped := &syscall.Overlapped{}
+	ok, _, err := procLockFileEx.Call(file.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(overlapped)))
+	if ok != 0 {
+		return nil
+	}
+	if errors.Is(err, errorLockViolation) {
+		return errLocked
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Metadata of a database that isn't stored in the database's CSV file itself
+// In the filesystem, this is kept in a JSON file alongside the database's CSV file,
+// with the same name but a '.meta.json' suffix instead of '.csv'
+//
+// FIELDS:
+//
+//	Format - version of the format the database's CSV file is stored in (see currentFileFormat)
+//	Sequence - the last id given to an entry in the database. Only ever goes up, so ids are never reused
+//	Types - map with column names as keys and the names of their column types as values
+//	Indexes - the database's indexes (see index)
+//	LSN - LSN of the last change from the write-ahead log made to the database's files (see writeAheadLog)
+type dbMetadata struct {
+	Format   int               `json:"format"`
+	Sequence int               `json:"sequence"`
+	Types    map[string]string `json:"types"`
+	Indexes  []indexMetadata   `json:"indexes,omitempty"`
+	LSN      uint64            `json:"lsn,omitempty"`
+}
+
+// Metadata of an index
+//
+// FIELDS:
+//
+//	Columns - names of the indexed columns
+//	Kind - name of the kind of index (see IndexKind)
+//	Unique - whether the index is unique
+type indexMetadata struct {
+	Columns []string `json:"columns"`
+	Kind    string   `json:"kind"`
+	Unique  bool     `json:"unique,omitempty"`
+}
+
+// Gets the path of the metadata file belonging to a database
+//
+// PARAMS: dbFilePath - path to the database's CSV file (with '.csv' suffix included)
+func metadataPath(dbFilePath string) string {
+	return strings.TrimSuffix(dbFilePath, ".csv") + ".meta.json"
+}
+
+// Reads a database's metadata file
+// Returns the error from the filesystem if the file doesn't exist or can't be read,
+// so callers can check for a missing file w/ os.IsNotExist()
+//
+// PARAMS: dbFilePath - path to the database's CSV file (with '.csv' suffix included)
+func loadMetadata(dbFilePath string) (*dbMetadata, error) {
+	data, err := os.ReadFile(metadataPath(dbFilePath))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &dbMetadata{}
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Writes a database's current metadata to it's metadata file
+// The metadata is written to a temporary file first, which then replaces the metadata file via a rename,
+// so the metadata file is never left half-written. The database's indexes must be up to date, as their B+trees are given it's LSN first
+//
+// RETURNS: a dbError if the metadata file couldn't be written
+func (db *Database) saveMetadata() error {
+	err := db.setIndexLSNs(db.lsn)
+	if err != nil {
+		return err
+	}
+
+	types := make(map[string]string)
+	for col, colType := range db.Types {
+		types[col] = colType.String()
+	}
+
+	indexes := make([]indexMetadata, len(db.indexes))
+	for i, idx := range db.indexes {
+		indexes[i] = indexMetadata{Columns: idx.columns, Kind: idx.kind.String(), Unique: idx.unique}
+	}
+
+	db.seqMu.Lock()
+	sequence := db.sequence
+	db.seqMu.Unlock()
+
+	meta := dbMetadata{Format: currentFileFormat, Sequence: sequence, Types: types, Indexes: indexes, LSN: db.lsn}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't encode metadata of %s", db.FilePath)}
+	}
+
+	path := metadataPath(db.FilePath)
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return &dbError{fmt.Sprintf("Couldn't write metadata file %s", path)}
+	}
+	return nil
+}
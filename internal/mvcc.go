@@ -0,0 +1,316 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCInterval Time between passes of a collection's garbage collector, which removes versions of entries that no transaction can see any more
+var GCInterval = time.Minute
+
+// Names of the columns at the end of every line of a database file, holding the timestamps of the entry version on the line (see entryVersion)
+// They aren't part of the database's Columns
+var versionColumns = []string{"_xmin", "_xmax"}
+
+// Prefix of the timestamps given to the versions a transaction makes and expires in it's copies of databases, followed by the number of
+// the change to the copy (e.g. 'tx3'), so a view of the copy knows which expiries were made after it. They're given the LSN of the commit
+// once the transaction is committed
+const pendingTimestamp = "tx"
+
+// A version of an entry, i.e. a line of a database file
+// Rather than being changed in place, an updated entry is expired and a new version of it is appended, and a deleted entry is just expired.
+// Only a version's xmax is written in place, when it's expired (see Database.expireVersionsAt).
+// So a transaction can go on seeing the entries as they were when it began (see Database.visible), while other changes are made.
+// Versions no transaction can see any more are removed when the database file is next rewritten, or by the garbage collector
+//
+// Timestamps are the LSNs of changes in the write-ahead log (see writeAheadLog), a pending timestamp (see pendingTimestamp) for a change
+// made in a transaction that hasn't been committed, or empty for a version that hasn't expired. Entries from before versions existed were made at timestamp 0
+//
+// FIELDS:
+//
+//	values - the entry's values, in the order of the database's columns
+//	xmin - timestamp of the change that made the version
+//	xmax - timestamp of the change that expired the version, or empty
+type entryVersion struct {
+	values []string
+	xmin   string
+	xmax   string
+}
+
+// A version of an entry that a change expired, as recorded in the write-ahead log (see versionChange)
+// An entry only has 1 unexpired version, and only 1 version made at each committed timestamp, so the entry's id and the version's xmin
+// identify the version
+type versionRef struct {
+	ID      string `json:"id"`
+	Created string `json:"created"`
+}
+
+// The changes to versions of entries that a committed transaction, an update or a delete made to one database,
+// as recorded in the write-ahead log. Recording the versions, rather than how to find them, means replaying the change
+// always changes the same versions (see Database.applyChange)
+//
+// FIELDS:
+//
+//	DB - Name of the database, for a commit
+//	Offset - Size of the database file before the versions made were appended, so replaying the change can cut off any it appended
+//		before (see Database.replayChange). 0 in changes recorded before it was
+//	Expired - The versions expired, by updating or deleting their entries
+//	Inserted - Values of the versions made, by inserting or updating entries, in the order of the database's columns
+type versionChange struct {
+	DB       string       `json:"db"`
+	Offset   int64        `json:"offset,omitempty"`
+	Expired  []versionRef `json:"expired,omitempty"`
+	Inserted [][]string   `json:"inserted,omitempty"`
+}
+
+// A collection's garbage collector, which runs in the background while the collection is open (see Collection.collectGarbage)
+//
+// ATTRIBUTES:
+//
+//	stop - Closed to stop the garbage collector
+//	stopOnce - Makes sure stop is only closed once
+//	done - Closed once the garbage collector has stopped
+//	errs - Error from the last pass that got to each database, for the databases that pass failed on. A database's error is kept
+//	       until a pass gets to it and succeeds, so passes that skip it don't hide it. Only read once the garbage collector has stopped
+type garbageCollector struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	errs     map[*Database]error
+}
+
+// Sets GCInterval from the GC_INTERVAL .env variable (a duration, e.g. '30s'), if it's set
+// Must be called after the .env file is loaded
+func loadGCSettings() {
+	intervalStr := os.Getenv("GC_INTERVAL")
+	if intervalStr == "" {
+		return
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		log.Fatalf("GC_INTERVAL must be a positive duration, got '%s'", intervalStr)
+	}
+	GCInterval = interval
+}
+
+// Gets the LSN a timestamp is, or false if it's empty or pending
+func committedAt(timestamp string) (uint64, bool) {
+	lsn, err := strconv.ParseUint(timestamp, 10, 64)
+	return lsn, err == nil
+}
+
+// Checks if a timestamp is pending, i.e. from a change made in a transaction that hasn't been committed (see pendingTimestamp)
+func isPending(timestamp string) bool {
+	return strings.HasPrefix(timestamp, pendingTimestamp)
+}
+
+// Gets the number of the change to a transaction's copy of a database that a pending timestamp is from
+func pendingChange(timestamp string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(timestamp, pendingTimestamp))
+	return n
+}
+
+// Checks if a version of an entry can be seen through the database
+// A collection's database sees the latest version of each entry. A transaction's copy of a database sees the versions made
+// before the transaction began or in the transaction, that hadn't been expired by then and haven't been expired in the transaction
+// A view of either (see Database.makeView) sees the versions it did when it was made
+func (db *Database) visible(entry entryVersion) bool {
+	if db.tx != nil {
+		if created, committed := committedAt(entry.xmin); committed && created > db.tx.snapshot {
+			return false
+		}
+	}
+	return !db.seesExpiry(entry.xmax)
+}
+
+// Checks if the database sees a version of an entry as expired, given the version's xmax
+// Versions are expired in place (see Database.expireVersionsAt), so a transaction's copy of a database doesn't see expiries committed
+// after the transaction began, and a view doesn't see expiries made after it was made
+func (db *Database) seesExpiry(xmax string) bool {
+	if xmax == "" {
+		return false
+	}
+	expired, committed := committedAt(xmax)
+	switch {
+	case committed && db.tx != nil && expired > db.tx.snapshot:
+		return false
+	case db.view == nil:
+		return true
+	case committed:
+		return expired <= db.view.lsn
+	}
+	return pendingChange(xmax) <= db.view.pendingChanges
+}
+
+// Checks if no transaction can see a version of an entry any more, so it can be removed
+//
+// PARAMS:
+//
+//	entry - the version
+//	horizon - the earliest timestamp a transaction can still see the database at (see Database.gcHorizon)
+func (db *Database) isDead(entry entryVersion, horizon uint64) bool {
+	if isPending(entry.xmin) && isPending(entry.xmax) {
+		return true // Made and expired in the same transaction
+	}
+	expired, committed := committedAt(entry.xmax)
+	return committed && expired <= horizon
+}
+
+// Gets the earliest timestamp the database can still be seen at: the earliest snapshot of the collection's open transactions,
+// or the transaction's snapshot for a transaction's copy of a database. Versions expired at or before it are dead (see isDead)
+func (db *Database) gcHorizon() uint64 {
+	switch {
+	case db.tx != nil:
+		return db.tx.snapshot
+	case db.wal != nil && db.wal.coll != nil:
+		return db.wal.coll.gcHorizon()
+	}
+	return math.MaxUint64
+}
+
+// Gets the earliest snapshot of the collection's open transactions, or the largest possible timestamp if none are open
+func (coll *Collection) gcHorizon() uint64 {
+	coll.snapshotsMu.Lock()
+	defer coll.snapshotsMu.Unlock()
+
+	horizon := uint64(math.MaxUint64)
+	for _, snapshot := range coll.snapshots {
+		horizon = min(horizon, snapshot)
+	}
+	return horizon
+}
+
+// Gets the timestamp to give versions made and expired by a change to the database
+// A change to a transaction's copy of a database is given the next pending timestamp (see pendingTimestamp)
+//
+// PARAMS: record - the change's record in the write-ahead log, which has been given it's LSN
+func (db *Database) changeTimestamp(record *walRecord) string {
+	if db.tx != nil {
+		db.pendingChanges++
+		return pendingTimestamp + strconv.Itoa(db.pendingChanges)
+	}
+	return strconv.FormatUint(record.LSN, 10)
+}
+
+// Returns a dbError if a version of an entry seen through a transaction's copy of a database has been expired by a change committed
+// since the transaction began, for changes to the entry. The first change to an entry wins, and the transaction can't overwrite it
+func (db *Database) checkNotExpired(entry entryVersion) error {
+	if entry.xmax == "" {
+		return nil
+	}
+	return &dbError{fmt.Sprintf("Entry with id %s was changed outside the transaction after it began", entry.values[slices.Index(db.Columns, "id")])}
+}
+
+// Starts the collection's garbage collector, which makes a pass over the collection's databases every GCInterval until the collection is closed
+func (coll *Collection) startGC() {
+	gc := &garbageCollector{stop: make(chan struct{}), done: make(chan struct{}), errs: make(map[*Database]error)}
+	coll.gc = gc
+	go func() {
+		defer close(gc.done)
+		ticker := time.NewTicker(GCInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-gc.stop:
+				return
+			case <-ticker.C:
+				coll.collectGarbage(gc.errs)
+			}
+		}
+	}()
+}
+
+// Stops the collection's garbage collector, waiting for any pass it's part way through to finish
+// Does nothing if the collection has no garbage collector (i.e. it's read-only)
+// Returns the errors from the garbage collector's last pass over each database it failed on, joined, if there are any
+func (coll *Collection) stopGC() error {
+	if coll.gc == nil {
+		return nil
+	}
+	coll.gc.stopOnce.Do(func() { close(coll.gc.stop) })
+	<-coll.gc.done
+	errs := make([]error, 0, len(coll.gc.errs))
+	for _, err := range coll.gc.errs {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Removes the versions of entries that no transaction can see any more from each of the collection's databases
+// Databases that are in use are skipped, and left for the next pass. So are databases the versions can't be removed from,
+// which are logged and tried again in the next pass
+//
+// PARAMS: errs - Error from the last pass that got to each database, for the databases it failed on. Updated for the databases
+// this pass gets to, and cleared for databases that are no longer in the collection
+func (coll *Collection) collectGarbage(errs map[*Database]error) {
+	coll.mu.RLock()
+	defer coll.mu.RUnlock()
+
+	loaded := make(map[*Database]bool, len(coll.dbs))
+	for name, db := range coll.dbs {
+		loaded[db] = true
+		if !db.mu.TryLock() {
+			continue
+		}
+		err := db.collectGarbage()
+		db.mu.Unlock()
+		if err != nil {
+			log.Printf("Couldn't collect garbage in database '%s': %s", name, err)
+			errs[db] = err
+		} else {
+			delete(errs, db)
+		}
+	}
+	for db := range errs {
+		if !loaded[db] {
+			delete(errs, db)
+		}
+	}
+}
+
+// Rewrites the database file w/o the versions of entries that no transaction can see any more, if it has any,
+// and rebuilds the database's indexes. Must be called w/ db.mu held for writing
+func (db *Database) collectGarbage() error {
+	if db.oldestExpiry == 0 { // Not known since the database was loaded
+		db.oldestExpiry = math.MaxUint64
+		err := db.scanVersions(func(offset int64, entry entryVersion) error {
+			if expired, committed := committedAt(entry.xmax); committed {
+				db.oldestExpiry = min(db.oldestExpiry, expired)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if db.oldestExpiry > db.gcHorizon() {
+		return nil
+	}
+	err := db.rewriteEntries(func(entry entryVersion) ([]entryVersion, error) {
+		return []entryVersion{entry}, nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return db.setIndexLSNs(db.lsn) // Nothing but the entries' positions changed
+}
+
+// Checks if any version of an entry in the database was made or expired at a timestamp, i.e. if the change w/ that LSN was made
+func (db *Database) hasVersionsFrom(timestamp string) (bool, error) {
+	found := false
+	err := db.scanVersions(func(offset int64, entry entryVersion) error {
+		if entry.xmin == timestamp || entry.xmax == timestamp {
+			found = true
+		}
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGarbageCollectorError(t *testing.T) {
+	interval := GCInterval
+	GCInterval = time.Millisecond
+	t.Cleanup(func() { GCInterval = interval })
+	coll := newTestCollection(t)
+	db := newTestDB(t, coll, "people", []string{"name"}, []string{"alice"}, []string{"bob"})
+
+	// An open transaction keeps the deleted entry's version, until it's rolled back
+	tx, err := coll.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Delete("name = 'bob'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in the way of the temporary file stops the database file being rewritten
+	err = os.Mkdir(db.FilePath+".tmp", 0755)
+	if err == nil {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"1|alice"}) {
+		t.Errorf("got rows %q after garbage collection failed, want alice's", got)
+	}
+
+	// Passes that skip the database while it's in use don't hide the failure
+	db.mu.RLock()
+	time.Sleep(50 * time.Millisecond)
+	err = coll.Close()
+	db.mu.RUnlock()
+	if err == nil {
+		t.Error("close succeeded after garbage collection failed, want an error")
+	}
+}
+
+func TestIndexesSeeSnapshot(t *testing.T) {
+	for _, kind := range []IndexKind{HASH_INDEX, BTREE_INDEX} {
+		t.Run(kind.String(), func(t *testing.T) {
+			coll := newTestCollection(t)
+			db := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"}, []string{"bob", "20"})
+			err := db.CreateIndex([]string{"age"}, kind, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx, err := coll.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { tx.Rollback() })
+			_, err = db.Update(map[string]string{"age": "21"}, "name = 'bob'")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The index has both of bob's versions, and each sees only the one it can
+			if got := selectRows(t, db, SelectQuery{Condition: "age = 20"}); len(got) != 0 {
+				t.Errorf("got rows %q w/ age = 20 outside the transaction, want none", got)
+			}
+			txDB, err := tx.GetDB("people")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selectRows(t, txDB, SelectQuery{Condition: "age = 20"}); !slices.Equal(got, []string{"2|bob|20"}) {
+				t.Errorf("got rows %q w/ age = 20 in the transaction, want bob's", got)
+			}
+			if got := selectRows(t, txDB, SelectQuery{Condition: "age = 21"}); len(got) != 0 {
+				t.Errorf("got rows %q w/ age = 21 in the transaction, want none", got)
+			}
+		})
+	}
+}
+
+func TestViewSeesVersionsAtMaking(t *testing.T) {
+	coll := newTestCollection(t)
+	db := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"}, []string{"bob", "20"})
+	tx, err := coll.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+	txDB, err := tx.GetDB("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Versions expired in place after a view is made are still seen through it, in the database and in the transaction's copy
+	for _, db := range []*Database{db, txDB} {
+		db.mu.RLock()
+		view, err := db.makeView()
+		db.mu.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = updateBob("21")(db)
+		if err == nil {
+			_, err = db.Delete("name = 'alice'")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0)
+		err = view.readEntries(func(values []string) error {
+			got = append(got, strings.Join(values, "|"))
+			return nil
+		})
+		view.closeView()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, []string{"1|alice|30", "2|bob|20"}) {
+			t.Errorf("got rows %q through a view made before the changes, want them as they were", got)
+		}
+		if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"2|bob|21"}) {
+			t.Errorf("got rows %q after the changes, want bob's new version", got)
+		}
+	}
+}
+
+// Makes changes to a transaction's copy of the people database
+func changeInTx(tx *Tx, changeFn func(db *Database) error) error {
+	db, err := tx.GetDB("people")
+	if err != nil {
+		return err
+	}
+	return changeFn(db)
+}
+
+// Updates bob's age in a database
+func updateBob(age string) func(db *Database) error {
+	return func(db *Database) error {
+		_, err := db.Update(map[string]string{"age": age}, "name = 'bob'")
+		return err
+	}
+}
+
+func TestFirstWriterWins(t *testing.T) {
+	tests := []struct {
+		name         string
+		copiedBefore bool // Whether A gets it's copy of the database before B commits
+	}{
+		{"copied before other commit", true},
+		{"copied after other commit", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coll := newTestCollection(t)
+			db := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"}, []string{"bob", "20"})
+			a, err := coll.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { a.Rollback() })
+			if test.copiedBefore {
+				_, err = a.GetDB("people")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			b, err := coll.Begin()
+			if err == nil {
+				err = changeInTx(b, updateBob("21"))
+			}
+			if err == nil {
+				err = b.Commit()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A's update fails straight away if it can see B's, or when it commits if not
+			err = changeInTx(a, updateBob("22"))
+			if err == nil {
+				err = a.Commit()
+			}
+			if err == nil {
+				t.Error("A's update of an entry B changed succeeded, want an error")
+			}
+			if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"1|alice|30", "2|bob|21"}) {
+				t.Errorf("got rows %q, want B's update", got)
+			}
+		})
+	}
+}
+
+func TestSnapshotRead(t *testing.T) {
+	tests := []struct {
+		name         string
+		copiedBefore bool // Whether A gets it's copy of the database before B commits
+	}{
+		{"copied before other commit", true},
+		{"copied after other commit", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coll := newTestCollection(t)
+			db := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"}, []string{"bob", "20"})
+			a, err := coll.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { a.Rollback() })
+			if test.copiedBefore {
+				_, err = a.GetDB("people")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			b, err := coll.Begin()
+			if err == nil {
+				err = changeInTx(b, updateBob("21"))
+			}
+			if err == nil {
+				err = changeInTx(b, func(db *Database) error { return db.Insert([]string{"name", "age"}, []string{"carol", "50"}) })
+			}
+			if err == nil {
+				err = b.Commit()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := a.Select("people", nil, SelectQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rowStrings(res); !slices.Equal(got, []string{"1|alice|30", "2|bob|20"}) {
+				t.Errorf("A got rows %q after B committed, want them as they were when A began", got)
+			}
+			if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"1|alice|30", "2|bob|21", "3|carol|50"}) {
+				t.Errorf("got rows %q outside the transactions, want B's changes", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/golang_db/internal/utils"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// SelectQuery A query selecting entries from a database
+//
+// FIELDS:
+//
+//	Columns - Columns to return for each matching entry, in the order they should be returned. If nil, all columns are returned
+//		In an aggregate query, these must be group columns, and come before the aggregates. If nil, all group columns are returned
+//	Condition - Condition string entries must match. An empty condition string matches every entry
+//	Aggregates - Aggregates to compute over each group of matching entries. If empty (and GroupBy is too), entries aren't grouped
+//	GroupBy - Columns whose values define the groups. If empty but there are aggregates, all matching entries form one group
+//	Having - Condition string groups must match, referring to result columns (e.g. "count(*) > 1"). Only allowed when grouping
+//	OrderBy - Columns to sort the results by, most significant first. If empty, entries are returned in the order they're stored
+//		In an aggregate query, these refer to result columns
+//	Limit - Maximum number of rows to return. 0 means no limit
+//	Offset - Number of rows to skip before returning any (after sorting)
+type SelectQuery struct {
+	Columns    []string
+	Condition  string
+	Aggregates []Aggregate
+	GroupBy    []string
+	Having     string
+	OrderBy    []OrderTerm
+	Limit      int
+	Offset     int
+}
+
+// OrderTerm A column to sort entries by
+//
+// FIELDS:
+//
+//	Column - Name of the column
+//	Descending - Sort from largest to smallest instead of smallest to largest
+type OrderTerm struct {
+	Column     string
+	Descending bool
+}
+
+// ResultSet Entries returned from a query
+//
+// FIELDS:
+//
+//	Columns - Names of the returned columns
+//	Rows - The returned entries. Each is a slice of strings arranged in the order of Columns
+type ResultSet struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// Makes a comparison function that sorts entries by a list of order terms
+// Values are compared according to their column's type (see compareValues), so e.g. int columns sort numerically
+// Empty cells sort before any other value
+//
+// PARAMS:
+//
+//	orderBy - the order terms
+//	columns - names of the columns entries have, in order
+//	types - map with column names as keys and column types as values
+//
+// RETURNS: function comparing 2 entries, returning -1, 0 or 1 (as in slices.SortFunc)
+func makeEntryComparer(orderBy []OrderTerm, columns []string, types map[string]ColumnType) func(a, b []string) int {
+	idxs := make([]int, len(orderBy))
+	for i, term := range orderBy {
+		idxs[i] = slices.Index(columns, term.Column)
+	}
+
+	return func(a, b []string) int {
+		for i, term := range orderBy {
+			idx := idxs[i]
+			cmp := compareValuesEmptyFirst(a[idx], b[idx], types[term.Column])
+			if term.Descending {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp
+			}
+		}
+		return 0
+	}
+}
+
+// Select Returns selected columns of the entries from a database that match a query's condition,
+// sorted and paginated as the query specifies
+// If the query has aggregates or group columns, the matching entries are grouped and one row is returned per group
+// Indexes are used to find matching entries where possible (see Database.planIndexScan)
+// Sorting and grouping spill to temporary files if the entries don't fit in MemoryBudget, so any size of database can be queried
+// The query runs on a view of the database as it was when the select started, so it doesn't hold up changes, and doesn't see them
+//
+// PARAMS: query - the query (see SelectQuery)
+//
+// RETURNS:
+//
+//	The matching entries, or the aggregated rows
+//	A dbError if an invalid column is requested, grouped by or ordered by, or if we can't read the database file
+//	A ConditionError if the condition or having string is malformed
+func (db *Database) Select(query SelectQuery) (*ResultSet, error) {
+	db.mu.RLock()
+	view, source, err := db.planSelect(&query)
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer view.closeView()
+
+	return runQuery(query, view.Columns, view.Types, source)
+}
+
+// Works out how to read the entries that can match a query, and makes a view of the database to read them from (see makeView)
+// Must be called w/ db.mu held for reading
+//
+// PARAMS: query - the query. If entries will come from an index in order, it's OrderBy is cleared
+//
+// RETURNS: the view, a function that streams the entries from the view, and a dbError or ConditionError as in Select
+func (db *Database) planSelect(query *SelectQuery) (*Database, func(entryFn func(values []string) error) error, error) {
+
+	// If the condition narrows down an indexed column, only the entries the index has for those values can match
+	predicate, err := CompileCondition(query.Condition, db.Columns, db.Types)
+	if err != nil {
+		return nil, nil, err
+	}
+	var offsets []int64
+	scan := db.planIndexScan(predicate, *query)
+	if scan != nil {
+		offsets, err = db.indexScanOffsets(scan)
+		if err != nil {
+			return nil, nil, err
+		}
+		if scan.ordered {
+			query.OrderBy = nil // Entries already come in order
+		}
+	}
+
+	view, err := db.makeView()
+	if err != nil {
+		return nil, nil, err
+	}
+	if scan == nil {
+		return view, view.readEntries, nil
+	}
+	return view, func(entryFn func(values []string) error) error {
+		return view.readEntriesAt(offsets, entryFn)
+	}, nil
+}
+
+// Makes a view of the database: a copy of it that reads the database file as it is now, even once it's been changed,
+// so a query can run on it w/o the database locked. Must be called w/ db.mu held
+// The view sees the same versions of entries as the database (see Database.visible). It has no indexes, and can't be changed
+// It must be closed w/ closeView once it's finished with
+//
+// RETURNS: the view, and a dbError if the database file can't be opened
+func (db *Database) makeView() (*Database, error) {
+	file, err := os.Open(db.FilePath)
+	if err != nil {
+		return nil, &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
+	}
+	return &Database{
+		FilePath: db.FilePath,
+		Columns:  slices.Clone(db.Columns),
+		Types:    maps.Clone(db.Types),
+		readOnly: true,
+		tx:       db.tx,
+		view:     &fileView{file: file, size: info.Size(), lsn: db.lsn, pendingChanges: db.pendingChanges},
+	}, nil
+}
+
+// Closes a view made by makeView
+func (db *Database) closeView() {
+	db.view.file.Close()
+}
+
+// Compares 2 values in the order of a column type, w/ empty values before any others
+func compareValuesEmptyFirst(a string, b string, colType ColumnType) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	case b == "":
+		return 1
+	default:
+		return compareValues(a, b, colType)
+	}
+}
+
+// Runs a select query over a stream of entries
+//
+// PARAMS:
+//
+//	query - the query (see SelectQuery)
+//	columns - names of the columns the entries have, in order
+//	types - map with column names as keys and column types as values
+//	source - streams the entries to query, stopping and returning the error if the callback returns one
+//
+// RETURNS: as in Database.Select
+func runQuery(query SelectQuery, columns []string, types map[string]ColumnType,
+	source func(entryFn func(values []string) error) error) (*ResultSet, error) {
+
+	if query.Limit < 0 || query.Offset < 0 {
+		return nil, &dbError{"Limit and offset can't be negative"}
+	}
+
+	// Compile condition once up front, rather than for every entry
+	predicate, err := CompileCondition(query.Condition, columns, types)
+	if err != nil {
+		return nil, err
+	}
+	matching := func(entryFn func(values []string) error) error {
+		return source(func(values []string) error {
+			if !predicate.Eval(values) {
+				return nil
+			}
+			return entryFn(values)
+		})
+	}
+
+	if len(query.Aggregates) > 0 || len(query.GroupBy) > 0 {
+		return runAggregateQuery(query, columns, types, matching)
+	}
+	if query.Having != "" {
+		return nil, &dbError{"Having can only be used in queries w/ aggregates or group by"}
+	}
+
+	selectedColumns := query.Columns
+	if selectedColumns == nil {
+		selectedColumns = columns
+	}
+
+	// Invalid column(s) requested
+	columnsValid, invalidCol := utils.IsSubset(selectedColumns, columns)
+	if !columnsValid {
+		return nil, &dbError{fmt.Sprintf("Column '%s' does not exist in database", invalidCol)}
+	}
+
+	// Positions of the requested columns in the entries
+	columnIdxs := make([]int, len(selectedColumns))
+	for i, col := range selectedColumns {
+		columnIdxs[i] = slices.Index(columns, col)
+	}
+
+	res := &ResultSet{Columns: selectedColumns, Rows: make([][]string, 0, 10)}
+	err = paginate(query, columns, types, matching, func(values []string) {
+		// Pick out only the requested columns
+		selected := make([]string, len(selectedColumns))
+		for i, idx := range columnIdxs {
+			selected[i] = values[idx]
+		}
+		res.Rows = append(res.Rows, selected)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Runs a select query that has aggregates or group columns over a stream of entries
+// The entries are grouped and aggregated, then the having condition, order terms and pagination apply to the aggregated rows
+//
+// PARAMS:
+//
+//	query - the query (see SelectQuery)
+//	columns - names of the columns the entries have, in order
+//	types - map with column names as keys and column types as values
+//	matching - streams the entries that match the query's condition
+//
+// RETURNS: as in Database.Select
+func runAggregateQuery(query SelectQuery, columns []string, types map[string]ColumnType,
+	matching func(entryFn func(values []string) error) error) (*ResultSet, error) {
+
+	outColumns, resultColumns, resultTypes, err := aggregateResultColumns(query, columns, types)
+	if err != nil {
+		return nil, err
+	}
+	having, err := CompileCondition(query.Having, resultColumns, resultTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Aggregated rows that pass the having condition are streamed on to pagination
+	groups := func(rowFn func(row []string) error) error {
+		return aggregateEntries(query.GroupBy, outColumns, query.Aggregates, columns, types, matching, func(row []string) error {
+			if !having.Eval(row) {
+				return nil
+			}
+			return rowFn(row)
+		})
+	}
+
+	res := &ResultSet{Columns: resultColumns, Rows: make([][]string, 0, 10)}
+	err = paginate(query, resultColumns, resultTypes, groups, func(row []string) {
+		res.Rows = append(res.Rows, row)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Sorts a stream of entries by a query's order terms, then passes the ones within the query's offset and limit to a callback
+// Unsorted entries are passed straight through, so a limit stops reading the source early
+//
+// PARAMS:
+//
+//	query - the query, giving the order terms, offset and limit
+//	columns - names of the columns the entries have, in order
+//	types - map with column names as keys and column types as values
+//	source - streams the entries
+//	emit - called w/ each entry to be returned, in order
+//
+// RETURNS: a dbError if an order term's column doesn't exist, or any error from the source
+func paginate(query SelectQuery, columns []string, types map[string]ColumnType,
+	source func(entryFn func(values []string) error) error, emit func(values []string)) error {
+
+	for _, term := range query.OrderBy {
+		if !slices.Contains(columns, term.Column) {
+			return &dbError{fmt.Sprintf("Can't order by column '%s', it does not exist", term.Column)}
+		}
+	}
+
+	// Emits an entry once the offset has been skipped past, until the limit is reached
+	skipped, emitted := 0, 0
+	paginated := func(values []string) error {
+		if skipped < query.Offset {
+			skipped++
+			return nil
+		}
+
+		emit(values)
+		emitted++
+		if query.Limit > 0 && emitted >= query.Limit {
+			return errStopScan
+		}
+		return nil
+	}
+
+	var err error
+	if len(query.OrderBy) == 0 {
+		// Entries can be returned straight from the source
+		err = source(paginated)
+	} else {
+		// All entries must be sorted before any can be returned
+		sorter := newExternalSorter(makeEntryComparer(query.OrderBy, columns, types))
+		defer sorter.cleanup()
+		err = source(sorter.add)
+		if err == nil {
+			err = sorter.sorted(paginated)
+		}
+	}
+
+	if err != nil && err != errStopScan {
+		return err
+	}
+	return nil
+}
+
+// ParseOrderBy Parses a comma-seperated list of order terms, e.g. "age desc, name"
+// Each term is a column name, optionally followed by 'asc' or 'desc' (case-insensitive). Terms are ascending by default
+// Column names may contain spaces, so aggregate result columns such as 'count(distinct city)' can be ordered by
+//
+// PARAMS: orderByStr - the list of order terms
+//
+// RETURNS:
+//
+//	the order terms
+//	a dbError if a term is malformed
+func ParseOrderBy(orderByStr string) ([]OrderTerm, error) {
+	terms := make([]OrderTerm, 0, 2)
+	for _, termStr := range strings.Split(orderByStr, ",") {
+		words := strings.Fields(termStr)
+		if len(words) == 0 {
+			return nil, &dbError{"Empty order term"}
+		}
+
+		term := OrderTerm{}
+		switch strings.ToLower(words[len(words)-1]) {
+		case "asc":
+			words = words[:len(words)-1]
+		case "desc":
+			term.Descending = true
+			words = words[:len(words)-1]
+		}
+		if len(words) == 0 {
+			return nil, &dbError{fmt.Sprintf("Missing column in order term '%s'", strings.TrimSpace(termStr))}
+		}
+
+		term.Column = strings.Join(words, " ")
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Schema Gets copies of the database's column names (in order) and types, which can be read while the columns are being changed
+//
+// RETURNS:
+//
+//	the names of the database's columns
+//	map with column names as keys and the type of each column as values
+func (db *Database) Schema() ([]string, map[string]ColumnType) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return slices.Clone(db.Columns), maps.Clone(db.Types)
+}
+
+// AddColumn Adds a new column to the end of the database's columns
+// Every existing entry gets an empty cell for the new column
+//
+// PARAMS:
+//
+//	name - name of the new column
+//	colType - type of the new column
+//
+// RETURNS: a dbError if the column already exists, if the database is a transaction's copy, or if we can't rewrite the database's files
+func (db *Database) AddColumn(name string, colType ColumnType) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.checkWritable()
+	if err == nil {
+		err = db.checkNotInTx()
+	}
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return &dbError{"Missing column name"}
+	}
+	if slices.Contains(db.Columns, name) {
+		return &dbError{fmt.Sprintf("Column '%s' already exists in database", name)}
+	}
+
+	record := &walRecord{Op: WAL_ADD_COLUMN, Column: name, Type: colType.String()}
+	err = db.logChange(record)
+	if err != nil {
+		return err
+	}
+	return db.finishChange(record, db.applyAddColumn(name, colType))
+}
+
+// Rewrites the database file w/ a new column at the end, and rebuilds the database's indexes
+func (db *Database) applyAddColumn(name string, colType ColumnType) error {
+	columns := append(slices.Clone(db.Columns), name)
+	err := db.rewriteWithColumns(columns, func(values []string) ([]string, error) {
+		return append(values, ""), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.Columns = columns
+	db.Types[name] = colType
+	return db.buildIndexes(db.indexes...) // Entries have moved
+}
+
+// DropColumn Removes a column, and every entry's value for it, from the database
+// The id column can't be dropped
+//
+// PARAMS: name - name of the column to drop
+//
+// RETURNS: a dbError if the column doesn't exist or is the id column, if the database is a transaction's copy,
+// or if we can't rewrite the database's files
+func (db *Database) DropColumn(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.checkWritable()
+	if err == nil {
+		err = db.checkNotInTx()
+	}
+	if err != nil {
+		return err
+	}
+
+	idx := slices.Index(db.Columns, name)
+	switch {
+	case idx == -1:
+		return &dbError{fmt.Sprintf("Column '%s' does not exist in database", name)}
+	case name == "id":
+		return &dbError{"The id column can't be dropped"}
+	}
+
+	record := &walRecord{Op: WAL_DROP_COLUMN, Column: name}
+	err = db.logChange(record)
+	if err != nil {
+		return err
+	}
+	return db.finishChange(record, db.applyDropColumn(name))
+}
+
+// Drops the indexes on a column and rewrites the database file w/o the column, then rebuilds the remaining indexes
+func (db *Database) applyDropColumn(name string) error {
+	err := db.dropIndexes(name)
+	if err != nil {
+		return err
+	}
+
+	idx := slices.Index(db.Columns, name)
+	columns := slices.Delete(slices.Clone(db.Columns), idx, idx+1)
+	err = db.rewriteWithColumns(columns, func(values []string) ([]string, error) {
+		return slices.Delete(values, idx, idx+1), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.Columns = columns
+	delete(db.Types, name)
+	return db.buildIndexes(db.indexes...) // Entries have moved
+}
+
+// RenameColumn Renames one of the database's columns. Entries' values are unchanged
+// The id column can't be renamed
+//
+// PARAMS:
+//
+//	oldName - current name of the column
+//	newName - name to give the column
+//
+// RETURNS: a dbError if the old column doesn't exist or is the id column, if the new name is taken, if the database is a transaction's copy,
+// or if we can't rewrite the database's files
+func (db *Database) RenameColumn(oldName string, newName string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.checkWritable()
+	if err == nil {
+		err = db.checkNotInTx()
+	}
+	if err != nil {
+		return err
+	}
+
+	idx := slices.Index(db.Columns, oldName)
+	switch {
+	case idx == -1:
+		return &dbError{fmt.Sprintf("Column '%s' does not exist in database", oldName)}
+	case oldName == "id":
+		return &dbError{"The id column can't be renamed"}
+	case newName == "":
+		return &dbError{"Missing column name"}
+	case slices.Contains(db.Columns, newName):
+		return &dbError{fmt.Sprintf("Column '%s' already exists in database", newName)}
+	}
+
+	record := &walRecord{Op: WAL_RENAME_COLUMN, Column: oldName, NewName: newName}
+	err = db.logChange(record)
+	if err != nil {
+		return err
+	}
+	return db.finishChange(record, db.applyRenameColumn(oldName, newName))
+}
+
+// Rewrites the database file's 1st line w/ a column renamed, then moves the column's indexes and rebuilds the database's indexes
+func (db *Database) applyRenameColumn(oldName string, newName string) error {
+	columns := slices.Clone(db.Columns)
+	columns[slices.Index(columns, oldName)] = newName
+	err := db.rewriteWithColumns(columns, func(values []string) ([]string, error) {
+		return values, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	types := maps.Clone(db.Types)
+	types[newName] = types[oldName]
+	delete(types, oldName)
+	db.Columns = columns
+	db.Types = types
+
+	// Indexes on the column move to it's new name. Entries have moved too (the 1st line of the file has changed length)
+	for _, idx := range db.indexes {
+		if colIdx := slices.Index(idx.columns, oldName); colIdx != -1 {
+			idx.columns = slices.Clone(idx.columns)
+			idx.columns[colIdx] = newName
+		}
+	}
+	err = db.moveIndexFiles()
+	if err != nil {
+		return err
+	}
+	return db.buildIndexes(db.indexes...)
+}
@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"slices"
+)
+
+// MemoryBudget Maximum number of bytes of entry data a single query operation (such as a sort) holds in memory
+// Operations that need more than this spill to temporary files on disk
+// Can be configured w/ the MEMORY_BUDGET variable in the .env file (see LoadCollection)
+var MemoryBudget int64 = 64 * 1024 * 1024
+
+// Returned from a callback to stop reading entries early (e.g. once a select's limit has been reached)
+// This isn't a real error, so is never passed back out of the exported Database methods
+var errStopScan = errors.New("stop scan")
+
+// Rough number of bytes an entry takes up in memory, for keeping track of MemoryBudget
+func entrySize(values []string) int64 {
+	size := int64(24 + 16*len(values)) // Slice header, plus a string header per value
+	for _, value := range values {
+		size += int64(len(value))
+	}
+	return size
+}
+
+// Sorts entries using an external merge sort
+// Entries are buffered in memory until the buffer would go over MemoryBudget, at which point the buffer is sorted
+// and spilled to a temporary file as a 'run'. Once all entries are added, the runs (and whatever is left in the buffer)
+// are merged together, so the sorted entries can be streamed out without ever holding them all in memory.
+// If all entries fit in the budget, nothing is ever written to disk
+//
+// ATTRIBUTES:
+//
+//	compare - Compares 2 entries, returning -1, 0 or 1 (as in slices.SortFunc)
+//	buffer - Entries not yet spilled to a run
+//	bufferSize - Rough size of the buffer in bytes (see entrySize)
+//	runs - Paths of the temporary files holding sorted runs, in the order they were spilled
+type externalSorter struct {
+	compare    func(a, b []string) int
+	buffer     [][]string
+	bufferSize int64
+	runs       []string
+}
+
+func newExternalSorter(compare func(a, b []string) int) *externalSorter {
+	return &externalSorter{compare: compare, buffer: make([][]string, 0, 64)}
+}
+
+// Adds an entry to be sorted, spilling the buffer to a run if it's full
+func (s *externalSorter) add(values []string) error {
+	size := entrySize(values)
+	if s.bufferSize+size > MemoryBudget && len(s.buffer) > 0 {
+		err := s.spill()
+		if err != nil {
+			return err
+		}
+	}
+	s.buffer = append(s.buffer, values)
+	s.bufferSize += size
+	return nil
+}
+
+// Maximum number of runs merged at once. Runs beyond this are merged in several passes (see externalSorter.sorted),
+// so a sort never has more than this many run files open
+const maxMergeFanIn = 32
+
+// Sorts the buffer and writes it to a new run file, emptying the buffer
+func (s *externalSorter) spill() error {
+	slices.SortStableFunc(s.buffer, s.compare)
+
+	path, err := writeRun(func(writer *csv.Writer) error {
+		return writer.WriteAll(s.buffer)
+	})
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, path)
+
+	s.buffer = s.buffer[:0]
+	s.bufferSize = 0
+	return nil
+}
+
+// Writes a new run file w/ a callback
+// The file is removed again if writing fails
+//
+// RETURNS: the path of the run file, and a dbError if it couldn't be written
+func writeRun(writeFn func(writer *csv.Writer) error) (string, error) {
+	file, err := os.CreateTemp("", "golang_db-sort-*.csv")
+	if err != nil {
+		return "", &dbError{"Couldn't create temporary file for sorting"}
+	}
+
+	writer := csv.NewWriter(file)
+	err = writeFn(writer)
+	if err == nil {
+		writer.Flush()
+		err = writer.Error()
+	}
+	closeErr := file.Close()
+	if err != nil || closeErr != nil {
+		os.Remove(file.Name())
+		if _, isDBError := err.(*dbError); isDBError {
+			return "", err
+		}
+		return "", &dbError{"Couldn't write temporary file for sorting"}
+	}
+	return file.Name(), nil
+}
+
+// Passes every added entry to a callback, in sorted order
+// Entries that compare equal come out in the order they were added
+// Stops and returns the error if the callback returns an error
+func (s *externalSorter) sorted(entryFn func(values []string) error) error {
+	slices.SortStableFunc(s.buffer, s.compare)
+
+	// Merge runs in groups until they can all be merged at once w/ the buffer. Groups are consecutive runs,
+	// so runs stay in the order their entries were added
+	for len(s.runs) >= maxMergeFanIn {
+		pending := s.runs
+		s.runs = make([]string, 0, len(pending)/maxMergeFanIn+1)
+		for len(pending) > 0 {
+			group := pending[:min(maxMergeFanIn, len(pending))]
+			path, err := s.mergeRuns(group)
+			if err != nil {
+				s.runs = append(s.runs, pending...) // So cleanup removes them
+				return err
+			}
+			s.runs = append(s.runs, path)
+			pending = pending[len(group):]
+		}
+	}
+
+	sources, err := openRuns(s.runs)
+	if err != nil {
+		return err
+	}
+	buffer := s.buffer
+	sources = append(sources, &mergeSource{next: func() ([]string, error) {
+		if len(buffer) == 0 {
+			return nil, io.EOF
+		}
+		values := buffer[0]
+		buffer = buffer[1:]
+		return values, nil
+	}})
+	return s.merge(sources, entryFn)
+}
+
+// Merges a group of runs into a single new run, removing the group's run files
+// A group of 1 run is left as it is
+//
+// RETURNS: the path of the merged run, and a dbError if the runs couldn't be merged
+func (s *externalSorter) mergeRuns(group []string) (string, error) {
+	if len(group) == 1 {
+		return group[0], nil
+	}
+
+	path, err := writeRun(func(writer *csv.Writer) error {
+		sources, err := openRuns(group)
+		if err != nil {
+			return err
+		}
+		return s.merge(sources, writer.Write)
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, run := range group {
+		os.Remove(run)
+	}
+	return path, nil
+}
+
+// Opens run files to be merged
+//
+// RETURNS: a merge source for each run, in the same order, or a dbError if any couldn't be opened
+func openRuns(runs []string) ([]*mergeSource, error) {
+	sources := make([]*mergeSource, 0, len(runs)+1)
+	for _, path := range runs {
+		file, err := os.Open(path)
+		if err != nil {
+			for _, source := range sources {
+				source.close()
+			}
+			return nil, &dbError{"Couldn't open temporary file for sorting"}
+		}
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		sources = append(sources, &mergeSource{next: reader.Read, file: file})
+	}
+	return sources, nil
+}
+
+// Merges sorted sources, passing each entry to a callback in sorted order
+// Sources are given in the order their entries were added, which is kept for entries that compare equal.
+// Each source is closed as soon as it's used up, and any left are closed if the merge stops early
+func (s *externalSorter) merge(sources []*mergeSource, entryFn func(values []string) error) error {
+	defer func() {
+		for _, source := range sources {
+			source.close()
+		}
+	}()
+
+	// Merge sources w/ a heap holding the next entry from each source
+	merger := &mergeHeap{compare: s.compare}
+	for i, source := range sources {
+		source.index = i
+		err := source.advance()
+		if err != nil {
+			return err
+		}
+		if source.current != nil {
+			merger.sources = append(merger.sources, source)
+		}
+	}
+	heap.Init(merger)
+
+	for merger.Len() > 0 {
+		source := merger.sources[0]
+		err := entryFn(source.current)
+		if err != nil {
+			return err
+		}
+
+		err = source.advance()
+		if err != nil {
+			return err
+		}
+		if source.current == nil {
+			heap.Pop(merger)
+		} else {
+			heap.Fix(merger, 0)
+		}
+	}
+	return nil
+}
+
+// Deletes any run files. Should always be called once the sorter is finished with
+func (s *externalSorter) cleanup() {
+	for _, path := range s.runs {
+		os.Remove(path)
+	}
+	s.runs = nil
+	s.buffer = nil
+}
+
+// A sorted sequence of entries being merged by an externalSorter
+//
+// ATTRIBUTES:
+//
+//	next - Gets the source's next entry, returning io.EOF once there are none left
+//	current - The source's entry at the front of the merge. nil once the source is used up
+//	index - Position of the source in the order entries were added, used to keep the merge stable
+//	file - The run file the source reads from, or nil if it isn't read from a file (or has been closed)
+type mergeSource struct {
+	next    func() ([]string, error)
+	current []string
+	index   int
+	file    *os.File
+}
+
+// Moves the source on to it's next entry, closing it once it's used up
+func (m *mergeSource) advance() error {
+	values, err := m.next()
+	if err == io.EOF {
+		m.current = nil
+		m.close()
+		return nil
+	}
+	if err != nil {
+		return &dbError{"Couldn't read temporary file for sorting"}
+	}
+	m.current = values
+	return nil
+}
+
+// Closes the run file the source reads from, if it hasn't been already
+func (m *mergeSource) close() {
+	if m.file != nil {
+		m.file.Close()
+		m.file = nil
+	}
+}
+
+// Min-heap of merge sources, ordered by their current entries (implements heap.Interface)
+type mergeHeap struct {
+	sources []*mergeSource
+	compare func(a, b []string) int
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	cmp := h.compare(h.sources[i].current, h.sources[j].current)
+	if cmp == 0 {
+		return h.sources[i].index < h.sources[j].index
+	}
+	return cmp < 0
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+
+func (h *mergeHeap) Push(x any) { h.sources = append(h.sources, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() any {
+	n := len(h.sources)
+	res := h.sources[n-1]
+	h.sources = h.sources[:n-1]
+	return res
+}
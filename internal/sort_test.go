@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestExternalSorter(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	budget := MemoryBudget
+	t.Cleanup(func() { MemoryBudget = budget })
+
+	// Entries are sorted by their key, and numbered so the order of equal keys can be checked
+	const numEntries = 5000
+	compare := func(a, b []string) int {
+		keyA, _ := strconv.Atoi(a[0])
+		keyB, _ := strconv.Atoi(b[0])
+		return keyA - keyB
+	}
+
+	tests := []struct {
+		name   string
+		budget int64
+	}{
+		{"in memory", 1 << 20},
+		{"single merge", 32 * 1024},
+		{"several passes", 100}, // About 1 entry per run
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			MemoryBudget = test.budget
+			sorter := newExternalSorter(compare)
+			defer sorter.cleanup()
+			for i := range numEntries {
+				err := sorter.add([]string{strconv.Itoa((i * 7919) % 100), strconv.Itoa(i)})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			count := 0
+			var last []string
+			err := sorter.sorted(func(values []string) error {
+				if last != nil {
+					cmp := compare(last, values)
+					lastSeq, _ := strconv.Atoi(last[1])
+					seq, _ := strconv.Atoi(values[1])
+					if cmp > 0 || (cmp == 0 && lastSeq > seq) {
+						t.Fatalf("%v came out before %v", last, values)
+					}
+				}
+				last = values
+				count++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != numEntries {
+				t.Errorf("got %d entries, want %d", count, numEntries)
+			}
+			if len(sorter.runs) >= maxMergeFanIn {
+				t.Errorf("%d runs left after merging, want fewer than %d", len(sorter.runs), maxMergeFanIn)
+			}
+
+			sorter.cleanup()
+			files, _ := os.ReadDir(os.Getenv("TMPDIR"))
+			if len(files) != 0 {
+				t.Errorf("%d temporary files left after cleanup", len(files))
+			}
+		})
+	}
+}
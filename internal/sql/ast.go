@@ -0,0 +1,152 @@
+package sql
+
+import (
+	"github.com/golang_db/internal"
+)
+
+// Statement A parsed SQL statement, ready to be executed
+// One of *CreateTable, *DropTable, *AlterTable, *Insert, *Select, *Update, *Delete or *Transaction
+type Statement interface {
+	statement()
+}
+
+// CreateTable CREATE TABLE <table> [( <column> [<type>], ... )]
+// Every table gets an id column, so it isn't declared
+//
+// FIELDS:
+//
+//	Table - Name of the database to create
+//	Columns - Definitions of the database's columns, each 'name' or 'name:type' (as accepted by Collection.NewDB)
+type CreateTable struct {
+	Table   string
+	Columns []string
+}
+
+// DropTable DROP TABLE <table>
+//
+// FIELDS: Table - Name of the database to drop
+type DropTable struct {
+	Table string
+}
+
+// AlterAction Alter table action enum
+//
+// RENAME_TABLE - ALTER TABLE <table> RENAME TO <new name>
+// RENAME_COLUMN - ALTER TABLE <table> RENAME [COLUMN] <column> TO <new name>
+// ADD_COLUMN - ALTER TABLE <table> ADD [COLUMN] <column> [<type>]
+// DROP_COLUMN - ALTER TABLE <table> DROP [COLUMN] <column>
+type AlterAction int
+
+const (
+	RENAME_TABLE AlterAction = iota
+	RENAME_COLUMN
+	ADD_COLUMN
+	DROP_COLUMN
+)
+
+// AlterTable ALTER TABLE <table> <action>
+//
+// FIELDS:
+//
+//	Table - Name of the database to alter
+//	Action - What to change
+//	Column - The column being renamed, added or dropped. Empty for RENAME_TABLE
+//	NewName - New name of the table or column, for RENAME_TABLE and RENAME_COLUMN
+//	Type - Type of the column being added, for ADD_COLUMN
+type AlterTable struct {
+	Table   string
+	Action  AlterAction
+	Column  string
+	NewName string
+	Type    internal.ColumnType
+}
+
+// Insert INSERT INTO <table> [( <column>, ... )] VALUES ( <value>, ... ), ...
+//
+// FIELDS:
+//
+//	Table - Name of the database to insert into
+//	Columns - Columns the values are for. nil if no columns were listed,
+//		in which case the values are for every column apart from id (which is assigned automatically)
+//	Rows - Values of each entry to insert. NULL is an empty value
+type Insert struct {
+	Table   string
+	Columns []string
+	Rows    [][]string
+}
+
+// Select SELECT <select list> FROM <table> [[INNER|LEFT] JOIN <table> ON <col> = <col> [AND ...]]...
+// [WHERE <condition>] [GROUP BY <col>, ...] [HAVING <condition>] [ORDER BY <col> [ASC|DESC], ...] [LIMIT <n>] [OFFSET <n>]
+//
+// FIELDS:
+//
+//	From - Name of the first database
+//	Joins - Databases joined onto it. If there are any, column names in the query are qualified (see Collection.Select)
+//	Query - The rest of the query. Its condition strings are passed through as written in the statement (but w/ '<>' written as '!=')
+//	ConditionOffset - Character offset of the WHERE condition in the SQL string, so errors in it can be pointed to
+//	HavingOffset - Character offset of the HAVING condition in the SQL string
+type Select struct {
+	From            string
+	Joins           []internal.Join
+	Query           internal.SelectQuery
+	ConditionOffset int
+	HavingOffset    int
+}
+
+// Update UPDATE <table> SET <column> = <value>, ... [WHERE <condition>]
+//
+// FIELDS:
+//
+//	Table - Name of the database to update
+//	Assignments - New values, keyed by column name
+//	Condition - Condition string entries must match to be updated, as written in the statement (as in Select). Empty if there was no WHERE
+//	ConditionOffset - Character offset of the condition in the SQL string, so errors in it can be pointed to
+type Update struct {
+	Table           string
+	Assignments     map[string]string
+	Condition       string
+	ConditionOffset int
+}
+
+// Delete DELETE FROM <table> [WHERE <condition>]
+//
+// FIELDS:
+//
+//	Table - Name of the database to delete from
+//	Condition - Condition string entries must match to be deleted, as written in the statement (as in Select). Empty if there was no WHERE
+//	ConditionOffset - Character offset of the condition in the SQL string, so errors in it can be pointed to
+type Delete struct {
+	Table           string
+	Condition       string
+	ConditionOffset int
+}
+
+// TransactionAction Transaction control enum
+//
+// BEGIN - BEGIN [TRANSACTION]
+// COMMIT - COMMIT [TRANSACTION]
+// ROLLBACK - ROLLBACK [TRANSACTION]
+type TransactionAction int
+
+const (
+	BEGIN TransactionAction = iota
+	COMMIT
+	ROLLBACK
+)
+
+// Transaction BEGIN, COMMIT or ROLLBACK
+// Statements between a BEGIN and a COMMIT are made all-or-nothing (see internal.Tx)
+//
+// FIELDS: Action - Whether the transaction is being started, committed or rolled back
+type Transaction struct {
+	Action TransactionAction
+}
+
+func (*CreateTable) statement() {}
+func (*DropTable) statement()   {}
+func (*AlterTable) statement()  {}
+func (*Insert) statement()      {}
+func (*Select) statement()      {}
+func (*Update) statement()      {}
+func (*Delete) statement()      {}
+func (*Transaction) statement() {}
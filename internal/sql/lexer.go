@@ -0,0 +1,125 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Token type enum
+//
+// IDENTIFIER - A keyword or an unquoted name, optionally qualified w/ a database name (e.g. SELECT, users, users.name)
+// QUOTED_IDENTIFIER - A name in double quotemarks, which can contain any characters ("first name")
+// STRING - Text in single quotemarks. Quotemarks inside the text are doubled up
+// NUMBER - An unsigned whole or decimal number (30, 2.5)
+// SYMBOL - Punctuation or an operator ( ( ) , ; * = < <= etc.)
+type tokenKind int
+
+const (
+	IDENTIFIER tokenKind = iota
+	QUOTED_IDENTIFIER
+	STRING
+	NUMBER
+	SYMBOL
+)
+
+// A token in a SQL statement
+//
+// ATTRIBUTES:
+//
+//	content - The token's text, as written in the statement
+//	kind - The token's type
+//	pos - Character offset of the start of the token in the statement
+type token struct {
+	content string
+	kind    tokenKind
+	pos     int
+}
+
+// Character offset just past the end of the token in the statement
+func (t token) end() int {
+	return t.pos + len(t.content)
+}
+
+// Regex rule matching a token type (or whitespace, which isn't kept as a token)
+type lexRule struct {
+	kind       tokenKind
+	whitespace bool
+	regex      *regexp.Regexp
+}
+
+// Regex rules for each token type, compiled once up front. Rules are tried in order, first match wins
+var lexRules = []lexRule{
+	{whitespace: true, regex: regexp.MustCompile(`^\s+`)},
+	{kind: STRING, regex: regexp.MustCompile(`^'([^']|'')*'`)},
+	{kind: QUOTED_IDENTIFIER, regex: regexp.MustCompile(`^"([^"]|"")*"`)},
+
+	// Numbers must be tried before identifiers, as they're made up of word characters too
+	{kind: NUMBER, regex: regexp.MustCompile(`^\d+(\.\d+)?\b`)},
+	{kind: IDENTIFIER, regex: regexp.MustCompile(`^\w+(\.\w+)?`)},
+	{kind: SYMBOL, regex: regexp.MustCompile(`^(<=|>=|!=|<>|[-+*/=<>!&|(),;])`)},
+}
+
+// SyntaxError Error type for malformed SQL statements
+//
+// FIELDS:
+//
+//	message - Description of the error
+//	Token - The offending token (empty if the error is at the end of the statement)
+//	Offset - Character offset of the offending token in the statement
+//	Statement - The statement the error is in
+type SyntaxError struct {
+	message   string
+	Token     string
+	Offset    int
+	Statement string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("SQL ERROR: %s AT END OF STATEMENT (CHARACTER %d)", e.message, e.Offset)
+	}
+	return fmt.Sprintf("SQL ERROR: %s AT '%s' (CHARACTER %d)", e.message, e.Token, e.Offset)
+}
+
+// Splits a SQL string into a stream of tokens, dropping whitespace
+// Returns a SyntaxError if part of the string isn't a valid token
+func lex(source string) ([]token, error) {
+	tokens := make([]token, 0, 16)
+	remaining := source
+
+	for len(remaining) > 0 {
+		offset := len(source) - len(remaining)
+		matched := false
+		for _, rule := range lexRules {
+			match := rule.regex.FindString(remaining)
+			if match == "" {
+				continue
+			}
+			if !rule.whitespace {
+				tokens = append(tokens, token{match, rule.kind, offset})
+			}
+			remaining = remaining[len(match):]
+			matched = true
+			break
+		}
+
+		if !matched {
+			switch {
+			case strings.HasPrefix(remaining, "'"):
+				return nil, &SyntaxError{"UNTERMINATED STRING", remaining, offset, source}
+			case strings.HasPrefix(remaining, `"`):
+				return nil, &SyntaxError{"UNTERMINATED NAME", remaining, offset, source}
+			default:
+				return nil, &SyntaxError{"UNRECOGNISED CHARACTER", remaining[:1], offset, source}
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// Removes the quotemarks around a string or quoted identifier, and unescapes doubled quotemarks inside it
+func unquote(quoted string) string {
+	quoteMark := quoted[:1]
+	return strings.ReplaceAll(quoted[1:len(quoted)-1], quoteMark+quoteMark, quoteMark)
+}
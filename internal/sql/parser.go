@@ -0,0 +1,729 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/golang_db/internal"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Recursive descent parser for SQL statements
+// Parses the grammar below, where keywords are case-insensitive:
+//
+//	script      := statement? ( ';' statement? )*
+//	statement   := create | drop | alter | insert | select | update | delete | transaction
+//	create      := CREATE TABLE name [ '(' name [ name ] ( ',' name [ name ] )* ')' ]
+//	drop        := DROP TABLE name
+//	alter       := ALTER TABLE name ( RENAME TO name | RENAME [COLUMN] name TO name
+//	             | ADD [COLUMN] name [ name ] | DROP [COLUMN] name )
+//	insert      := INSERT INTO name [ '(' name ( ',' name )* ')' ] VALUES row ( ',' row )*
+//	row         := '(' value ( ',' value )* ')'
+//	select      := SELECT selectList FROM name join* [ WHERE condition ] [ GROUP BY name ( ',' name )* ]
+//	               [ HAVING condition ] [ ORDER BY orderTerm ( ',' orderTerm )* ] [ LIMIT NUMBER ] [ OFFSET NUMBER ]
+//	selectList  := '*' | selectItem ( ',' selectItem )*
+//	selectItem  := name | name '(' ... ')'    (an aggregate, see internal.ParseAggregate)
+//	join        := [ INNER | LEFT [OUTER] ] JOIN name ON name '=' name ( AND name '=' name )*
+//	orderTerm   := selectItem [ ASC | DESC ]
+//	update      := UPDATE name SET name '=' value ( ',' name '=' value )* [ WHERE condition ]
+//	delete      := DELETE FROM name [ WHERE condition ]
+//	transaction := ( BEGIN | COMMIT | ROLLBACK ) [ TRANSACTION ]
+//	value       := STRING | [ '-' ] NUMBER | TRUE | FALSE | NULL
+//	name        := IDENTIFIER | QUOTED_IDENTIFIER
+//
+// Conditions aren't parsed here. Everything from WHERE or HAVING up to the next clause is passed on as a condition string,
+// to be compiled by internal.CompileCondition
+//
+// ATTRIBUTES:
+//
+//	tokens - The token stream being parsed
+//	pos - Index of the next token to be parsed
+//	source - The SQL string the tokens came from
+type parser struct {
+	tokens []token
+	pos    int
+	source string
+}
+
+// Parse Parses a string of one or more SQL statements, seperated by semicolons
+//
+// PARAMS: source - the SQL string
+//
+// RETURNS:
+//
+//	the statements, in order
+//	a SyntaxError if the string isn't valid SQL (see parser for the grammar accepted)
+func Parse(source string) ([]Statement, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, source: source}
+	statements := make([]Statement, 0, 1)
+	for p.peek() != nil {
+		if p.acceptSymbol(";") {
+			continue // Empty statement
+		}
+
+		statement, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+
+		if p.peek() != nil && !p.acceptSymbol(";") {
+			return nil, p.errorAtNext("EXPECTED ';'")
+		}
+	}
+	return statements, nil
+}
+
+// Gets the next token without consuming it
+// Returns nil if all tokens have been consumed
+func (p *parser) peek() *token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+// Makes a SyntaxError pointing at the next token (or the end of the statement, if there are no tokens left)
+func (p *parser) errorAtNext(message string) *SyntaxError {
+	next := p.peek()
+	if next == nil {
+		return &SyntaxError{message, "", len(p.source), p.source}
+	}
+	return &SyntaxError{message, next.content, next.pos, p.source}
+}
+
+// Checks if a token is a keyword
+func isKeyword(t *token, keyword string) bool {
+	return t != nil && t.kind == IDENTIFIER && strings.EqualFold(t.content, keyword)
+}
+
+// Consumes the next token if it is a keyword
+func (p *parser) acceptKeyword(keyword string) bool {
+	if isKeyword(p.peek(), keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Consumes the next token if it is a keyword, otherwise returns a SyntaxError
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return p.errorAtNext(fmt.Sprintf("EXPECTED '%s'", strings.ToUpper(keyword)))
+	}
+	return nil
+}
+
+// Consumes the next token if it is a symbol
+func (p *parser) acceptSymbol(symbol string) bool {
+	next := p.peek()
+	if next != nil && next.kind == SYMBOL && next.content == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Consumes the next token if it is a symbol, otherwise returns a SyntaxError
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.errorAtNext(fmt.Sprintf("EXPECTED '%s'", symbol))
+	}
+	return nil
+}
+
+// Parses a name (of a table, column or type), unquoting it if it's quoted
+//
+// PARAMS: what - what the name is of, for the error message if there's no name
+func (p *parser) parseName(what string) (string, error) {
+	next := p.peek()
+	switch {
+	case next != nil && next.kind == IDENTIFIER:
+		p.pos++
+		return next.content, nil
+	case next != nil && next.kind == QUOTED_IDENTIFIER:
+		p.pos++
+		return unquote(next.content), nil
+	default:
+		return "", p.errorAtNext(fmt.Sprintf("EXPECTED %s NAME", strings.ToUpper(what)))
+	}
+}
+
+// Checks if the next token is an identifier that could be a name, rather than punctuation or the end of the statement
+func (p *parser) atName() bool {
+	next := p.peek()
+	return next != nil && (next.kind == IDENTIFIER || next.kind == QUOTED_IDENTIFIER)
+}
+
+func (p *parser) parseStatement() (Statement, error) {
+	next := p.peek()
+	switch {
+	case isKeyword(next, "create"):
+		return p.parseCreate()
+	case isKeyword(next, "drop"):
+		return p.parseDrop()
+	case isKeyword(next, "alter"):
+		return p.parseAlter()
+	case isKeyword(next, "insert"):
+		return p.parseInsert()
+	case isKeyword(next, "select"):
+		return p.parseSelect()
+	case isKeyword(next, "update"):
+		return p.parseUpdate()
+	case isKeyword(next, "delete"):
+		return p.parseDelete()
+	case isKeyword(next, "begin"), isKeyword(next, "commit"), isKeyword(next, "rollback"):
+		return p.parseTransaction()
+	default:
+		return nil, p.errorAtNext("EXPECTED STATEMENT")
+	}
+}
+
+func (p *parser) parseCreate() (Statement, error) {
+	p.pos++ // CREATE
+	err := p.expectKeyword("table")
+	if err != nil {
+		return nil, err
+	}
+	table, err := p.parseName("table")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CreateTable{Table: table, Columns: make([]string, 0, 5)}
+	if !p.acceptSymbol("(") {
+		return res, nil
+	}
+	for {
+		column, err := p.parseName("column")
+		if err != nil {
+			return nil, err
+		}
+		def := column
+		if p.atName() {
+			colType, err := p.parseType()
+			if err != nil {
+				return nil, err
+			}
+			def = fmt.Sprintf("%s:%s", column, colType)
+		}
+		res.Columns = append(res.Columns, def)
+
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return res, p.expectSymbol(")")
+}
+
+// Parses the name of a column type
+func (p *parser) parseType() (internal.ColumnType, error) {
+	typeToken := p.peek()
+	typeName, err := p.parseName("type")
+	if err != nil {
+		return internal.TEXT, err
+	}
+	colType, err := internal.ParseColumnType(typeName)
+	if err != nil {
+		return internal.TEXT, &SyntaxError{"UNKNOWN COLUMN TYPE", typeToken.content, typeToken.pos, p.source}
+	}
+	return colType, nil
+}
+
+func (p *parser) parseDrop() (Statement, error) {
+	p.pos++ // DROP
+	err := p.expectKeyword("table")
+	if err != nil {
+		return nil, err
+	}
+	table, err := p.parseName("table")
+	if err != nil {
+		return nil, err
+	}
+	return &DropTable{table}, nil
+}
+
+func (p *parser) parseAlter() (Statement, error) {
+	p.pos++ // ALTER
+	err := p.expectKeyword("table")
+	if err != nil {
+		return nil, err
+	}
+	table, err := p.parseName("table")
+	if err != nil {
+		return nil, err
+	}
+	res := &AlterTable{Table: table}
+
+	switch {
+	case p.acceptKeyword("rename"):
+		if p.acceptKeyword("to") {
+			res.Action = RENAME_TABLE
+		} else {
+			res.Action = RENAME_COLUMN
+			p.acceptKeyword("column")
+			res.Column, err = p.parseName("column")
+			if err != nil {
+				return nil, err
+			}
+			err = p.expectKeyword("to")
+			if err != nil {
+				return nil, err
+			}
+		}
+		res.NewName, err = p.parseName("new")
+		return res, err
+
+	case p.acceptKeyword("add"):
+		res.Action = ADD_COLUMN
+		p.acceptKeyword("column")
+		res.Column, err = p.parseName("column")
+		if err != nil {
+			return nil, err
+		}
+		if p.atName() {
+			res.Type, err = p.parseType()
+		}
+		return res, err
+
+	case p.acceptKeyword("drop"):
+		res.Action = DROP_COLUMN
+		p.acceptKeyword("column")
+		res.Column, err = p.parseName("column")
+		return res, err
+
+	default:
+		return nil, p.errorAtNext("EXPECTED 'RENAME', 'ADD' OR 'DROP'")
+	}
+}
+
+func (p *parser) parseInsert() (Statement, error) {
+	p.pos++ // INSERT
+	err := p.expectKeyword("into")
+	if err != nil {
+		return nil, err
+	}
+	table, err := p.parseName("table")
+	if err != nil {
+		return nil, err
+	}
+	res := &Insert{Table: table, Rows: make([][]string, 0, 1)}
+
+	if p.acceptSymbol("(") {
+		res.Columns, err = p.parseNameList("column")
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectSymbol(")")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.expectKeyword("values")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = p.expectSymbol("(")
+		if err != nil {
+			return nil, err
+		}
+		row := make([]string, 0, 5)
+		for {
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, value)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		err = p.expectSymbol(")")
+		if err != nil {
+			return nil, err
+		}
+		res.Rows = append(res.Rows, row)
+
+		if !p.acceptSymbol(",") {
+			return res, nil
+		}
+	}
+}
+
+// Parses a comma-seperated list of names
+func (p *parser) parseNameList(what string) ([]string, error) {
+	names := make([]string, 0, 5)
+	for {
+		name, err := p.parseName(what)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.acceptSymbol(",") {
+			return names, nil
+		}
+	}
+}
+
+// Parses a literal value. NULL gives an empty value
+func (p *parser) parseValue() (string, error) {
+	next := p.peek()
+	switch {
+	case next == nil:
+		return "", p.errorAtNext("EXPECTED VALUE")
+	case next.kind == STRING:
+		p.pos++
+		return unquote(next.content), nil
+	case next.kind == NUMBER:
+		p.pos++
+		return next.content, nil
+	case next.kind == SYMBOL && next.content == "-":
+		p.pos++
+		number := p.peek()
+		if number == nil || number.kind != NUMBER {
+			return "", p.errorAtNext("EXPECTED NUMBER")
+		}
+		p.pos++
+		return "-" + number.content, nil
+	case isKeyword(next, "true"), isKeyword(next, "false"):
+		p.pos++
+		return strings.ToLower(next.content), nil
+	case isKeyword(next, "null"):
+		p.pos++
+		return "", nil
+	default:
+		return "", p.errorAtNext("EXPECTED VALUE")
+	}
+}
+
+func (p *parser) parseSelect() (Statement, error) {
+	p.pos++ // SELECT
+	res := &Select{}
+
+	// Select list. Aggregates' results always come after the columns (see internal.SelectQuery)
+	if !p.acceptSymbol("*") { // nil columns selects all columns
+		res.Query.Columns = make([]string, 0, 5)
+		for {
+			column, aggregate, isAggregate, err := p.parseSelectItem()
+			switch {
+			case err != nil:
+				return nil, err
+			case isAggregate:
+				res.Query.Aggregates = append(res.Query.Aggregates, aggregate)
+			default:
+				res.Query.Columns = append(res.Query.Columns, column)
+			}
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	err := p.expectKeyword("from")
+	if err != nil {
+		return nil, err
+	}
+	res.From, err = p.parseName("table")
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		join, found, err := p.parseJoin()
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			break
+		}
+		res.Joins = append(res.Joins, join)
+	}
+
+	if p.acceptKeyword("where") {
+		res.Query.Condition, res.ConditionOffset, err = p.parseConditionString("group", "having", "order", "limit", "offset")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("group") {
+		err = p.expectKeyword("by")
+		if err != nil {
+			return nil, err
+		}
+		res.Query.GroupBy, err = p.parseNameList("column")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("having") {
+		res.Query.Having, res.HavingOffset, err = p.parseConditionString("order", "limit", "offset")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("order") {
+		err = p.expectKeyword("by")
+		if err != nil {
+			return nil, err
+		}
+		for {
+			item, aggregate, isAggregate, err := p.parseSelectItem()
+			if err != nil {
+				return nil, err
+			}
+			term := internal.OrderTerm{Column: item}
+			if isAggregate {
+				term.Column = aggregate.Label() // Aggregates are ordered by their result column
+			}
+			if p.acceptKeyword("desc") {
+				term.Descending = true
+			} else {
+				p.acceptKeyword("asc")
+			}
+			res.Query.OrderBy = append(res.Query.OrderBy, term)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("limit") {
+		res.Query.Limit, err = p.parseCount(1) // A limit of 0 in a query means no limit, so isn't allowed here
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("offset") {
+		res.Query.Offset, err = p.parseCount(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Parses a join, if there is one next
+//
+// RETURNS:
+//
+//	the join
+//	false if there's no join next, otherwise true
+//	a SyntaxError if the join is malformed
+func (p *parser) parseJoin() (internal.Join, bool, error) {
+	join := internal.Join{Kind: internal.INNER_JOIN}
+	switch {
+	case p.acceptKeyword("inner"):
+	case p.acceptKeyword("left"):
+		join.Kind = internal.LEFT_JOIN
+		p.acceptKeyword("outer")
+	case !isKeyword(p.peek(), "join"):
+		return join, false, nil
+	}
+
+	err := p.expectKeyword("join")
+	if err != nil {
+		return join, false, err
+	}
+	join.DB, err = p.parseName("table")
+	if err != nil {
+		return join, false, err
+	}
+	err = p.expectKeyword("on")
+	if err != nil {
+		return join, false, err
+	}
+
+	for {
+		key := internal.JoinKey{}
+		key.Left, err = p.parseName("column")
+		if err != nil {
+			return join, false, err
+		}
+		err = p.expectSymbol("=")
+		if err != nil {
+			return join, false, err
+		}
+		key.Right, err = p.parseName("column")
+		if err != nil {
+			return join, false, err
+		}
+		join.On = append(join.On, key)
+
+		if !p.acceptKeyword("and") {
+			return join, true, nil
+		}
+	}
+}
+
+// Parses an item of a select list (or an order term without it's direction): either a column name or an aggregate
+//
+// RETURNS:
+//
+//	the column name, if the item is a column
+//	the aggregate, if the item is an aggregate
+//	whether the item is an aggregate
+//	a SyntaxError if the item is malformed
+func (p *parser) parseSelectItem() (string, internal.Aggregate, bool, error) {
+	nameToken := p.peek()
+	name, err := p.parseName("column")
+	if err != nil {
+		return "", internal.Aggregate{}, false, err
+	}
+	if nameToken.kind == QUOTED_IDENTIFIER || !p.acceptSymbol("(") {
+		return name, internal.Aggregate{}, false, nil
+	}
+
+	// Aggregate: find the closing bracket, then parse the whole call
+	depth := 1
+	for depth > 0 {
+		next := p.peek()
+		switch {
+		case next == nil:
+			return "", internal.Aggregate{}, false, p.errorAtNext("EXPECTED ')'")
+		case next.kind == SYMBOL && next.content == "(":
+			depth++
+		case next.kind == SYMBOL && next.content == ")":
+			depth--
+		}
+		p.pos++
+	}
+
+	call := p.source[nameToken.pos:p.tokens[p.pos-1].end()]
+	aggregate, isAggregate, err := internal.ParseAggregate(call)
+	if err != nil || !isAggregate {
+		return "", internal.Aggregate{}, false, &SyntaxError{"INVALID AGGREGATE", call, nameToken.pos, p.source}
+	}
+	return "", aggregate, true, nil
+}
+
+// Takes the tokens up to the next of a set of keywords (or a semicolon, or the end of the statement),
+// and returns the part of the statement they span as a condition string
+// Keywords inside brackets don't end the condition. SQL's '<>' is written as '!=', which conditions use instead
+//
+// PARAMS: stopKeywords - keywords that start the clauses that could follow the condition
+//
+// RETURNS:
+//
+//	the condition string
+//	character offset of the condition in the SQL string
+//	a SyntaxError if there's no condition
+func (p *parser) parseConditionString(stopKeywords ...string) (string, int, error) {
+	start := p.pos
+	depth := 0
+	for next := p.peek(); next != nil; next = p.peek() {
+		if depth == 0 && next.kind == SYMBOL && next.content == ";" {
+			break
+		}
+		if depth == 0 && slices.ContainsFunc(stopKeywords, func(keyword string) bool { return isKeyword(next, keyword) }) {
+			break
+		}
+
+		if next.kind == SYMBOL && next.content == "(" {
+			depth++
+		} else if next.kind == SYMBOL && next.content == ")" {
+			depth--
+		}
+		p.pos++
+	}
+
+	if p.pos == start {
+		return "", 0, p.errorAtNext("EXPECTED CONDITION")
+	}
+	offset := p.tokens[start].pos
+	condition := []byte(p.source[offset:p.tokens[p.pos-1].end()])
+	for _, t := range p.tokens[start:p.pos] {
+		if t.kind == SYMBOL && t.content == "<>" {
+			copy(condition[t.pos-offset:], "!=") // Same length, so offsets in the condition match the statement
+		}
+	}
+	return string(condition), offset, nil
+}
+
+// Parses a whole number of at least a minimum value, such as in a LIMIT clause
+func (p *parser) parseCount(min int) (int, error) {
+	next := p.peek()
+	if next == nil || next.kind != NUMBER {
+		return 0, p.errorAtNext("EXPECTED NUMBER")
+	}
+	n, err := strconv.Atoi(next.content)
+	if err != nil || n < min {
+		return 0, p.errorAtNext(fmt.Sprintf("EXPECTED A NUMBER OF AT LEAST %d", min))
+	}
+	p.pos++
+	return n, nil
+}
+
+func (p *parser) parseUpdate() (Statement, error) {
+	p.pos++ // UPDATE
+	table, err := p.parseName("table")
+	if err != nil {
+		return nil, err
+	}
+	err = p.expectKeyword("set")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Update{Table: table, Assignments: make(map[string]string)}
+	for {
+		column, err := p.parseName("column")
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectSymbol("=")
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		res.Assignments[column] = value
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("where") {
+		res.Condition, res.ConditionOffset, err = p.parseConditionString()
+	}
+	return res, err
+}
+
+func (p *parser) parseDelete() (Statement, error) {
+	p.pos++ // DELETE
+	err := p.expectKeyword("from")
+	if err != nil {
+		return nil, err
+	}
+	table, err := p.parseName("table")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Delete{Table: table}
+	if p.acceptKeyword("where") {
+		res.Condition, res.ConditionOffset, err = p.parseConditionString()
+	}
+	return res, err
+}
+
+func (p *parser) parseTransaction() (Statement, error) {
+	res := &Transaction{Action: BEGIN}
+	switch {
+	case p.acceptKeyword("commit"):
+		res.Action = COMMIT
+	case p.acceptKeyword("rollback"):
+		res.Action = ROLLBACK
+	default:
+		p.pos++ // BEGIN
+	}
+	p.acceptKeyword("transaction")
+	return res, nil
+}
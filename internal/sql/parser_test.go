@@ -0,0 +1,121 @@
+package sql
+
+import (
+	"errors"
+	"github.com/golang_db/internal"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []Statement
+	}{
+		{"", []Statement{}},
+		{";;", []Statement{}},
+		{"CREATE TABLE users (name, age int);", []Statement{
+			&CreateTable{"users", []string{"name", "age:int"}},
+		}},
+		{"create table t", []Statement{&CreateTable{"t", []string{}}}},
+		{"DROP TABLE users", []Statement{&DropTable{"users"}}},
+		{"ALTER TABLE users RENAME TO people", []Statement{
+			&AlterTable{Table: "users", Action: RENAME_TABLE, NewName: "people"},
+		}},
+		{"ALTER TABLE users RENAME COLUMN name TO full_name", []Statement{
+			&AlterTable{Table: "users", Action: RENAME_COLUMN, Column: "name", NewName: "full_name"},
+		}},
+		{"ALTER TABLE users ADD age int", []Statement{
+			&AlterTable{Table: "users", Action: ADD_COLUMN, Column: "age", Type: internal.INT},
+		}},
+		{"ALTER TABLE users DROP COLUMN age", []Statement{
+			&AlterTable{Table: "users", Action: DROP_COLUMN, Column: "age"},
+		}},
+		{"INSERT INTO users (name, age) VALUES ('Jane Doe', 30), ('O''Brien', -2)", []Statement{
+			&Insert{"users", []string{"name", "age"}, [][]string{{"Jane Doe", "30"}, {"O'Brien", "-2"}}},
+		}},
+		{"INSERT INTO users VALUES ('a', NULL, TRUE)", []Statement{
+			&Insert{"users", nil, [][]string{{"a", "", "true"}}},
+		}},
+		{"SELECT * FROM users", []Statement{&Select{From: "users"}}},
+		{"SELECT name, age FROM users WHERE age > 30 and name != 'bob' ORDER BY age DESC, name LIMIT 10 OFFSET 5", []Statement{
+			&Select{From: "users", Query: internal.SelectQuery{
+				Columns:   []string{"name", "age"},
+				Condition: "age > 30 and name != 'bob'",
+				OrderBy:   []internal.OrderTerm{{Column: "age", Descending: true}, {Column: "name"}},
+				Limit:     10,
+				Offset:    5,
+			}, ConditionOffset: 34},
+		}},
+		{"SELECT users.name FROM users LEFT OUTER JOIN orders ON orders.uid = users.id AND orders.x = users.x", []Statement{
+			&Select{From: "users",
+				Joins: []internal.Join{{Kind: internal.LEFT_JOIN, DB: "orders", On: []internal.JoinKey{
+					{Left: "orders.uid", Right: "users.id"}, {Left: "orders.x", Right: "users.x"},
+				}}},
+				Query: internal.SelectQuery{Columns: []string{"users.name"}},
+			},
+		}},
+		{"UPDATE users SET age = 31, name = 'x' WHERE id = 1", []Statement{
+			&Update{"users", map[string]string{"age": "31", "name": "x"}, "id = 1", 44},
+		}},
+		{"DELETE FROM users", []Statement{&Delete{Table: "users"}}},
+		{"BEGIN; DELETE FROM users WHERE (a = 1) or b = 2; COMMIT TRANSACTION", []Statement{
+			&Transaction{BEGIN},
+			&Delete{"users", "(a = 1) or b = 2", 31},
+			&Transaction{COMMIT},
+		}},
+		{"rollback", []Statement{&Transaction{ROLLBACK}}},
+		{"SELECT * FROM t WHERE a <> 1 HAVING b <> 2", []Statement{
+			&Select{From: "t", Query: internal.SelectQuery{Condition: "a != 1", Having: "b != 2"}, ConditionOffset: 22, HavingOffset: 36},
+		}},
+		{"DELETE FROM t WHERE a<>'<>'", []Statement{&Delete{"t", "a!='<>'", 20}}},
+	}
+
+	for _, test := range tests {
+		got, err := Parse(test.source)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.source, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		offset int
+		token  string
+	}{
+		{"CREATE users", 7, "users"},
+		{"CREATE TABLE", 12, ""},
+		{"CREATE TABLE t (a,)", 18, ")"},
+		{"DROP TABLE t u", 13, "u"},
+		{"INSERT INTO users VALUES ('a'", 29, ""},
+		{"INSERT INTO users VALUES ('a)", 26, "'a)"},
+		{"SELECT FROM users", 12, "users"}, // FROM is taken as a column name
+		{"SELECT * FROM users WHERE", 25, ""},
+		{"SELECT * FROM users LIMIT x", 26, "x"},
+		{"SELECT * FROM users JOIN orders", 31, ""},
+		{"UPDATE users age = 1", 13, "age"},
+		{"DELETE users", 7, "users"},
+		{"DELETE FROM users WHERE", 23, ""},
+		{"BEGIN; SELEC * FROM users", 7, "SELEC"},
+		{"SELECT * FROM users #", 20, "#"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.source)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) returned %v, want a SyntaxError", test.source, err)
+			continue
+		}
+		if syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+			t.Errorf("Parse(%q) failed at %q (character %d), want %q (character %d): %v",
+				test.source, syntaxErr.Token, syntaxErr.Offset, test.token, test.offset, err)
+		}
+	}
+}
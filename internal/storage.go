@@ -0,0 +1,567 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Version of the format that database files are stored in, recorded in each database's metadata file
+//
+// 0 - Legacy format. Entries are values joined by commas w/ no quoting,
+// so a value containing a comma, quotemark or newline corrupts the file
+// 1 - RFC 4180 CSV. Values are quoted and escaped as needed, so any text can be stored
+// 2 - As 1, but each line holds a version of an entry, w/ the version's timestamps after the entry's values (see entryVersion),
+// and versionColumns after the column names on the 1st line
+// 3 - As 2, but each version's _xmax is padded to xmaxWidth (see formatXmax), so a version can be expired in place
+const currentFileFormat = 3
+
+// Width in bytes of the _xmax field on every line of a database file but the 1st, wide enough for any LSN
+// A version is expired by writing over it's _xmax, which leaves the rest of the file where it is (see Database.expireVersionsAt)
+const xmaxWidth = 20
+
+// Written in the _xmax field of a version that hasn't expired, as a field of only spaces would be quoted
+const unexpiredMark = "-"
+
+// Pads an xmax timestamp (see entryVersion) to xmaxWidth w/ trailing spaces, writing unexpiredMark for a version that hasn't expired
+func formatXmax(timestamp string) string {
+	if timestamp == "" {
+		timestamp = unexpiredMark
+	}
+	return timestamp + strings.Repeat(" ", xmaxWidth-len(timestamp))
+}
+
+// Reads the column names from the 1st line of a database file, leaving off the version columns at the end (see versionColumns)
+//
+// PARAMS: filePath - path to the database's CSV file
+func readColumns(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	columns, err := csv.NewReader(file).Read()
+	if err != nil || len(columns) < len(versionColumns) {
+		return nil, &dbError{fmt.Sprintf("Couldn't read columns from file %s", filePath)}
+	}
+	return columns[:len(columns)-len(versionColumns)], nil
+}
+
+// Writes a file through a CSV writer
+// The file is written to a temporary file first, which then replaces the file at the path via a rename,
+// so the file is never left half-written if something goes wrong midway
+//
+// PARAMS:
+//
+//	path - path to the file to write
+//	writeFn - writes the records of the file to the provided CSV writer
+//
+// RETURNS:
+//
+//	A dbError if we can't write the temporary file or replace the file at the path
+//	Otherwise whatever error writeFn returned (or nil). On any error, the file at the path is left untouched
+func writeFileAtomically(path string, writeFn func(writer *csv.Writer) error) error {
+
+	tmpPath := path + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't create file %s", tmpPath)}
+	}
+	writer := csv.NewWriter(tmpFile)
+
+	err = writeFn(writer)
+
+	// Make sure the new records are actually on disk before the temporary file replaces the file
+	if err == nil {
+		writer.Flush()
+		if writer.Error() != nil || tmpFile.Sync() != nil {
+			err = &dbError{fmt.Sprintf("Couldn't write to file %s", tmpPath)}
+		}
+	}
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return &dbError{fmt.Sprintf("Couldn't replace file %s", path)}
+	}
+	return nil
+}
+
+// Copies a file to a new path, overwriting any file already there
+//
+// PARAMS:
+//
+//	srcPath - path to the file to copy
+//	dstPath - path to copy the file to
+//
+// RETURNS: a dbError if we can't read the file or write the copy
+func copyFile(srcPath string, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open file %s", srcPath)}
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't create file %s", dstPath)}
+	}
+	_, err = io.Copy(dst, src)
+	closeErr := dst.Close()
+	if err != nil || closeErr != nil {
+		return &dbError{fmt.Sprintf("Couldn't write to file %s", dstPath)}
+	}
+	return nil
+}
+
+// Rewrites a database file that is in the legacy format (see currentFileFormat) as RFC 4180 CSV
+// Entries that contained a comma in the legacy format have already been corrupted,
+// so if any line doesn't have one value per column, the migration fails and the file is left as it is
+//
+// PARAMS: filePath - path to the database's CSV file
+func migrateLegacyFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open file %s", filePath)}
+	}
+	defer file.Close()
+
+	return writeFileAtomically(filePath, func(writer *csv.Writer) error {
+		lineScanner := bufio.NewScanner(file)
+		numColumns := -1 // Set once the column names on the 1st line have been read
+		lineNum := 0
+		for lineScanner.Scan() {
+			lineNum++
+			line := lineScanner.Text()
+			if line == "" {
+				continue
+			}
+
+			values := strings.Split(line, ",")
+			if numColumns == -1 {
+				numColumns = len(values)
+			} else if len(values) != numColumns {
+				return &dbError{fmt.Sprintf("Can't migrate file %s: line %d has %d values but there are %d columns", filePath, lineNum, len(values), numColumns)}
+			}
+
+			err := writer.Write(values)
+			if err != nil {
+				return err
+			}
+		}
+
+		if lineScanner.Err() != nil {
+			return &dbError{fmt.Sprintf("Couldn't read file %s", filePath)}
+		}
+		return nil
+	})
+}
+
+// Rewrites a database file that is in format 1 (see currentFileFormat) w/ version columns,
+// as a single version of each entry that was made before any transaction and hasn't expired
+//
+// PARAMS: filePath - path to the database's CSV file
+func addVersionColumns(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open file %s", filePath)}
+	}
+	defer file.Close()
+
+	return writeFileAtomically(filePath, func(writer *csv.Writer) error {
+		reader := csv.NewReader(bufio.NewReader(file))
+		extra := versionColumns // Column names on the 1st line, then timestamps on every other line
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return &dbError{fmt.Sprintf("Can't migrate file %s: it has a malformed entry", filePath)}
+			}
+
+			err = writer.Write(slices.Concat(record, extra))
+			if err != nil {
+				return err
+			}
+			extra = []string{"0", ""}
+		}
+	})
+}
+
+// Rewrites a database file that is in format 2 (see currentFileFormat) w/ each version's _xmax padded to xmaxWidth
+//
+// PARAMS: filePath - path to the database's CSV file
+func padXmaxColumn(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open file %s", filePath)}
+	}
+	defer file.Close()
+
+	return writeFileAtomically(filePath, func(writer *csv.Writer) error {
+		reader := csv.NewReader(bufio.NewReader(file))
+		columnNames := true // The 1st line has column names, rather than a version
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil || len(record) < len(versionColumns) {
+				return &dbError{fmt.Sprintf("Can't migrate file %s: it has a malformed entry", filePath)}
+			}
+
+			if !columnNames {
+				record[len(record)-1] = formatXmax(record[len(record)-1])
+			}
+			err = writer.Write(record)
+			if err != nil {
+				return err
+			}
+			columnNames = false
+		}
+	})
+}
+
+// Opens the database file to be read
+// A view of the database (see Database.view) reads the file as it was when the view was made
+//
+// RETURNS: the file, a function that closes it, and a dbError if it can't be opened
+func (db *Database) openFile() (io.ReadSeeker, func() error, error) {
+	if db.view != nil {
+		return io.NewSectionReader(db.view.file, 0, db.view.size), func() error { return nil }, nil
+	}
+	file, err := os.Open(db.FilePath)
+	if err != nil {
+		return nil, nil, &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
+	}
+	return file, file.Close, nil
+}
+
+// Splits a line of the database file into the version of an entry on it, taking the padding off it's _xmax (see formatXmax)
+func (db *Database) parseVersion(record []string) entryVersion {
+	numColumns := len(db.Columns)
+	xmax := strings.TrimRight(record[numColumns+1], " ")
+	if xmax == unexpiredMark {
+		xmax = ""
+	}
+	return entryVersion{values: record[:numColumns:numColumns], xmin: record[numColumns], xmax: xmax}
+}
+
+// Reads every entry the database can see (see Database.visible) from the database file in order, passing each one to a callback
+// The database file is streamed one entry at a time, so the whole file is never held in memory
+// Stops and returns the error if the callback returns an error
+//
+// PARAMS:
+//
+//	entryFn - called with the values of each entry, in the order of the database's columns
+//
+// RETURNS:
+//
+//	A dbError if we can't read the database file, or if it contains a malformed entry
+//	Otherwise whatever error entryFn returned (or nil)
+func (db *Database) readEntries(entryFn func(values []string) error) error {
+	return db.scanEntries(func(offset int64, values []string) error {
+		return entryFn(values)
+	})
+}
+
+// As readEntries, but also passes the callback the byte offset of each entry in the database file (as used by indexes)
+func (db *Database) scanEntries(entryFn func(offset int64, values []string) error) error {
+	return db.scanVersions(func(offset int64, entry entryVersion) error {
+		if !db.visible(entry) {
+			return nil
+		}
+		return entryFn(offset, entry.values)
+	})
+}
+
+// As scanEntries, but passes the callback every version of every entry in the database file, whether the database can see it or not
+func (db *Database) scanVersions(versionFn func(offset int64, entry entryVersion) error) error {
+
+	// Open db file
+	file, closeFile, err := db.openFile()
+	if err != nil {
+		return err
+	}
+	defer closeFile()
+	reader := csv.NewReader(bufio.NewReader(file))
+	reader.FieldsPerRecord = len(db.Columns) + len(versionColumns)
+
+	// Skip past the column names on the 1st line of the file
+	_, err = reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+
+	for err == nil {
+		offset := reader.InputOffset()
+		var record []string
+		record, err = reader.Read()
+		if err == nil {
+			err = versionFn(offset, db.parseVersion(record))
+		}
+	}
+
+	// Reaching end of file is how the loop is supposed to finish
+	var parseErr *csv.ParseError
+	switch {
+	case err == io.EOF:
+		return nil
+	case errors.As(err, &parseErr):
+		return &dbError{fmt.Sprintf("Malformed entry on line %d of file %s", parseErr.StartLine, db.FilePath)}
+	default:
+		return err
+	}
+}
+
+// Reads the entries at a list of byte offsets in the database file, passing each one the database can see to a callback
+// Stops and returns the error if the callback returns an error
+//
+// PARAMS:
+//
+//	offsets - offsets of the entries to read (e.g. from an index), in the order they should be read
+//	entryFn - called with the values of each entry, in the order of the database's columns
+//
+// RETURNS: as in readEntries
+func (db *Database) readEntriesAt(offsets []int64, entryFn func(values []string) error) error {
+	return db.scanEntriesAt(offsets, func(offset int64, values []string) error {
+		return entryFn(values)
+	})
+}
+
+// As readEntriesAt, but also passes the callback the offset of each entry
+func (db *Database) scanEntriesAt(offsets []int64, entryFn func(offset int64, values []string) error) error {
+	file, closeFile, err := db.openFile()
+	if err != nil {
+		return err
+	}
+	defer closeFile()
+
+	for _, offset := range offsets {
+		_, err = file.Seek(offset, io.SeekStart)
+		if err != nil {
+			return &dbError{fmt.Sprintf("Couldn't read file %s", db.FilePath)}
+		}
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = len(db.Columns) + len(versionColumns)
+		record, err := reader.Read()
+		if err != nil {
+			return &dbError{fmt.Sprintf("Malformed entry at offset %d of file %s", offset, db.FilePath)}
+		}
+
+		entry := db.parseVersion(record)
+		if !db.visible(entry) {
+			continue
+		}
+		err = entryFn(offset, entry.values)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Appends a single version of an entry to the end of the database file
+//
+// PARAMS:
+//
+//	values - values of the entry, in the order of the database's columns
+//	timestamp - timestamp of the change that made the version (see entryVersion)
+//
+// RETURNS:
+//
+//	The byte offset of the new entry in the database file
+//	A dbError if we can't open or write to the database file
+func (db *Database) appendEntry(values []string, timestamp string) (int64, error) {
+	offsets, err := db.appendEntries([][]string{values}, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return offsets[0], nil
+}
+
+// As appendEntry, but appends a version of each of several entries in one write
+// If the write fails, the file is truncated back to where it was, so no version is left half-written
+//
+// RETURNS: the byte offsets of the new entries in the database file, and a dbError as in appendEntry
+func (db *Database) appendEntries(entries [][]string, timestamp string) ([]int64, error) {
+
+	// Open db file
+	file, err := os.OpenFile(db.FilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
+	}
+	defer file.Close()
+
+	// Entries start at what is currently the end of the file
+	info, err := file.Stat()
+	if err != nil {
+		return nil, &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
+	}
+
+	var data bytes.Buffer
+	writer := csv.NewWriter(&data)
+	offsets := make([]int64, len(entries))
+	for i, values := range entries {
+		offsets[i] = info.Size() + int64(data.Len())
+		err = writer.Write(slices.Concat(values, []string{timestamp, formatXmax("")}))
+		if err == nil {
+			writer.Flush()
+			err = writer.Error()
+		}
+		if err != nil {
+			return nil, &dbError{fmt.Sprintf("Couldn't write to file %s", db.FilePath)}
+		}
+	}
+	_, err = file.Write(data.Bytes())
+	if err != nil {
+		file.Truncate(info.Size())
+		return nil, &dbError{fmt.Sprintf("Couldn't write to file %s", db.FilePath)}
+	}
+	return offsets, nil
+}
+
+// Expires the versions of entries at a list of byte offsets in the database file, by writing a timestamp over their _xmax in place
+// _xmax is the last field on the line, and always xmaxWidth bytes wide (see formatXmax), so nothing else in the file moves
+// and indexes stay up to date. A view of the database made before the change still sees the versions (see Database.seesExpiry)
+//
+// PARAMS:
+//
+//	offsets - offsets of the versions, e.g. from scanVersions
+//	timestamp - timestamp of the change that expired them (see entryVersion), or empty to make them unexpired again
+//
+// RETURNS: a dbError if we can't read or write the database file, or a version's _xmax isn't where it should be
+func (db *Database) expireVersionsAt(offsets []int64, timestamp string) error {
+	file, err := os.OpenFile(db.FilePath, os.O_RDWR, 0)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open file %s", db.FilePath)}
+	}
+	defer file.Close()
+
+	xmax := []byte(formatXmax(timestamp))
+	for _, offset := range offsets {
+
+		// The line ends in _xmax then a newline, so it's end is found by reading the version
+		reader := csv.NewReader(io.NewSectionReader(file, offset, math.MaxInt64-offset))
+		reader.FieldsPerRecord = len(db.Columns) + len(versionColumns)
+		record, err := reader.Read()
+		if err != nil || len(record[len(record)-1]) != xmaxWidth {
+			return &dbError{fmt.Sprintf("Malformed entry at offset %d of file %s", offset, db.FilePath)}
+		}
+		_, err = file.WriteAt(xmax, offset+reader.InputOffset()-1-xmaxWidth)
+		if err != nil {
+			return &dbError{fmt.Sprintf("Couldn't write to file %s", db.FilePath)}
+		}
+	}
+	return nil
+}
+
+// Rewrites the database file version-by-version (see entryVersion), then rebuilds the database's indexes
+// The database file is only replaced once every version has been rewritten (see writeFileAtomically)
+// Used by the garbage collector, which reads and writes the whole file (and rebuilds every index) to remove dead versions.
+// Updates and deletes don't move entries, so don't rewrite the file (see Database.applyChange)
+//
+// PARAMS:
+//
+//	rewriteFn - called with each existing version, whether the database can see it or not.
+//	            Returns the versions to write in place of it, e.g. the version expired and a new version of the entry
+//	appended - versions to write after all the existing ones, or nil
+//
+// RETURNS:
+//
+//	A dbError if we can't read the database file or write the temporary file
+//	Otherwise whatever error rewriteFn returned (or nil). On any error, the database file is left untouched
+func (db *Database) rewriteEntries(rewriteFn func(entry entryVersion) ([]entryVersion, error), appended []entryVersion) error {
+	err := db.rewriteVersions(db.Columns, rewriteFn, appended)
+	if err != nil {
+		return err
+	}
+
+	// Entries have moved, so indexes must be rebuilt
+	return db.buildIndexes(db.indexes...)
+}
+
+// Rewrites the database file entry-by-entry under a new set of column names, as when the database's columns are altered
+// Every version of every entry is rewritten, keeping it's timestamps
+// The database's Columns are left as they are, the caller must update them (and rebuild indexes) once the file has been rewritten
+//
+// PARAMS:
+//
+//	columns - column names to write on the 1st line of the new file
+//	rewriteFn - called with the values of each version, in the order of the database's columns. Returns the values to write in place of them,
+//	            in the order of the new columns
+//
+// RETURNS: as in rewriteEntries
+func (db *Database) rewriteWithColumns(columns []string, rewriteFn func(values []string) ([]string, error)) error {
+	return db.rewriteVersions(columns, func(entry entryVersion) ([]entryVersion, error) {
+		values, err := rewriteFn(entry.values)
+		entry.values = values
+		return []entryVersion{entry}, err
+	}, nil)
+}
+
+// Does the work of rewriteEntries and rewriteWithColumns, writing column names on the 1st line of the new file
+// and leaving out versions that no transaction can see any more (see Database.isDead). Indexes aren't rebuilt
+func (db *Database) rewriteVersions(columns []string, rewriteFn func(entry entryVersion) ([]entryVersion, error), appended []entryVersion) error {
+	// Entries will move, so B+tree indexes are out of date until they're rebuilt
+	err := db.setIndexLSNs(changingLSN)
+	if err != nil {
+		return err
+	}
+
+	horizon := db.gcHorizon()
+	oldestExpiry := uint64(math.MaxUint64)
+	write := func(writer *csv.Writer, entry entryVersion) error {
+		if db.isDead(entry, horizon) {
+			return nil
+		}
+		if expired, committed := committedAt(entry.xmax); committed {
+			oldestExpiry = min(oldestExpiry, expired)
+		}
+		return writer.Write(slices.Concat(entry.values, []string{entry.xmin, formatXmax(entry.xmax)}))
+	}
+
+	err = writeFileAtomically(db.FilePath, func(writer *csv.Writer) error {
+
+		// Column names go on 1st line, as in any database file
+		err := writer.Write(slices.Concat(columns, versionColumns))
+		if err != nil {
+			return err
+		}
+
+		err = db.scanVersions(func(offset int64, entry entryVersion) error {
+			newEntries, err := rewriteFn(entry)
+			for _, newEntry := range newEntries {
+				if err == nil {
+					err = write(writer, newEntry)
+				}
+			}
+			return err
+		})
+		for _, entry := range appended {
+			if err == nil {
+				err = write(writer, entry)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	db.oldestExpiry = oldestExpiry
+	return nil
+}
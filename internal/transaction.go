@@ -0,0 +1,493 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of the names of transactions' directories in a collection's directory
+const txDirPrefix = ".tx-"
+
+// Tx A transaction, which groups changes to one or more of a collection's databases so they're made all-or-nothing
+// A transaction sees the collection's databases as they were when it began (it's snapshot), along w/ it's own changes,
+// however they're changed outside it in the meantime (see Database.visible)
+// The 1st time a database is used in the transaction, it's files are copied into the transaction's directory, and every change
+// in the transaction is made to the copy. Committing makes the changes to the collection's databases (see Commit), rolling back just deletes the copies
+// A transaction can be used by several goroutines at once
+//
+// ATTRIBUTES:
+//
+//	coll - The collection the transaction is in
+//	dir - Path to the transaction's directory, inside the collection's directory
+//	snapshot - LSN of the last change the transaction sees, i.e. the last change recorded in the write-ahead log when it began
+//	dbs - map of databases used in the transaction: key is database name, value is the transaction's copy of the database
+//	originals - map of database name to the collection's database that was copied
+//	done - Whether the transaction has been committed or rolled back
+//	mu - Held while the attributes above are being read or changed
+type Tx struct {
+	coll      *Collection
+	dir       string
+	snapshot  uint64
+	dbs       map[string]*Database
+	originals map[string]*Database
+	done      bool
+	mu        sync.Mutex
+}
+
+// Begin Starts a transaction in the collection
+// Versions of entries the transaction can see aren't removed by the garbage collector until it's finished
+// Returns a CollError if the collection is read-only, or a dbError if the transaction's directory can't be made
+func (coll *Collection) Begin() (*Tx, error) {
+	err := coll.checkWritable()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(coll.Path, txDirPrefix+"*")
+	if err != nil {
+		return nil, &dbError{fmt.Sprintf("Couldn't make transaction directory in %s", coll.Path)}
+	}
+	tx := &Tx{
+		coll:      coll,
+		dir:       dir,
+		dbs:       make(map[string]*Database),
+		originals: make(map[string]*Database),
+	}
+
+	// The snapshot is taken and registered together, so versions expired after it can't be removed in between
+	coll.snapshotsMu.Lock()
+	defer coll.snapshotsMu.Unlock()
+	tx.snapshot = coll.wal.lastLSN()
+	coll.snapshots[tx] = tx.snapshot
+	return tx, nil
+}
+
+// Returns a dbError if the transaction has already been committed or rolled back
+func (tx *Tx) checkActive() error {
+	if tx.done {
+		return &dbError{"Transaction has already finished"}
+	}
+	return nil
+}
+
+// GetDB Gets the transaction's copy of a database in the collection by name
+// Changes made to the copy are part of the transaction
+//
+// PARAMS: dbName - name of DB to get
+//
+// RETURNS: a CollError if there is no database of that name in the collection,
+// or a dbError if the transaction has finished or the database's files can't be copied
+func (tx *Tx) GetDB(dbName string) (*Database, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	err := tx.checkActive()
+	if err != nil {
+		return nil, err
+	}
+	if db, found := tx.dbs[dbName]; found {
+		return db, nil
+	}
+	original, err := tx.coll.GetDB(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Indexes are copied after the database file, so they aren't older than it and are loaded as they are
+	// The database can't be changed while it's being copied
+	original.mu.RLock()
+	defer original.mu.RUnlock()
+	for _, path := range original.files() {
+		err = copyFile(path, filepath.Join(tx.dir, filepath.Base(path)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The indexes have every version in the copied file, including versions expired since the transaction began that it can still see
+	db := loadDB(filepath.Join(tx.dir, filepath.Base(original.FilePath)), false)
+	db.tx = tx
+	db.original = original
+	tx.dbs[dbName] = db
+	tx.originals[dbName] = original
+	return db, nil
+}
+
+// Select Runs a select query over one or more databases, as in Collection.Select, but w/ the transaction's copies of the databases
+func (tx *Tx) Select(from string, joins []Join, query SelectQuery) (*ResultSet, error) {
+	return selectJoined(tx.GetDB, from, joins, query)
+}
+
+// Commit Makes the transaction's changes to the collection's databases, all at once
+// The versions of entries the transaction expired are expired in the collection's databases, and the versions it made are added to them,
+// all w/ the LSN of the commit, which is recorded in the write-ahead log first. If we crash part way through,
+// or it can't be made to one of the databases, the rest of the commit is made when the collection is next loaded (see Collection.replay)
+// The first change to an entry wins: if an entry changed in the transaction has been changed outside it since it began, nothing is changed
+// and the transaction is rolled back. It's also rolled back if an entry it made clashes w/ one made outside it since it began
+// Column changes can't be made in a transaction (see Database.checkNotInTx)
+//
+// RETURNS: a dbError if the transaction has finished, it's changes clash w/ changes made outside it (as above),
+// or the commit can't be recorded or made
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	err := tx.checkActive()
+	if err == nil {
+		err = tx.commit()
+	}
+	if err != nil {
+		return err
+	}
+	if tx.coll.wal.full() {
+		return tx.coll.wal.checkpoint()
+	}
+	return nil
+}
+
+// Does the work of Commit, w/ the databases the transaction changed locked so nothing else can change them in the meantime
+// Must be called w/ tx.mu held
+func (tx *Tx) commit() error {
+
+	// Databases are gone through in order of name, so the commit's record doesn't depend on map order
+	changes := make([]versionChange, 0)
+	for _, name := range slices.Sorted(maps.Keys(tx.dbs)) {
+		change, err := tx.dbs[name].txChanges()
+		if err != nil {
+			return err
+		}
+		if len(change.Expired) > 0 || len(change.Inserted) > 0 {
+			change.DB = name
+			changes = append(changes, change)
+		}
+	}
+	if len(changes) == 0 {
+		return tx.finish()
+	}
+
+	originals := make([]*Database, len(changes))
+	for i, change := range changes {
+		originals[i] = tx.originals[change.DB]
+	}
+	tx.coll.mu.RLock()
+	defer tx.coll.mu.RUnlock()
+	unlock := lockDBs(originals, true)
+	defer unlock()
+
+	for i, change := range changes {
+		var err error
+		switch original := originals[i]; {
+		case tx.coll.dbs[change.DB] != original:
+			err = &dbError{fmt.Sprintf("Database '%s' was dropped or renamed outside the transaction, so it has been rolled back", change.DB)}
+		case !slices.Equal(original.Columns, tx.dbs[change.DB].Columns):
+			err = &dbError{fmt.Sprintf("Columns of database '%s' were changed outside the transaction, so it has been rolled back", change.DB)}
+		default:
+			err = original.checkCommit(change)
+		}
+		if err != nil {
+			tx.finish()
+			return err
+		}
+	}
+
+	// A checkpoint can't truncate the commit from the log until it's been made to every database
+	// Each change records where the versions it makes will be appended (see versionChange)
+	for i := range changes {
+		info, err := os.Stat(originals[i].FilePath)
+		if err != nil {
+			tx.finish()
+			return &dbError{fmt.Sprintf("Couldn't open file %s", originals[i].FilePath)}
+		}
+		changes[i].Offset = info.Size()
+	}
+	tx.coll.wal.changes.RLock()
+	defer tx.coll.wal.changes.RUnlock()
+	record := &walRecord{Op: WAL_COMMIT, Changes: changes}
+	err := tx.coll.wal.append(record)
+	if err != nil {
+		return err
+	}
+
+	// The commit is recorded, so from here on it will be finished even if we can't finish it now.
+	// The transaction's snapshot is dropped first, so the versions it expires aren't kept for it
+	// If it can't be made to a database, it's left in the log to be replayed onto that database when the collection is next loaded,
+	// and the log is stopped so nothing can be changed (or truncate the commit from the log) until then
+	tx.dropSnapshot()
+	var commitErr error
+	for i, change := range changes {
+		err = originals[i].applyChange(strconv.FormatUint(record.LSN, 10), change)
+		if err == nil {
+			originals[i].lsn = record.LSN
+			err = originals[i].saveMetadata()
+		}
+		if err != nil && commitErr == nil {
+			log.Printf("Couldn't make commit (LSN %d) to database '%s': %s", record.LSN, change.DB, err)
+			commitErr = &dbError{fmt.Sprintf("Commit couldn't be made to database '%s', so it will be finished when the collection is next loaded. "+
+				"Nothing can be changed in the collection until then", change.DB)}
+			tx.coll.wal.fail(commitErr)
+		}
+	}
+	err = tx.finish()
+	if commitErr != nil {
+		return commitErr
+	}
+	return err
+}
+
+// Rollback Abandons the transaction, deleting it's copies of the databases. The collection's databases are left unchanged
+// Returns a dbError if the transaction has already finished
+func (tx *Tx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	err := tx.checkActive()
+	if err != nil {
+		return err
+	}
+	return tx.finish()
+}
+
+// Marks the transaction as finished, once it's been committed or rolled back, and deletes it's copies of the databases
+// Must be called w/ tx.mu held
+func (tx *Tx) finish() error {
+	tx.done = true
+	tx.dropSnapshot()
+	err := os.RemoveAll(tx.dir)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't delete transaction directory %s", tx.dir)}
+	}
+	return nil
+}
+
+// Removes the transaction's snapshot from the collection's snapshots, so the versions only it could see can be removed
+func (tx *Tx) dropSnapshot() {
+	tx.coll.snapshotsMu.Lock()
+	defer tx.coll.snapshotsMu.Unlock()
+	delete(tx.coll.snapshots, tx)
+}
+
+// Gets the paths of the database's files: it's CSV file, then it's metadata file, then it's index files
+func (db *Database) files() []string {
+	paths := []string{db.FilePath, metadataPath(db.FilePath)}
+	for _, idx := range db.indexes {
+		paths = append(paths, idx.path)
+	}
+	return paths
+}
+
+// Gets the changes made to a transaction's copy of a database, to be made to the collection's database when the transaction commits:
+// the versions the transaction expired, and the versions it made that it hasn't expired again
+func (db *Database) txChanges() (versionChange, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	change := versionChange{}
+	idIdx := slices.Index(db.Columns, "id")
+	err := db.scanVersions(func(offset int64, entry entryVersion) error {
+		switch {
+		case isPending(entry.xmin) && entry.xmax == "":
+			change.Inserted = append(change.Inserted, entry.values)
+		case isPending(entry.xmax) && !isPending(entry.xmin):
+			change.Expired = append(change.Expired, versionRef{ID: entry.values[idIdx], Created: entry.xmin})
+		}
+		return nil
+	})
+	return change, err
+}
+
+// Checks that a transaction's changes can be made to the database, which must be locked for writing
+// Each version the transaction expired must not have been expired since, as the first change to an entry wins.
+// Each version it made can't have the id of an entry inserted outside the transaction, or the same key in a unique index as another entry
+//
+// PARAMS: change - the transaction's changes to the database
+//
+// RETURNS: a dbError saying what clashes
+func (db *Database) checkCommit(change versionChange) error {
+	idIdx := slices.Index(db.Columns, "id")
+	expiredIDs := make(map[string]bool)
+	unexpired := make(map[versionRef]bool)
+	for _, ref := range change.Expired {
+		expiredIDs[ref.ID] = true
+	}
+	err := db.scanVersions(func(offset int64, entry entryVersion) error {
+		ref := versionRef{ID: entry.values[idIdx], Created: entry.xmin}
+		if expiredIDs[ref.ID] && entry.xmax == "" {
+			unexpired[ref] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ref := range change.Expired {
+		if !unexpired[ref] {
+			return &dbError{fmt.Sprintf("Entry with id %s in database '%s' was changed outside the transaction after it began, so it has been rolled back", ref.ID, db.name())}
+		}
+	}
+
+	// Entries the transaction expired are left out, as they're replaced by it's versions of them
+	for _, values := range change.Inserted {
+		id := values[idIdx]
+		if expiredIDs[id] {
+			continue
+		}
+		taken, err := db.idExists(id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return &dbError{fmt.Sprintf("An entry with id %s was inserted into database '%s' outside the transaction, so it has been rolled back", id, db.name())}
+		}
+	}
+	for _, idx := range db.indexes {
+		if !idx.unique {
+			continue
+		}
+		colIdxs := idx.columnIdxs(db.Columns)
+		for _, values := range change.Inserted {
+			key := keyValues(values, colIdxs)
+			if slices.Contains(key, "") {
+				continue
+			}
+			offsets, err := db.lookup(idx, indexKey(key))
+			if err != nil {
+				return err
+			}
+			err = db.readEntriesAt(offsets, func(other []string) error {
+				if !expiredIDs[other[idIdx]] {
+					return duplicateKeyError(idx, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Makes a change to versions of entries in the database: a committed transaction's changes, or an update or delete.
+// The versions the change made are appended to the database file and added to the indexes, then the versions it expired
+// are expired at it's timestamp in place (see expireVersionsAt). Nothing in the file moves, so the indexes aren't rebuilt.
+// Versions that have already been expired are left as they are, so this can be repeated.
+// If the database file can't be changed, it's put back as it was
+//
+// PARAMS:
+//
+//	timestamp - timestamp of the change (see entryVersion)
+//	change - the versions the change expired and made
+func (db *Database) applyChange(timestamp string, change versionChange) error {
+	idIdx := slices.Index(db.Columns, "id")
+	expired := make(map[versionRef]bool)
+	for _, ref := range change.Expired {
+		expired[ref] = true
+	}
+	expiredOffsets := make([]int64, 0, len(change.Expired))
+	err := db.scanVersions(func(offset int64, entry entryVersion) error {
+		if entry.xmax == "" && expired[versionRef{ID: entry.values[idIdx], Created: entry.xmin}] {
+			expiredOffsets = append(expiredOffsets, offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	offsets, err := db.appendEntries(change.Inserted, timestamp)
+	if err != nil {
+		return err
+	}
+	err = db.expireVersionsAt(expiredOffsets, timestamp)
+	if err != nil {
+		db.expireVersionsAt(expiredOffsets, "")
+		if len(offsets) > 0 {
+			os.Truncate(db.FilePath, offsets[0])
+		}
+		return err
+	}
+	if expiredAt, committed := committedAt(timestamp); committed && len(expiredOffsets) > 0 && db.oldestExpiry != 0 {
+		db.oldestExpiry = min(db.oldestExpiry, expiredAt)
+	}
+
+	for i, values := range change.Inserted {
+		if n, err := strconv.Atoi(values[idIdx]); err == nil {
+			db.reserveID(n)
+		}
+		for _, idx := range db.indexes {
+			err = idx.add(indexKey(keyValues(values, idx.columnIdxs(db.Columns))), offsets[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// A hash index's file is out of date if it's older than the database file (see loadIndexes), but expiring versions doesn't change it,
+	// so if no versions were added to it, it's marked as up to date
+	if len(change.Inserted) > 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, idx := range db.indexes {
+		if idx.kind != HASH_INDEX {
+			continue
+		}
+		err = os.Chtimes(idx.path, now, now)
+		if err != nil {
+			return &dbError{fmt.Sprintf("Couldn't write to index file %s", idx.path)}
+		}
+	}
+	return nil
+}
+
+// Replays a change to versions of entries recorded in the write-ahead log onto the database
+// The change may have been made in part, so any versions it appended are cut off the database file, then it's made again
+// Changes recorded before offsets were (see versionChange) rewrote the database file in one go, so they were made
+// if any version in the file was made or expired by them, and are only made if not
+//
+// PARAMS:
+//
+//	lsn - LSN of the change's record
+//	change - the versions the change expired and made
+func (db *Database) replayChange(lsn uint64, change versionChange) error {
+	timestamp := strconv.FormatUint(lsn, 10)
+	if change.Offset == 0 {
+		made, err := db.hasVersionsFrom(timestamp)
+		if err != nil || made {
+			return err
+		}
+	} else {
+		err := os.Truncate(db.FilePath, change.Offset)
+		if err != nil {
+			return &dbError{fmt.Sprintf("Couldn't truncate file %s", db.FilePath)}
+		}
+	}
+	return db.applyChange(timestamp, change)
+}
+
+// Deletes the directories of transactions that were open when we crashed, along w/ their copies of databases
+// Must be called before the collection's databases are loaded
+//
+// PARAMS: collectionPath - path to the collection's directory
+func removeTxDirs(collectionPath string) error {
+	entries, err := os.ReadDir(collectionPath)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't read collection directory %s", collectionPath)}
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), txDirPrefix) {
+			err = os.RemoveAll(filepath.Join(collectionPath, entry.Name()))
+			if err != nil {
+				return &dbError{fmt.Sprintf("Couldn't delete transaction directory %s", entry.Name())}
+			}
+		}
+	}
+	return nil
+}
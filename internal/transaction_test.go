@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUncommittedInsert(t *testing.T) {
+	coll := newTestCollection(t)
+	db := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"})
+	tx, err := coll.Begin()
+	if err == nil {
+		err = changeInTx(tx, func(db *Database) error { return db.Insert([]string{"name", "age"}, []string{"bob", "20"}) })
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The insert is only seen in the transaction until it's committed
+	res, err := tx.Select("people", nil, SelectQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rowStrings(res); !slices.Equal(got, []string{"1|alice|30", "2|bob|20"}) {
+		t.Errorf("got rows %q in the transaction, want alice's and bob's", got)
+	}
+	if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"1|alice|30"}) {
+		t.Errorf("got rows %q outside the transaction, want alice's", got)
+	}
+	other, err := coll.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { other.Rollback() })
+	res, err = other.Select("people", nil, SelectQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rowStrings(res); !slices.Equal(got, []string{"1|alice|30"}) {
+		t.Errorf("got rows %q in another transaction, want alice's", got)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"1|alice|30", "2|bob|20"}) {
+		t.Errorf("got rows %q after commit, want alice's and bob's", got)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	coll := newTestCollection(t)
+	db := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"}, []string{"bob", "20"})
+	err := db.CreateIndex([]string{"age"}, HASH_INDEX, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := readDBFiles(t, db)
+	tx, err := coll.Begin()
+	if err == nil {
+		err = changeInTx(tx, updateBob("21"))
+	}
+	if err == nil {
+		err = changeInTx(tx, func(db *Database) error { return db.Insert([]string{"name", "age"}, []string{"carol", "50"}) })
+	}
+	if err == nil {
+		err = changeInTx(tx, func(db *Database) error {
+			_, err := db.Delete("name = 'alice'")
+			return err
+		})
+	}
+	if err == nil {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readDBFiles(t, db)
+	for i := range before {
+		if !slices.Equal(got[i], before[i]) {
+			t.Errorf("file %d after rollback is\n%s\nwant\n%s", i, got[i], before[i])
+		}
+	}
+	if got := selectRows(t, db, SelectQuery{Condition: "age = 20"}); !slices.Equal(got, []string{"2|bob|20"}) {
+		t.Errorf("got rows %q w/ age = 20 after rollback, want bob's", got)
+	}
+}
+
+func TestCommitAtomic(t *testing.T) {
+	coll := newTestCollection(t)
+	people := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"}, []string{"bob", "20"})
+	pets := newTestDB(t, coll, "pets", []string{"name", "age:int"}, []string{"rex", "3"}, []string{"bob", "5"})
+	before := [][][]byte{readDBFiles(t, people), readDBFiles(t, pets)}
+
+	// Begins a transaction that updates bob in both databases
+	beginUpdate := func(petAge string) *Tx {
+		tx, err := coll.Begin()
+		if err == nil {
+			err = changeInTx(tx, updateBob("21"))
+		}
+		if err == nil {
+			var txPets *Database
+			txPets, err = tx.GetDB("pets")
+			if err == nil {
+				_, err = txPets.Update(map[string]string{"age": petAge}, "name = 'bob'")
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	tx := beginUpdate("6")
+
+	// The pet changed outside the transaction stops the whole commit, so neither database is changed by it
+	_, err := pets.Update(map[string]string{"age": "7"}, "name = 'bob'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before[1] = readDBFiles(t, pets)
+	if tx.Commit() == nil {
+		t.Fatal("commit succeeded after an entry it changed was changed outside it, want an error")
+	}
+	for i, db := range []*Database{people, pets} {
+		if got := readDBFiles(t, db); !slices.Equal(got[0], before[i][0]) {
+			t.Errorf("database file after failed commit is\n%s\nwant\n%s", got[0], before[i][0])
+		}
+	}
+	if got := selectRows(t, people, SelectQuery{}); !slices.Equal(got, []string{"1|alice|30", "2|bob|20"}) {
+		t.Errorf("got people %q after failed commit, want them unchanged", got)
+	}
+
+	// Once nothing clashes, the commit changes both databases
+	err = beginUpdate("8").Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := selectRows(t, people, SelectQuery{}); !slices.Equal(got, []string{"1|alice|30", "2|bob|21"}) {
+		t.Errorf("got people %q after commit, want bob's update", got)
+	}
+	if got := selectRows(t, pets, SelectQuery{}); !slices.Equal(got, []string{"1|rex|3", "2|bob|8"}) {
+		t.Errorf("got pets %q after commit, want bob's update", got)
+	}
+}
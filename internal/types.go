@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ColumnType Column type enum
+//
+// TEXT - Any string. Columns are text unless declared otherwise
+// INT - A whole number
+// FLOAT - A decimal number
+// BOOL - 'true' or 'false'
+// TIMESTAMP - A date, or a date and time. Stored in RFC 3339 format
+type ColumnType int
+
+const (
+	TEXT ColumnType = iota
+	INT
+	FLOAT
+	BOOL
+	TIMESTAMP
+)
+
+// Names of column types, as used in column definitions and metadata files
+var columnTypeNames = map[ColumnType]string{
+	TEXT:      "text",
+	INT:       "int",
+	FLOAT:     "float",
+	BOOL:      "bool",
+	TIMESTAMP: "timestamp",
+}
+
+// Layouts accepted when parsing a timestamp value, tried in order
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func (t ColumnType) String() string {
+	return columnTypeNames[t]
+}
+
+// ParseColumnType Gets the column type with a given name (e.g. 'int')
+// Returns a dbError if there is no column type with that name
+//
+// PARAMS: name - name of the column type (case-insensitive)
+func ParseColumnType(name string) (ColumnType, error) {
+	for colType, typeName := range columnTypeNames {
+		if strings.EqualFold(name, typeName) {
+			return colType, nil
+		}
+	}
+	return TEXT, &dbError{fmt.Sprintf("Unknown column type '%s'", name)}
+}
+
+// Parses a column definition of the form 'name' or 'name:type'
+// Columns defined without a type are text columns
+//
+// PARAMS: def - the column definition
+//
+// RETURNS:
+//
+//	column name
+//	column type
+//	dbError if the definition has no name or an unknown type
+func parseColumnDef(def string) (string, ColumnType, error) {
+	name, typeName, hasType := strings.Cut(def, ":")
+	if name == "" {
+		return "", TEXT, &dbError{fmt.Sprintf("Missing column name in definition '%s'", def)}
+	}
+	if !hasType {
+		return name, TEXT, nil
+	}
+
+	colType, err := ParseColumnType(typeName)
+	if err != nil {
+		return "", TEXT, err
+	}
+	return name, colType, nil
+}
+
+// Parses a timestamp value in any of the accepted layouts (see timestampLayouts)
+func parseTimestamp(value string) (time.Time, error) {
+	var err error
+	for _, layout := range timestampLayouts {
+		var t time.Time
+		t, err = time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// Checks that a value is valid for a column type and converts it to the type's canonical form
+// e.g. '007' becomes '7' for an int column, 'TRUE' becomes 'true' for a bool column
+// The empty string is valid for every type, and represents an empty cell
+//
+// PARAMS:
+//
+//	value - the value to check
+//	colType - the type of the column the value is for
+//
+// RETURNS:
+//
+//	the value in it's canonical form
+//	error if the value doesn't parse as the type
+func normaliseValue(value string, colType ColumnType) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch colType {
+	case INT:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(n, 10), nil
+
+	case FLOAT:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+
+	case BOOL:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(b), nil
+
+	case TIMESTAMP:
+		t, err := parseTimestamp(value)
+		if err != nil {
+			return "", err
+		}
+		return t.Format(time.RFC3339Nano), nil
+
+	default:
+		return value, nil
+	}
+}
+
+// Compares two values as values of a column type
+// If either value doesn't parse as the type (e.g. an empty cell), they are compared as text instead
+//
+// PARAMS:
+//
+//	a, b - the values to compare
+//	colType - the type to compare the values as
+//
+// RETURNS: -1 if a < b, 0 if a == b, 1 if a > b
+func compareValues(a string, b string, colType ColumnType) int {
+	switch colType {
+	case INT, FLOAT:
+		f1, err1 := strconv.ParseFloat(a, 64)
+		f2, err2 := strconv.ParseFloat(b, 64)
+		if err1 == nil && err2 == nil {
+			switch {
+			case f1 < f2:
+				return -1
+			case f1 > f2:
+				return 1
+			default:
+				return 0
+			}
+		}
+
+	case BOOL:
+		b1, err1 := strconv.ParseBool(a)
+		b2, err2 := strconv.ParseBool(b)
+		if err1 == nil && err2 == nil {
+			switch {
+			case b1 == b2:
+				return 0
+			case !b1: // false < true
+				return -1
+			default:
+				return 1
+			}
+		}
+
+	case TIMESTAMP:
+		t1, err1 := parseTimestamp(a)
+		t2, err2 := parseTimestamp(b)
+		if err1 == nil && err2 == nil {
+			return t1.Compare(t2)
+		}
+	}
+
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,664 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WALSyncPolicy Write-ahead log sync policy enum, controlling when the log is flushed to disk w/ fsync
+//
+// SYNC_ALWAYS - The log is synced after every record, so a change is never lost once it's been made
+// SYNC_INTERVAL - The log is synced once WALSyncInterval has passed since it was last synced, if records have been written since,
+// so changes made in the last interval before a crash may be lost
+// SYNC_NEVER - The log is only synced at checkpoints, leaving it to the OS to write it to disk in between
+type WALSyncPolicy int
+
+const (
+	SYNC_ALWAYS WALSyncPolicy = iota
+	SYNC_INTERVAL
+	SYNC_NEVER
+)
+
+// Names of sync policies, as used in the WAL_SYNC .env variable
+var walSyncPolicyNames = map[WALSyncPolicy]string{
+	SYNC_ALWAYS:   "always",
+	SYNC_INTERVAL: "interval",
+	SYNC_NEVER:    "never",
+}
+
+func (p WALSyncPolicy) String() string {
+	return walSyncPolicyNames[p]
+}
+
+// WALSync When the write-ahead log is synced to disk (see WALSyncPolicy)
+var WALSync = SYNC_ALWAYS
+
+// WALSyncInterval Longest time between syncs of the write-ahead log, under the SYNC_INTERVAL policy
+var WALSyncInterval = 100 * time.Millisecond
+
+// CheckpointSize Size in bytes the write-ahead log can grow to before a checkpoint truncates it
+var CheckpointSize int64 = 4 * 1024 * 1024
+
+// Name of the write-ahead log file in a collection's directory
+const walFileName = "wal.log"
+
+// Write-ahead log record kind enum, one for each kind of change to a database
+type walOp int
+
+const (
+	WAL_INSERT walOp = iota
+	WAL_UPDATE
+	WAL_DELETE
+	WAL_ADD_COLUMN
+	WAL_DROP_COLUMN
+	WAL_RENAME_COLUMN
+	WAL_COMMIT
+)
+
+// A change to a database, as recorded in the write-ahead log
+// Only the fields needed for the kind of change are set. A committed transaction (see Tx) can change several databases,
+// so it's record has no DB, and has the changes to each database instead
+//
+// FIELDS:
+//
+//	LSN - Log sequence number. Numbers go up w/ each record, and are never reused in a collection
+//	DB - Name of the changed database
+//	Op - Kind of change
+//	Offset - For an insert, update or delete, size of the database file before any versions were appended to it
+//	Values - For an insert, the entry's values (including it's id), in the order of the database's columns
+//	Expired - For an update or delete, the versions of the entries it changed (see matchingChange)
+//	Inserted - For an update, the new versions of the entries, in the same order as Expired
+//	Column - For a column change, name of the column
+//	NewName - For a renamed column, the column's new name
+//	Type - For an added column, name of the column's type
+//	Changes - For a commit, the changes the transaction made to each database it changed (see versionChange)
+type walRecord struct {
+	LSN      uint64          `json:"lsn"`
+	DB       string          `json:"db"`
+	Op       walOp           `json:"op"`
+	Offset   int64           `json:"offset,omitempty"`
+	Values   []string        `json:"values,omitempty"`
+	Expired  []versionRef    `json:"expired,omitempty"`
+	Inserted [][]string      `json:"inserted,omitempty"`
+	Column   string          `json:"column,omitempty"`
+	NewName  string          `json:"new_name,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	Changes  []versionChange `json:"changes,omitempty"`
+}
+
+// A collection's write-ahead log. Every change to a database is recorded in the log before it's made to the database's files,
+// so if we crash part way through a change, it can be made again (replayed) when the collection is next loaded
+// Each database's metadata records the LSN of the last change made to it's files, so only later changes are replayed
+//
+// In the filesystem, the log is a file in the collection's directory (see walFileName). Each record is stored as
+// it's length (4 bytes), a CRC-32 checksum of it's contents (4 bytes), and it's contents (JSON). A record that's cut short
+// or doesn't match it's checksum was being written when we crashed, so it and anything after it are ignored.
+// The log is truncated at checkpoints, once every change in it has been synced to the database files
+// The log is shared by all of the collection's databases, so may be used by several goroutines at once
+//
+// ATTRIBUTES:
+//
+//	path - Path to the log file
+//	size - Size of the log file in bytes
+//	lastStart - Where in the log file the last record starts, so it can be removed if it's change fails
+//	nextLSN - LSN to give the next record
+//	lastSync - When the log was last synced
+//	unsynced - Whether records have been written since the log was last synced
+//	syncTimer - Under the SYNC_INTERVAL policy, syncs the log once WALSyncInterval has passed since it was last synced,
+//		if records have been written since. nil if no sync is pending
+//	coll - The collection the log belongs to
+//	failed - Set if a change in the log couldn't be made to the database files (see fail). No more records can be written
+//		and the log can't be truncated until the collection is reloaded, so the change is replayed then
+//	mu - Held while the log file (or the attributes above) are being read or written
+//	changes - Held for reading by each change from when it's recorded until it's been made to the database files,
+//		and for writing by checkpoints, so the log is never truncated while a change in it is only part made
+type writeAheadLog struct {
+	path      string
+	size      int64
+	lastStart int64
+	nextLSN   uint64
+	lastSync  time.Time
+	unsynced  bool
+	syncTimer *time.Timer
+	coll      *Collection
+	failed    error
+	mu        sync.Mutex
+	changes   sync.RWMutex
+}
+
+// Table used for record checksums
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Sets the write-ahead log settings from .env variables, where they're set:
+// WAL_SYNC (a sync policy name), WAL_SYNC_INTERVAL (a duration, e.g. '50ms') and CHECKPOINT_SIZE (a number of bytes)
+// Must be called after the .env file is loaded
+func loadWALSettings() {
+	if syncStr := os.Getenv("WAL_SYNC"); syncStr != "" {
+		found := false
+		for policy, name := range walSyncPolicyNames {
+			if strings.EqualFold(syncStr, name) {
+				WALSync, found = policy, true
+			}
+		}
+		if !found {
+			log.Fatalf("WAL_SYNC must be always, interval or never, got '%s'", syncStr)
+		}
+	}
+	if intervalStr := os.Getenv("WAL_SYNC_INTERVAL"); intervalStr != "" {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil || interval <= 0 {
+			log.Fatalf("WAL_SYNC_INTERVAL must be a positive duration, got '%s'", intervalStr)
+		}
+		WALSyncInterval = interval
+	}
+	if sizeStr := os.Getenv("CHECKPOINT_SIZE"); sizeStr != "" {
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size < 1 {
+			log.Fatalf("CHECKPOINT_SIZE must be a positive number of bytes, got '%s'", sizeStr)
+		}
+		CheckpointSize = size
+	}
+}
+
+// Opens a collection's write-ahead log, creating it if it doesn't exist, and reads the records in it
+// Anything after the last intact record is cut off the file, so new records follow on from it
+//
+// PARAMS:
+//
+//	collectionPath - path to the collection's directory
+//	readOnly - whether the collection is being loaded read-only, in which case the log file is only read
+//
+// RETURNS:
+//
+//	the log
+//	the records in the log, in order
+//	a dbError if the log file can't be read or written
+func openWAL(collectionPath string, readOnly bool) (*writeAheadLog, []*walRecord, error) {
+	wal := &writeAheadLog{path: filepath.Join(collectionPath, walFileName), nextLSN: 1, lastSync: time.Now()}
+	data, err := os.ReadFile(wal.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, &dbError{fmt.Sprintf("Couldn't read file %s", wal.path)}
+	}
+
+	records := make([]*walRecord, 0)
+	for len(data)-int(wal.size) >= 8 {
+		rest := data[wal.size:]
+		length := int64(binary.LittleEndian.Uint32(rest))
+		checksum := binary.LittleEndian.Uint32(rest[4:])
+		if int64(len(rest)) < 8+length || crc32.Checksum(rest[8:8+length], walChecksumTable) != checksum {
+			break
+		}
+		record := &walRecord{}
+		if json.Unmarshal(rest[8:8+length], record) != nil {
+			break
+		}
+		records = append(records, record)
+		wal.nextLSN = record.LSN + 1
+		wal.size += 8 + length
+	}
+
+	if int64(len(data)) != wal.size && !readOnly {
+		err = wal.truncate(wal.size)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return wal, records, nil
+}
+
+// Writes a record to the end of the log, giving it the next LSN, and syncs the log as WALSync says
+// A commit is always synced, so a transaction is never lost once it's been committed
+func (wal *writeAheadLog) append(record *walRecord) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.failed != nil {
+		return wal.failed
+	}
+
+	record.LSN = wal.nextLSN
+	contents, err := json.Marshal(record)
+	if err != nil {
+		return &dbError{"Couldn't encode write-ahead log record"}
+	}
+	data := make([]byte, 8, 8+len(contents))
+	binary.LittleEndian.PutUint32(data, uint32(len(contents)))
+	binary.LittleEndian.PutUint32(data[4:], crc32.Checksum(contents, walChecksumTable))
+	data = append(data, contents...)
+
+	file, err := os.OpenFile(wal.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't open file %s", wal.path)}
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err == nil && (WALSync == SYNC_ALWAYS || record.Op == WAL_COMMIT || (WALSync == SYNC_INTERVAL && time.Since(wal.lastSync) >= WALSyncInterval)) {
+		err = file.Sync()
+		wal.unsynced, wal.lastSync = false, time.Now()
+	} else if err == nil {
+		wal.unsynced = true
+		if WALSync == SYNC_INTERVAL && wal.syncTimer == nil {
+			wal.syncTimer = time.AfterFunc(WALSyncInterval-time.Since(wal.lastSync), wal.syncPending)
+		}
+	}
+	if err != nil {
+		wal.truncate(wal.size) // Don't leave part of a record behind
+		return &dbError{fmt.Sprintf("Couldn't write to file %s", wal.path)}
+	}
+
+	wal.lastStart = wal.size
+	wal.size += int64(len(data))
+	wal.nextLSN++
+	return nil
+}
+
+// Cuts the log file down to a size, syncing it
+// Once the log is open, must be called w/ wal.mu held
+func (wal *writeAheadLog) truncate(size int64) error {
+	file, err := os.OpenFile(wal.path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		err = file.Truncate(size)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+	}
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't truncate file %s", wal.path)}
+	}
+	wal.size = size
+	wal.unsynced, wal.lastSync = false, time.Now()
+	return nil
+}
+
+// Syncs the log file to disk, if records have been written since it was last synced
+// Must be called w/ wal.mu held
+func (wal *writeAheadLog) sync() error {
+	if !wal.unsynced {
+		return nil
+	}
+	err := syncFile(wal.path)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't sync file %s", wal.path)}
+	}
+	wal.unsynced, wal.lastSync = false, time.Now()
+	return nil
+}
+
+// Syncs the log for syncTimer, once WALSyncInterval has passed since it was last synced
+func (wal *writeAheadLog) syncPending() {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	wal.syncTimer = nil
+	err := wal.sync()
+	if err != nil {
+		log.Printf("Couldn't sync write-ahead log: %s", err)
+	}
+}
+
+// Syncs every file in a directory (apart from the log itself), then the directory, so that the files' contents
+// and any renames are on disk
+// Temporary files can be renamed away while we're syncing (e.g. by an index being built), so files that disappear are skipped
+func syncDir(dirPath string) error {
+	names, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range names {
+		if entry.IsDir() || entry.Name() == walFileName {
+			continue
+		}
+		err = syncFile(filepath.Join(dirPath, entry.Name()))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return syncFile(dirPath)
+}
+
+// Syncs a file (or directory) to disk
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Makes a checkpoint: syncs every database file in the collection, then truncates the log,
+// since every change in it is now on disk. LSNs carry on from where they were
+// Waits for any changes being made to finish first, so mustn't be called while making a change
+func (wal *writeAheadLog) checkpoint() error {
+	wal.changes.Lock()
+	defer wal.changes.Unlock()
+
+	err := syncDir(wal.coll.Path)
+	if err != nil {
+		return &dbError{fmt.Sprintf("Couldn't sync collection directory %s", wal.coll.Path)}
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.failed != nil {
+		return wal.failed
+	}
+	return wal.truncate(0)
+}
+
+// Closes the log: syncs it, stopping any pending sync, then makes a checkpoint, so nothing needs replaying when the collection is next loaded
+// Nothing can be written to the log once it's closed
+func (wal *writeAheadLog) close() error {
+	wal.mu.Lock()
+	if wal.syncTimer != nil {
+		wal.syncTimer.Stop()
+		wal.syncTimer = nil
+	}
+	err := wal.sync()
+	wal.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return wal.checkpoint()
+}
+
+// Stops the log being written to or truncated, after a change recorded in it couldn't be made to the database files
+// The change is left in the log, so it's finished when the collection is next loaded (see Collection.replay)
+//
+// PARAMS: err - the error to return for any later change or checkpoint
+func (wal *writeAheadLog) fail(err error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.failed == nil {
+		wal.failed = err
+	}
+}
+
+// Gets the LSN of the last record written to the log, or of the last change before the log was truncated
+func (wal *writeAheadLog) lastLSN() uint64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.nextLSN - 1
+}
+
+// Checks if the log has grown big enough to need a checkpoint (see CheckpointSize)
+func (wal *writeAheadLog) full() bool {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.size >= CheckpointSize
+}
+
+// Removes a record from the end of the log, if no record has been written after it
+func (wal *writeAheadLog) removeLast(record *walRecord) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if record.LSN == wal.nextLSN-1 && wal.size > 0 {
+		wal.truncate(wal.lastStart)
+	}
+}
+
+// Records a change to a database in the write-ahead log, before it's made to the database's files
+// If it's recorded, finishChange must be called once the change has been made (or has failed)
+// Does nothing if the database doesn't belong to a collection w/ a log
+func (db *Database) logChange(record *walRecord) error {
+	if db.wal == nil {
+		return nil
+	}
+	record.DB = db.name()
+	db.wal.changes.RLock()
+	err := db.wal.append(record)
+	if err != nil {
+		db.wal.changes.RUnlock()
+	}
+	return err
+}
+
+// Finishes a change recorded by logChange
+// If the change was made, records it's LSN in the database's metadata, then makes a checkpoint if the log has grown too big.
+// If it failed, it's removed from the log so it isn't replayed
+//
+// PARAMS:
+//
+//	record - the change's record
+//	err - the error making the change, or nil if it was made
+//
+// RETURNS: err, or a dbError if we couldn't update the metadata or log
+func (db *Database) finishChange(record *walRecord, err error) error {
+	if db.wal == nil {
+		if err != nil {
+			return err
+		}
+		return db.saveMetadata()
+	}
+
+	if err != nil {
+		db.wal.removeLast(record)
+		db.wal.changes.RUnlock()
+		return err
+	}
+
+	db.lsn = record.LSN
+	err = db.saveMetadata()
+	db.wal.changes.RUnlock()
+	if err != nil {
+		return err
+	}
+	if db.wal.full() {
+		return db.wal.checkpoint()
+	}
+	return nil
+}
+
+// Replays the changes in the log that haven't been made to their database's files
+// Changes to databases that no longer exist are skipped. A commit is replayed for each database it changed
+//
+// PARAMS: records - the records in the log, in order
+func (coll *Collection) replay(records []*walRecord) error {
+	replayed := make(map[*Database]bool)
+	replayInto := func(dbName string, lsn uint64, replayFn func(db *Database) error) error {
+		db, exists := coll.dbs[dbName]
+		if !exists || lsn <= db.lsn {
+			return nil
+		}
+		err := replayFn(db)
+		if err != nil {
+			return err
+		}
+		db.lsn = lsn
+		replayed[db] = true
+		return nil
+	}
+
+	for _, record := range records {
+		if record.Op != WAL_COMMIT {
+			err := replayInto(record.DB, record.LSN, func(db *Database) error { return db.replay(record) })
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, change := range record.Changes {
+			err := replayInto(change.DB, record.LSN, func(db *Database) error { return db.replayChange(record.LSN, change) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for db := range replayed {
+		err := db.buildIndexes(db.indexes...)
+		if err == nil {
+			err = db.saveMetadata()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes a change recorded in the log to the database's files
+// The change may already have been made, in part or in full, so each kind of change is made in a way that can be repeated:
+// an insert truncates the database file back to where the entry was appended, an update or delete truncates it back to where it's versions
+// were appended and leaves versions it already expired as they are (see replayChange), and a column change is skipped if the columns already show it
+func (db *Database) replay(record *walRecord) error {
+	switch record.Op {
+	case WAL_INSERT:
+		err := os.Truncate(db.FilePath, record.Offset)
+		if err != nil {
+			return &dbError{fmt.Sprintf("Couldn't truncate file %s", db.FilePath)}
+		}
+		_, err = db.appendEntry(record.Values, db.changeTimestamp(record))
+		if err != nil {
+			return err
+		}
+		id, convErr := strconv.Atoi(record.Values[slices.Index(db.Columns, "id")])
+		if convErr == nil {
+			db.reserveID(id)
+		}
+		return nil
+
+	case WAL_UPDATE, WAL_DELETE:
+		return db.replayChange(record.LSN, versionChange{Offset: record.Offset, Expired: record.Expired, Inserted: record.Inserted})
+
+	case WAL_ADD_COLUMN:
+		colType, err := ParseColumnType(record.Type)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(db.Columns, record.Column) {
+			db.Types[record.Column] = colType
+			return nil
+		}
+		return db.applyAddColumn(record.Column, colType)
+
+	case WAL_DROP_COLUMN:
+		if !slices.Contains(db.Columns, record.Column) {
+			return nil
+		}
+		return db.applyDropColumn(record.Column)
+
+	case WAL_RENAME_COLUMN:
+		if !slices.Contains(db.Columns, record.Column) || slices.Contains(db.Columns, record.NewName) {
+			return nil
+		}
+		return db.applyRenameColumn(record.Column, record.NewName)
+	}
+	return &dbError{fmt.Sprintf("Unknown change in write-ahead log (LSN %d)", record.LSN)}
+}
+
+// Undoes any entry that was only partly appended to a database file when we crashed, before the database is loaded
+// (as a half-written entry can't be read). The 1st insert, update, delete or commit that changed the database and hasn't been recorded
+// in it's metadata appended it's versions at the end of the file, so the file is truncated back to where they started
+//
+// PARAMS:
+//
+//	dbFilePath - path to the database's CSV file (with '.csv' suffix included)
+//	records - the records in the log, in order
+func repairTornAppend(dbFilePath string, records []*walRecord) error {
+	meta, err := loadMetadata(dbFilePath)
+	if err != nil {
+		return nil // A DB w/o metadata predates the log
+	}
+	name := strings.TrimSuffix(filepath.Base(dbFilePath), ".csv")
+	for _, record := range records {
+		if record.LSN <= meta.LSN {
+			continue
+		}
+		offset := int64(0)
+		switch record.Op {
+		case WAL_INSERT, WAL_UPDATE, WAL_DELETE:
+			if record.DB != name {
+				continue
+			}
+			offset = record.Offset
+		case WAL_COMMIT:
+			i := slices.IndexFunc(record.Changes, func(change versionChange) bool { return change.DB == name })
+			if i == -1 {
+				continue
+			}
+			offset = record.Changes[i].Offset
+		default:
+			if record.DB != name {
+				continue
+			}
+		}
+		if offset == 0 {
+			return nil // A column change, or a change recorded before offsets were, rewrote the file in one go
+		}
+
+		info, err := os.Stat(dbFilePath)
+		if err == nil && info.Size() > offset {
+			err = os.Truncate(dbFilePath, offset)
+		}
+		if err != nil {
+			return &dbError{fmt.Sprintf("Couldn't repair file %s", dbFilePath)}
+		}
+		return nil
+	}
+	return nil
+}
+
+// Gets the database's name, from it's file path
+func (db *Database) name() string {
+	return strings.TrimSuffix(filepath.Base(db.FilePath), ".csv")
+}
+
+// Checks that a collection being loaded read-only doesn't need recovering from a crash, as recovering would write to it
+// It needs recovering if a change in the log (including a commit) wasn't made to it's database's files,
+// or a database is in an older format (see currentFileFormat)
+//
+// PARAMS:
+//
+//	collectionPath - path to the collection's directory
+//	name - name of the collection
+//	records - the records in the log, in order
+//
+// RETURNS: a CollError if the collection needs recovering, saying why
+func checkRecovered(collectionPath string, name string, records []*walRecord) error {
+	needsRecovery := func(reason string) error {
+		return &CollError{fmt.Sprintf("COLLECTION '%s' CAN'T BE LOADED READ-ONLY AS %s. LOAD IT FOR WRITING FIRST", name, reason)}
+	}
+
+	entries, err := os.ReadDir(collectionPath)
+	if err != nil {
+		return &CollError{fmt.Sprintf("COULDN'T READ COLLECTION DIRECTORY %s", collectionPath)}
+	}
+	lsns := make(map[string]uint64)
+	for _, entry := range entries {
+		dbName, isDB := strings.CutSuffix(entry.Name(), ".csv")
+		if !isDB || entry.IsDir() {
+			continue
+		}
+		meta, err := loadMetadata(filepath.Join(collectionPath, entry.Name()))
+		if err != nil || meta.Format < currentFileFormat {
+			return needsRecovery(fmt.Sprintf("DATABASE '%s' IS IN AN OLDER FORMAT", dbName))
+		}
+		lsns[dbName] = meta.LSN
+	}
+
+	for _, record := range records {
+		dbNames := []string{record.DB}
+		if record.Op == WAL_COMMIT {
+			dbNames = dbNames[:0]
+			for _, change := range record.Changes {
+				dbNames = append(dbNames, change.DB)
+			}
+		}
+		for _, dbName := range dbNames {
+			if lsn, exists := lsns[dbName]; exists && record.LSN > lsn {
+				return needsRecovery(fmt.Sprintf("CHANGES TO DATABASE '%s' WEREN'T FINISHED", dbName))
+			}
+		}
+	}
+	return nil
+}
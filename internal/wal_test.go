@@ -0,0 +1,394 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOpenWAL(t *testing.T) {
+	tests := []struct {
+		name      string
+		corruptFn func(data []byte) []byte
+		records   int
+	}{
+		{"intact", func(data []byte) []byte { return data }, 3},
+		{"torn last record", func(data []byte) []byte { return data[:len(data)-5] }, 2},
+		{"torn length", func(data []byte) []byte { return append(data, 1, 0, 0) }, 3},
+		{"checksum mismatch", func(data []byte) []byte {
+			data[len(data)-2] ^= 0xff
+			return data
+		}, 2},
+		{"all torn", func(data []byte) []byte { return data[:6] }, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, _, err := openWAL(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ends := []int64{0}
+			for _, value := range []string{"a", "b", "c"} {
+				err = wal.append(&walRecord{DB: "people", Op: WAL_INSERT, Values: []string{"1", value}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ends = append(ends, wal.size)
+			}
+			data, err := os.ReadFile(wal.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			corrupted := test.corruptFn(data)
+			err = os.WriteFile(wal.path, corrupted, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A read-only open leaves the file alone
+			_, records, err := openWAL(dir, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != test.records {
+				t.Errorf("read-only open read %d records, want %d", len(records), test.records)
+			}
+			if info, _ := os.Stat(wal.path); info.Size() != int64(len(corrupted)) {
+				t.Errorf("read-only open changed the log's size to %d, want %d", info.Size(), len(corrupted))
+			}
+
+			wal, records, err = openWAL(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != test.records {
+				t.Fatalf("read %d records, want %d", len(records), test.records)
+			}
+			for i, record := range records {
+				if record.LSN != uint64(i+1) || record.Values[1] != []string{"a", "b", "c"}[i] {
+					t.Errorf("record %d is %+v", i, record)
+				}
+			}
+			if wal.nextLSN != uint64(test.records+1) {
+				t.Errorf("next LSN is %d, want %d", wal.nextLSN, test.records+1)
+			}
+			if info, _ := os.Stat(wal.path); info.Size() != ends[test.records] || wal.size != ends[test.records] {
+				t.Errorf("log is %d bytes (%d on disk), want %d", wal.size, info.Size(), ends[test.records])
+			}
+		})
+	}
+}
+
+// Reads a database's CSV and metadata files
+func readDBFiles(t *testing.T, db *Database) [][]byte {
+	t.Helper()
+	files := make([][]byte, 0, 2)
+	for _, path := range []string{db.FilePath, metadataPath(db.FilePath)} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, data)
+	}
+	return files
+}
+
+// Releases a collection's lock w/o closing it's log, as if we'd crashed, then loads it again (replaying it's log)
+// and gets one of it's databases
+func reloadDB(t *testing.T, coll *Collection, name string) (*Collection, *Database) {
+	t.Helper()
+	coll.stopGC()
+	coll.lock.Close()
+	coll, err := LoadCollection("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { coll.Close() })
+	db, err := coll.GetDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coll, db
+}
+
+func TestWALReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		changeFn func(db *Database) error
+	}{
+		{"insert", func(db *Database) error { return db.Insert([]string{"name", "age"}, []string{"dan", "40"}) }},
+		{"update", func(db *Database) error {
+			_, err := db.Update(map[string]string{"age": "99"}, "age > 25")
+			return err
+		}},
+		{"delete", func(db *Database) error {
+			_, err := db.Delete("name = 'bob'")
+			return err
+		}},
+		{"add column", func(db *Database) error { return db.AddColumn("email", TEXT) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coll := newTestCollection(t)
+			db := newTestDB(t, coll, "people", []string{"name", "age:int"},
+				[]string{"alice", "30"}, []string{"bob", "20"}, []string{"carol", "50"})
+			before := readDBFiles(t, db)
+			err := test.changeFn(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := readDBFiles(t, db)
+			wantRows := selectRows(t, db, SelectQuery{})
+
+			_, records, err := openWAL(coll.Path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := records[len(records)-1]
+
+			// Replaying a change that's already been made leaves the database as it is
+			db.mu.Lock()
+			err = db.replay(record)
+			db.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readDBFiles(t, db); !slices.Equal(got[0], after[0]) {
+				t.Errorf("replaying a made change gave file\n%s\nwant\n%s", got[0], after[0])
+			}
+
+			// Put the database's files back as they were before the change, so loading the collection replays it
+			for i, path := range []string{db.FilePath, metadataPath(db.FilePath)} {
+				err = os.WriteFile(path, before[i], 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for range 2 {
+				coll, db = reloadDB(t, coll, "people")
+				if got := readDBFiles(t, db); !slices.Equal(got[0], after[0]) {
+					t.Errorf("replayed change gave file\n%s\nwant\n%s", got[0], after[0])
+				}
+				if db.lsn != record.LSN {
+					t.Errorf("database's LSN is %d, want %d", db.lsn, record.LSN)
+				}
+				if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, wantRows) {
+					t.Errorf("got rows %q, want %q", got, wantRows)
+				}
+			}
+		})
+	}
+}
+
+func TestRepairTornAppend(t *testing.T) {
+	tests := []struct {
+		name     string
+		changeFn func(db *Database) error
+		aged30   []string // Rows w/ age = 30 once the change is made
+	}{
+		{"insert", func(db *Database) error { return db.Insert([]string{"name", "age"}, []string{"bob", "20"}) }, []string{"1|alice|30"}},
+		{"update", func(db *Database) error {
+			_, err := db.Update(map[string]string{"age": "31"}, "name = 'alice'")
+			return err
+		}, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coll := newTestCollection(t)
+			db := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"})
+			err := db.CreateIndex([]string{"age"}, HASH_INDEX, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := readDBFiles(t, db)
+			err = test.changeFn(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRows := selectRows(t, db, SelectQuery{})
+
+			// Leave the database as a crash part way through appending the new version could: w/ the start of it in the file, but not in the metadata.
+			// An update has already expired the old version in place
+			after := readDBFiles(t, db)
+			torn := after[0][:len(before[0])+3]
+			err = os.WriteFile(db.FilePath, torn, 0644)
+			if err == nil {
+				err = os.WriteFile(metadataPath(db.FilePath), before[1], 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, db = reloadDB(t, coll, "people")
+			if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, wantRows) {
+				t.Errorf("got rows %q, want %q", got, wantRows)
+			}
+			if got := selectRows(t, db, SelectQuery{Condition: "age = 30"}); !slices.Equal(got, test.aged30) {
+				t.Errorf("got rows %q w/ age = 30 from the index, want %q", got, test.aged30)
+			}
+		})
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	coll := newTestCollection(t)
+	db := newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"}, []string{"bob", "20"})
+	_, err := db.Delete("name = 'alice'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsn := coll.wal.lastLSN()
+
+	err = coll.wal.checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(coll.Path, walFileName)); err != nil || info.Size() != 0 {
+		t.Fatalf("log wasn't truncated by checkpoint: %v, %v", info, err)
+	}
+	if coll.wal.lastLSN() != lsn {
+		t.Errorf("last LSN after checkpoint is %d, want %d", coll.wal.lastLSN(), lsn)
+	}
+
+	coll, db = reloadDB(t, coll, "people")
+	if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"2|bob|20"}) {
+		t.Errorf("got rows %q after reopening, want bob's", got)
+	}
+
+	// LSNs carry on from before the checkpoint
+	err = db.Insert([]string{"name", "age"}, []string{"carol", "50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.lsn != lsn+1 {
+		t.Errorf("LSN of insert after reopening is %d, want %d", db.lsn, lsn+1)
+	}
+}
+
+func TestCommitNotMade(t *testing.T) {
+	coll := newTestCollection(t)
+	newTestDB(t, coll, "people", []string{"name", "age:int"}, []string{"alice", "30"})
+	db := newTestDB(t, coll, "pets", []string{"name"}, []string{"rex"})
+	err := db.CreateIndex([]string{"name"}, HASH_INDEX, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := coll.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"people", "pets"} {
+		txDB, err := tx.GetDB(name)
+		if err == nil {
+			_, err = txDB.Update(map[string]string{"name": "bob"}, "id = 1")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory in place of the pets index's file stops the new version being added to it
+	idxPath := db.indexes[0].path
+	err = os.Remove(idxPath)
+	if err == nil {
+		err = os.Mkdir(idxPath, 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Commit() == nil {
+		t.Fatal("commit succeeded, want an error")
+	}
+	if db.Insert([]string{"name"}, []string{"tom"}) == nil {
+		t.Error("insert succeeded after a commit wasn't made, want an error")
+	}
+	if coll.wal.checkpoint() == nil {
+		t.Error("checkpoint succeeded after a commit wasn't made, want an error")
+	}
+
+	// The rest of the commit is made once the collection is reloaded
+	err = os.Remove(idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll, db = reloadDB(t, coll, "pets")
+	if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"1|bob"}) {
+		t.Errorf("got pets %q, want bob", got)
+	}
+	people, err := coll.GetDB("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := selectRows(t, people, SelectQuery{}); !slices.Equal(got, []string{"1|bob|30"}) {
+		t.Errorf("got people %q, want bob", got)
+	}
+	err = db.Insert([]string{"name"}, []string{"tom"})
+	if err != nil {
+		t.Errorf("insert after reloading failed: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	policy := WALSync
+	WALSync = SYNC_NEVER
+	t.Cleanup(func() { WALSync = policy })
+	coll := newTestCollection(t)
+	newTestDB(t, coll, "people", []string{"name"}, []string{"alice"})
+
+	// Closing syncs the log and makes a checkpoint, so nothing is left to replay
+	err := coll.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(coll.Path, walFileName)); err != nil || info.Size() != 0 {
+		t.Errorf("log wasn't truncated by close: %v, %v", info, err)
+	}
+	coll, err = LoadCollection("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { coll.Close() })
+	db, err := coll.GetDB("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := selectRows(t, db, SelectQuery{}); !slices.Equal(got, []string{"1|alice"}) {
+		t.Errorf("got rows %q after reopening, want alice's", got)
+	}
+}
+
+func TestIntervalSync(t *testing.T) {
+	policy, interval := WALSync, WALSyncInterval
+	WALSync, WALSyncInterval = SYNC_INTERVAL, 20*time.Millisecond
+	t.Cleanup(func() { WALSync, WALSyncInterval = policy, interval })
+	coll := newTestCollection(t)
+	db := newTestDB(t, coll, "people", []string{"name"})
+
+	// A record written straight after a sync is left unsynced, until the interval has passed
+	coll.wal.mu.Lock()
+	coll.wal.lastSync = time.Now()
+	coll.wal.mu.Unlock()
+	err := db.Insert([]string{"name"}, []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll.wal.mu.Lock()
+	unsynced := coll.wal.unsynced
+	coll.wal.mu.Unlock()
+	if !unsynced {
+		t.Fatal("log was synced straight after a record was written, want it left until the interval has passed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	coll.wal.mu.Lock()
+	unsynced = coll.wal.unsynced
+	coll.wal.mu.Unlock()
+	if unsynced {
+		t.Error("log wasn't synced once the interval had passed")
+	}
+}
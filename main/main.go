@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"github.com/golang_db/cmd"
 	"github.com/golang_db/internal"
 	"log"
 	"os"
@@ -12,13 +14,28 @@ import (
 func main() {
 
 	// Desired collection to open is provided as an OS arg
-	collectionName := os.Args[1]
-
-	currentCollection, err := internal.LoadCollection(collectionName)
-	if err != nil { // If collection does not exist, make new one under that name
-		currentCollection := internal.MakeNewCollection(collectionName)
-		fmt.Println("CREATED NEW COLLECTION: " + currentCollection.Name)
+	// With the -readonly flag, the collection is opened read-only, so other read-only processes can open it at the same time
+	readOnly := flag.Bool("readonly", false, "open the collection read-only")
+	flag.Parse()
+	collectionName := flag.Arg(0)
+
+	var currentCollection *internal.Collection
+	var err error
+	if *readOnly {
+		currentCollection, err = internal.LoadCollectionReadOnly(collectionName)
 	} else {
+		currentCollection, err = internal.LoadCollection(collectionName)
+	}
+	switch {
+	case os.IsNotExist(err) && !*readOnly: // If collection does not exist, make new one under that name
+		currentCollection = internal.MakeNewCollection(collectionName)
+		fmt.Println("CREATED NEW COLLECTION: " + currentCollection.Name)
+	case err != nil: // e.g. another process has the collection open
+		fmt.Println(err.Error())
+		os.Exit(1)
+	case *readOnly:
+		fmt.Println("LOADED COLLECTION (READ-ONLY): " + currentCollection.Name)
+	default:
 		fmt.Println("LOADED COLLECTION: " + currentCollection.Name)
 	}
 
@@ -33,7 +50,7 @@ func main() {
 			log.Fatal(err)
 		}
 
-		Parse(command, currentCollection)
+		cmd.Parse(command, currentCollection)
 		fmt.Println() // Go to newline for next command
 
 	}